@@ -2,77 +2,182 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"gochop-it/internal/analytics"
+	"gochop-it/internal/config"
 	"gochop-it/internal/handlers"
+	"gochop-it/internal/health"
+	"gochop-it/internal/logging"
+	"gochop-it/internal/middleware"
 	"gochop-it/internal/repository"
 	"gochop-it/internal/routes"
+	"gochop-it/internal/screening"
+	"gochop-it/internal/tracing"
+	"gochop-it/internal/utils"
 )
 
+// connectTimeout bounds each attempt to reach a dependency at startup
+const connectTimeout = 10 * time.Second
+
+// drainTimeout bounds writing the buffered clicks and traces on shutdown
+const drainTimeout = 10 * time.Second
+
 func main() {
 	ctx := context.Background()
 
-	// MongoDB setup
-	mongoRepo, err := repository.NewMongoRepo(ctx)
+	// Subcommands back up and restore the links instead of serving
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		if err := runTransfer(ctx, os.Args[1], os.Args[2:]); err != nil {
+			fatal(os.Args[1]+" failed", err)
+		}
+		return
+	}
+
+	// Load configuration from CONFIG_FILE and the environment
+	cfg, err := config.Load()
+	if err != nil {
+		fatal("Could not load config", err)
+	}
+	// Structured logs, records logged with a request's context carry its request ID
+	slog.SetDefault(logging.New(os.Stderr, cfg.Log))
+	// Clicks are recorded with hashed client IPs, which the salt keeps from being reversed
+	if err := cfg.Analytics.CheckIPHashSalt(); err != nil {
+		fatal("Invalid analytics settings", err)
+	}
+
+	// Spans are exported over OTLP when a collector endpoint is configured
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
 	if err != nil {
-		log.Fatalf("Could not connect to MongoDB: %v", err)
+		fatal("Could not set up tracing", err)
 	}
-	fmt.Println("Connected to MongoDB!")
 
-	// Ensure MongoDB connection is valid
-	err = mongoRepo.Client.Ping(ctx, nil)
+	// Short codes are obfuscated when a secret is configured
+	codec, err := cfg.Codes.ShortCodec()
 	if err != nil {
-		log.Fatalf("MongoDB ping failed: %v", err)
+		fatal("Invalid short code settings", err)
+	}
+	utils.SetShortCodec(codec)
+	// Equivalent spellings of a URL are deduped onto one link
+	utils.SetCanonicalizer(cfg.Links.Canonicalizer())
+
+	// Storage setup, MongoDB unless another backend is configured
+	urlRepo, err := repository.NewURLRepository(ctx, cfg)
+	if err != nil {
+		fatal("Could not open storage backend", err)
 	}
-	fmt.Println("MongoDB connection is active!")
 
 	// Redis setup
-	redisRepo := repository.NewRedisRepo()
+	redisRepo := repository.NewRedisRepo(cfg.Redis)
+
+	// Background work runs until shutdown
+	listenCtx, stopListening := context.WithCancel(ctx)
+	defer stopListening()
+
+	// An unreachable dependency doesn't stop the server, it starts degraded, /readyz reports
+	// the outage and the connection is retried in the background until it comes back
+	health.Connect(listenCtx, cfg.Storage.Backend, connectTimeout, func(ctx context.Context) error {
+		if err := urlRepo.Ping(ctx); err != nil {
+			return err
+		}
+		// Ensure indexes, including the TTL index that purges expired links
+		return urlRepo.EnsureIndexes(ctx)
+	})
+	health.Connect(listenCtx, "redis", connectTimeout, redisRepo.Ping)
+
+	// Drop locally cached links when any instance edits or deletes them
+	go redisRepo.ListenForInvalidations(listenCtx)
 
-	// Ensure Redis connection is valid
-	if e := redisRepo.Ping(ctx); e != nil {
-		log.Fatalf("Could not connect to Redis: %v", e)
+	// Click analytics, with countries only when a GeoIP database is configured
+	var geo *analytics.GeoIP
+	if cfg.Analytics.GeoIPPath != "" {
+		geo, err = analytics.LoadGeoIP(cfg.Analytics.GeoIPPath)
+		if err != nil {
+			fatal("Could not load GeoIP database", err)
+		}
+	}
+	recorder := analytics.NewRecorder(urlRepo, cfg.Analytics.IPHashSalt, geo)
+
+	// Access counts are buffered and written in batches off the redirect path
+	clickCounter := analytics.NewClickCounter(urlRepo, cfg.Analytics.ClickFlushInterval)
+
+	// Destination screening, the blocklist file is reloaded when it changes
+	var blocklist *screening.Blocklist
+	if cfg.Screening.BlocklistPath != "" {
+		blocklist, err = screening.LoadBlocklist(cfg.Screening.BlocklistPath)
+		if err != nil {
+			fatal("Could not load blocklist", err)
+		}
+		go blocklist.Watch(listenCtx, cfg.Screening.BlocklistReloadInterval)
 	}
-	fmt.Println("Connected to Redis!")
+	var reputation screening.Reputation
+	if cfg.Screening.SafeBrowsingAPIKey != "" {
+		reputation = screening.NewSafeBrowsing(cfg.Screening.SafeBrowsingAPIKey)
+	}
+	screener := screening.NewScreener(blocklist, reputation, cfg.Screening.AllowPrivateHosts)
 
 	// Initialize Handlers
-	handlers, err := handlers.NewHandlers(mongoRepo, redisRepo)
+	handlers, err := handlers.NewHandlers(urlRepo, redisRepo, recorder, clickCounter, screener, cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize handlers: %v", err)
+		fatal("Failed to initialize handlers", err)
 	}
 
 	// Register Routes
-	routes.RegisterRoutes(handlers)
+	routes.RegisterRoutes(handlers, cfg)
 
-	// Server Setup
+	// Server Setup, every request gets an ID for its log lines
 	srv := &http.Server{
-		Addr: ":8080",
+		Addr:     cfg.Server.Addr,
+		Handler:  middleware.RequestID(http.DefaultServeMux),
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelError),
 	}
 
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed: %v", err)
+			fatal("Server failed", err)
 		}
 	}()
-	fmt.Println("Server is running on http://localhost:8080")
+	slog.Info("Server is running", "addr", cfg.Server.Addr)
 
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	fmt.Println("Shutting down server...")
+	slog.Info("Shutting down server")
 
 	ctxShutDown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// Keep going on a forced shutdown so buffered clicks are still written
 	if err := srv.Shutdown(ctxShutDown); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		slog.Error("Server forced to shutdown", "error", err)
+	}
+	// With the server stopped no more clicks arrive, so drain the buffers. The drain gets its own
+	// timeout, waiting for slow requests may have used up the server's.
+	ctxDrain, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
+	if err := clickCounter.Close(ctxDrain); err != nil {
+		slog.Error("Failed to flush click counts", "error", err)
+	}
+	if err := recorder.Close(ctxDrain); err != nil {
+		slog.Error("Failed to flush click events", "error", err)
+	}
+	if err := urlRepo.Close(ctxDrain); err != nil {
+		slog.Error("Failed to close storage backend", "error", err)
 	}
-	fmt.Println("Server exiting")
+	if err := shutdownTracing(ctxDrain); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+	slog.Info("Server exiting")
+}
+
+// fatal logs an error that keeps the server from running and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gochop-it/internal/config"
+	"gochop-it/internal/logging"
+	"gochop-it/internal/repository"
+	"gochop-it/internal/transfer"
+	"gochop-it/internal/utils"
+)
+
+// runTransfer runs the export or import subcommand against the configured storage backend.
+// Progress goes to stderr, so an export to stdout can be piped straight into a file.
+// Imports must run with every server stopped: the url_counter is raised past the imported IDs,
+// but blocks of IDs already leased by a running server can't be taken back.
+func runTransfer(ctx context.Context, command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	format := flags.String("format", "", "ndjson or csv, by default taken from the file extension")
+	var verify *bool
+	if command == "import" {
+		verify = flags.Bool("verify", true, "read the links back after the import and check they match")
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags] [file]\n\n", filepath.Base(os.Args[0]), command)
+		fmt.Fprintln(flags.Output(), "Export writes to stdout and import reads from stdin when no file is given.")
+		if command == "import" {
+			fmt.Fprintln(flags.Output(), "Stop every server first, running servers may hand out imported IDs from blocks they already leased.")
+		}
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	path := flags.Arg(0)
+	if *format == "" && strings.EqualFold(filepath.Ext(path), ".csv") {
+		*format = transfer.FormatCSV
+	}
+	if _, err := transfer.ParseFormat(*format); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("could not load config: %w", err)
+	}
+	// Logged like the server, so a restore run by a job lands in the same log pipeline
+	slog.SetDefault(logging.New(os.Stderr, cfg.Log))
+	// Replaced links are dropped from the cache under the codes the server serves them at
+	codec, err := cfg.Codes.ShortCodec()
+	if err != nil {
+		return fmt.Errorf("invalid short code settings: %w", err)
+	}
+	utils.SetShortCodec(codec)
+	repo, err := repository.NewURLRepository(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("could not open storage backend: %w", err)
+	}
+	defer repo.Close(ctx)
+	if err := repo.Ping(ctx); err != nil {
+		return fmt.Errorf("storage ping failed: %w", err)
+	}
+
+	if command == "export" {
+		var count int
+		if path == "" {
+			count, err = transfer.Export(ctx, repo, os.Stdout, *format)
+		} else {
+			count, err = exportFile(ctx, repo, path, *format)
+		}
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Exported links", "count", count)
+		return nil
+	}
+
+	in := io.Reader(os.Stdin)
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	// The unique indexes have to exist before links are written
+	if err := repo.EnsureIndexes(ctx); err != nil {
+		return fmt.Errorf("could not create storage indexes: %w", err)
+	}
+	cache := repository.NewRedisRepo(cfg.Redis)
+	defer cache.Client.Close()
+	result, err := transfer.Import(ctx, repo, cache, in, *format)
+	if err != nil {
+		return fmt.Errorf("after %d links: %w", result.Imported, err)
+	}
+	slog.InfoContext(ctx, "Imported links", "count", result.Imported, "max_id", result.MaxID)
+	if *verify {
+		if err := transfer.Verify(ctx, repo, result); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Verified links", "count", result.Imported)
+	}
+	return nil
+}
+
+// exportFile exports the links to path. The file is synced and closed before returning,
+// so an export that didn't make it to disk fails instead of being reported as done.
+func exportFile(ctx context.Context, repo repository.URLRepository, path, format string) (int, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	count, err := transfer.Export(ctx, repo, file, format)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return count, err
+}
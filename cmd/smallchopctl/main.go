@@ -0,0 +1,238 @@
+// Command smallchopctl lets operators inspect and fix links without a database shell.
+// It reads the same configuration as the server, from CONFIG_FILE and the environment.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"gochop-it/internal/config"
+	"gochop-it/internal/repository"
+	"gochop-it/internal/transfer"
+	"gochop-it/internal/utils"
+)
+
+const usage = `Usage: smallchopctl <command> [arguments]
+
+Commands:
+  lookup <code>      show the link stored for a short code or alias and its cache state
+  disable <code>     make the link answer 410 Gone until it is enabled again
+  enable <code>      re-enable a disabled link
+  delete <code>      soft delete the link, its code and alias stay reserved
+  flush <key>...     drop keys from Redis and the local cache of every instance
+  top [-n count]     list the links with the most clicks (default 10)
+`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	ctx := context.Background()
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Could not load config: %v", err)
+	}
+	// Codes are decoded with the server's codec, so obfuscated codes resolve to the right ID
+	codec, err := cfg.Codes.ShortCodec()
+	if err != nil {
+		log.Fatalf("Invalid short code settings: %v", err)
+	}
+	utils.SetShortCodec(codec)
+
+	repo, err := repository.NewURLRepository(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Could not open storage backend: %v", err)
+	}
+	defer repo.Close(ctx)
+
+	c := &ctl{repo: repo, redis: repository.NewRedisRepo(cfg.Redis), out: os.Stdout}
+	if err := c.run(ctx, os.Args[1:]); err != nil {
+		log.Fatalf("%s: %v", os.Args[1], err)
+	}
+}
+
+// errUsage is returned for a malformed command line
+var errUsage = errors.New("invalid arguments\n\n" + usage)
+
+// ctl runs the commands against the storage backend and the Redis cache
+type ctl struct {
+	repo  repository.URLRepository
+	redis *repository.RedisRepo
+	out   io.Writer
+}
+
+// run dispatches a command line, without the program name
+func (c *ctl) run(ctx context.Context, args []string) error {
+	command, args := args[0], args[1:]
+	switch command {
+	case "lookup", "disable", "enable", "delete":
+		if len(args) != 1 {
+			return errUsage
+		}
+		switch command {
+		case "lookup":
+			return c.lookup(ctx, args[0])
+		case "delete":
+			return c.delete(ctx, args[0])
+		default:
+			return c.setDisabled(ctx, args[0], command == "disable")
+		}
+	case "flush":
+		if len(args) == 0 {
+			return errUsage
+		}
+		return c.flush(ctx, args)
+	case "top":
+		flags := flag.NewFlagSet("top", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		n := flags.Int("n", 10, "number of links to list")
+		if err := flags.Parse(args); err != nil || flags.NArg() > 0 || *n < 1 {
+			return errUsage
+		}
+		return c.top(ctx, *n)
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", command, usage)
+	}
+}
+
+// find resolves a short code or alias to its link
+func (c *ctl) find(ctx context.Context, code string) (*repository.URL, error) {
+	if !utils.IsValidShortCode(code) {
+		return nil, fmt.Errorf("%q is not a valid short code or alias", code)
+	}
+	return repository.FindURLByShortCode(ctx, c.repo, code)
+}
+
+// lookup prints how a code decodes, the stored link and whether each of its codes is cached
+func (c *ctl) lookup(ctx context.Context, code string) error {
+	if utils.Decode(code) != -1 {
+		fmt.Fprintf(c.out, "Code %s decodes to ID %d\n", code, utils.DecodeID(code))
+	} else {
+		fmt.Fprintf(c.out, "Code %s is an alias\n", code)
+	}
+
+	urlDoc, err := c.find(ctx, code)
+	if err != nil {
+		// Whatever is cached for the code may still be served, so show it anyway
+		c.printCache(ctx, nil, []string{code})
+		return err
+	}
+	record, err := json.MarshalIndent(transfer.NewRecord(urlDoc), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Status: %s\n%s\n", linkStatus(urlDoc, time.Now()), record)
+	c.printCache(ctx, urlDoc, urlDoc.ShortCodes())
+	return nil
+}
+
+// printCache reports the Redis entry of every code, flagging entries that no longer match the stored link
+func (c *ctl) printCache(ctx context.Context, urlDoc *repository.URL, codes []string) {
+	fmt.Fprintln(c.out, "Cache:")
+	for _, code := range codes {
+		cached, ttl, err := c.redis.CachedURL(ctx, code)
+		switch {
+		case err != nil:
+			fmt.Fprintf(c.out, "  %s: unknown, %v\n", code, err)
+		case cached == nil:
+			fmt.Fprintf(c.out, "  %s: not cached\n", code)
+		default:
+			expiry := "never expires"
+			if ttl > 0 {
+				expiry = "expires in " + ttl.Round(time.Second).String()
+			}
+			state := "cached"
+			if urlDoc == nil || cached.LongURL != urlDoc.LongURL || cached.Deleted() != urlDoc.Deleted() || cached.Disabled() != urlDoc.Disabled() {
+				state = "stale"
+			}
+			fmt.Fprintf(c.out, "  %s: %s, %s, %s\n", code, state, expiry, cached.LongURL)
+		}
+	}
+}
+
+// setDisabled disables or re-enables a link and drops its cached copies
+func (c *ctl) setDisabled(ctx context.Context, code string, disabled bool) error {
+	urlDoc, err := c.find(ctx, code)
+	if err != nil {
+		return err
+	}
+	if urlDoc, err = c.repo.SetDisabled(ctx, urlDoc.ID, disabled); err != nil {
+		return err
+	}
+	action := "Enabled"
+	if disabled {
+		action = "Disabled"
+	}
+	fmt.Fprintf(c.out, "%s %s (ID %d)\n", action, urlDoc.ShortCode(), urlDoc.ID)
+	return c.invalidate(ctx, urlDoc)
+}
+
+// delete soft deletes a link and drops its cached copies
+func (c *ctl) delete(ctx context.Context, code string) error {
+	urlDoc, err := c.find(ctx, code)
+	if err != nil {
+		return err
+	}
+	if err := c.repo.DeleteURL(ctx, urlDoc.ID); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Deleted %s (ID %d)\n", urlDoc.ShortCode(), urlDoc.ID)
+	return c.invalidate(ctx, urlDoc)
+}
+
+// invalidate drops the cached copies of a changed link, which would otherwise be served until they expire
+func (c *ctl) invalidate(ctx context.Context, urlDoc *repository.URL) error {
+	if err := c.redis.InvalidateURL(ctx, urlDoc); err != nil {
+		return fmt.Errorf("the link was changed but its cache entries were not dropped, run flush %s: %w", urlDoc.ShortCode(), err)
+	}
+	return nil
+}
+
+// flush drops keys from Redis and tells every instance to drop its local copy
+func (c *ctl) flush(ctx context.Context, keys []string) error {
+	if err := c.redis.InvalidateKeys(ctx, keys...); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Flushed %d keys\n", len(keys))
+	return nil
+}
+
+// top lists the links with the most clicks
+func (c *ctl) top(ctx context.Context, n int) error {
+	urls, err := c.repo.TopURLs(ctx, n)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CODE\tID\tCLICKS\tSTATUS\tLONG URL")
+	now := time.Now()
+	for _, urlDoc := range urls {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", urlDoc.ShortCode(), urlDoc.ID, urlDoc.AccessCount, linkStatus(urlDoc, now), urlDoc.LongURL)
+	}
+	return w.Flush()
+}
+
+// linkStatus describes whether the link redirects, in the order the redirect checks it
+func linkStatus(urlDoc *repository.URL, now time.Time) string {
+	switch {
+	case urlDoc.Deleted():
+		return "deleted"
+	case urlDoc.Disabled():
+		return "disabled"
+	case urlDoc.Expired(now):
+		return "expired"
+	default:
+		return "active"
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"gochop-it/internal/repository"
+)
+
+// newTestCtl returns a ctl over an in-memory repository and a mock Redis server
+func newTestCtl(t *testing.T) (*ctl, *bytes.Buffer, *miniredis.Miniredis) {
+	t.Helper()
+	mockRedis, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Unable to start mock redis server: %v", err)
+	}
+	t.Cleanup(mockRedis.Close)
+	out := &bytes.Buffer{}
+	return &ctl{
+		repo:  repository.NewMemoryRepo(),
+		redis: &repository.RedisRepo{Client: redis.NewClient(&redis.Options{Addr: mockRedis.Addr()})},
+		out:   out,
+	}, out, mockRedis
+}
+
+// Test lookup shows the document and flags cache entries that no longer match it
+func TestLookup(t *testing.T) {
+	ctx := context.TODO()
+	c, out, mockRedis := newTestCtl(t)
+	urlDoc, err := c.repo.SaveURL(ctx, "https://example.com/a", repository.LinkOptions{Alias: "spring-sale"})
+	if err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+	code := urlDoc.ShortCodes()[0]
+	if err := c.redis.CacheURL(ctx, "spring-sale", urlDoc, time.Hour); err != nil {
+		t.Fatalf("Failed to cache URL: %v", err)
+	}
+	mockRedis.Set(code, "https://example.com/old")
+
+	if err := c.run(ctx, []string{"lookup", code}); err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	for _, want := range []string{
+		"Code " + code + " decodes to ID 1",
+		"Status: active",
+		`"longURL": "https://example.com/a"`,
+		"  " + code + ": stale, never expires, https://example.com/old",
+		"  spring-sale: cached, expires in 1h0m0s, https://example.com/a",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected the output to contain %q, got:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	err = c.run(ctx, []string{"lookup", "summer-sale"})
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if !strings.Contains(out.String(), "summer-sale: not cached") {
+		t.Errorf("Expected the cache state of an unknown code, got:\n%s", out.String())
+	}
+}
+
+// Test disabling, enabling and deleting a link drop its cached copies
+func TestDisableEnableDelete(t *testing.T) {
+	ctx := context.TODO()
+	c, out, mockRedis := newTestCtl(t)
+	urlDoc, err := c.repo.SaveURL(ctx, "https://example.com/a", repository.LinkOptions{})
+	if err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+	code := urlDoc.ShortCode()
+
+	for _, command := range []string{"disable", "enable", "delete"} {
+		if err := c.redis.CacheURL(ctx, code, urlDoc, time.Hour); err != nil {
+			t.Fatalf("Failed to cache URL: %v", err)
+		}
+		if err := c.run(ctx, []string{command, code}); err != nil {
+			t.Fatalf("%s failed: %v", command, err)
+		}
+		if mockRedis.Exists(code) {
+			t.Errorf("Expected %s to drop the cached copy", command)
+		}
+		stored, err := c.repo.FindURLByID(ctx, urlDoc.ID)
+		if err != nil {
+			t.Fatalf("Failed to find URL: %v", err)
+		}
+		if stored.Disabled() != (command == "disable") {
+			t.Errorf("Unexpected disabled state after %s: %v", command, stored.DisabledAt)
+		}
+	}
+	if !strings.Contains(out.String(), "Disabled "+code) || !strings.Contains(out.String(), "Deleted "+code) {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+	if err := c.run(ctx, []string{"delete", code}); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("Expected deleting twice to fail with ErrNotFound, got %v", err)
+	}
+}
+
+// Test top lists links by clicks and flush drops arbitrary keys
+func TestTopAndFlush(t *testing.T) {
+	ctx := context.TODO()
+	c, out, mockRedis := newTestCtl(t)
+	for i, longURL := range []string{"https://example.com/a", "https://example.com/b", "https://example.com/c"} {
+		urlDoc, err := c.repo.SaveURL(ctx, longURL, repository.LinkOptions{})
+		if err != nil {
+			t.Fatalf("Failed to save URL: %v", err)
+		}
+		if err := c.repo.IncrementAccessCounts(ctx, map[int64]int{urlDoc.ID: (i + 1) * 10}); err != nil {
+			t.Fatalf("Failed to count clicks: %v", err)
+		}
+	}
+
+	if err := c.run(ctx, []string{"top", "-n", "2"}); err != nil {
+		t.Fatalf("top failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "https://example.com/c") || !strings.Contains(lines[2], "https://example.com/b") {
+		t.Errorf("Unexpected top links:\n%s", out.String())
+	}
+
+	mockRedis.Set("bc", "https://example.com/a")
+	if err := c.run(ctx, []string{"flush", "bc"}); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if mockRedis.Exists("bc") {
+		t.Errorf("Expected the key to be flushed")
+	}
+
+	for _, args := range [][]string{{"lookup"}, {"flush"}, {"top", "-n", "0"}, {"purge", "bc"}} {
+		if err := c.run(ctx, args); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+}
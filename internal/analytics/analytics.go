@@ -0,0 +1,59 @@
+package analytics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+// User agent classes recorded on click events
+const (
+	AgentBot     = "bot"
+	AgentMobile  = "mobile"
+	AgentTablet  = "tablet"
+	AgentDesktop = "desktop"
+	AgentUnknown = "unknown"
+)
+
+// ClassifyUserAgent buckets a User-Agent header into a coarse class.
+// Only the class is stored, never the raw header.
+func ClassifyUserAgent(ua string) string {
+	lower := strings.ToLower(ua)
+	switch {
+	case lower == "":
+		return AgentUnknown
+	case strings.Contains(lower, "bot"), strings.Contains(lower, "spider"),
+		strings.Contains(lower, "crawl"), strings.Contains(lower, "curl"),
+		strings.Contains(lower, "wget"), strings.Contains(lower, "python-requests"):
+		return AgentBot
+	case strings.Contains(lower, "ipad"), strings.Contains(lower, "tablet"):
+		return AgentTablet
+	case strings.Contains(lower, "mobi"), strings.Contains(lower, "iphone"), strings.Contains(lower, "android"):
+		return AgentMobile
+	case strings.Contains(lower, "windows"), strings.Contains(lower, "macintosh"),
+		strings.Contains(lower, "x11"), strings.Contains(lower, "linux"):
+		return AgentDesktop
+	default:
+		return AgentUnknown
+	}
+}
+
+// HashIP returns a salted SHA-256 of the client IP, so unique visitors can be
+// counted without storing addresses
+func HashIP(salt, ip string) string {
+	sum := sha256.Sum256([]byte(salt + ip))
+	return hex.EncodeToString(sum[:16])
+}
+
+// ReferrerHost reduces a Referer header to its host, or "direct" when there is none
+func ReferrerHost(referrer string) string {
+	if referrer == "" {
+		return "direct"
+	}
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return "unknown"
+	}
+	return strings.ToLower(u.Hostname())
+}
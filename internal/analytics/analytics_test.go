@@ -0,0 +1,269 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gochop-it/internal/repository"
+)
+
+// Test user agent classification
+func TestClassifyUserAgent(t *testing.T) {
+	cases := map[string]string{
+		"":              AgentUnknown,
+		"Googlebot/2.1": AgentBot,
+		"curl/8.4.0":    AgentBot,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148": AgentMobile,
+		"Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X)":                        AgentTablet,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/120.0":               AgentDesktop,
+	}
+	for ua, expected := range cases {
+		if got := ClassifyUserAgent(ua); got != expected {
+			t.Errorf("ClassifyUserAgent(%q) = %s, want %s", ua, got, expected)
+		}
+	}
+}
+
+// Test that IP hashes are stable, salted and don't contain the address
+func TestHashIP(t *testing.T) {
+	a := HashIP("salt", "203.0.113.7")
+	if a != HashIP("salt", "203.0.113.7") {
+		t.Errorf("Expected hash to be stable")
+	}
+	if a == HashIP("other", "203.0.113.7") {
+		t.Errorf("Expected salt to change the hash")
+	}
+	if strings.Contains(a, "203") {
+		t.Errorf("Hash should not contain the address: %s", a)
+	}
+}
+
+// Test referrers are reduced to their host
+func TestReferrerHost(t *testing.T) {
+	cases := map[string]string{
+		"":                               "direct",
+		"https://News.example.com/a?b=c": "news.example.com",
+		"not a url":                      "unknown",
+	}
+	for referrer, expected := range cases {
+		if got := ReferrerHost(referrer); got != expected {
+			t.Errorf("ReferrerHost(%q) = %s, want %s", referrer, got, expected)
+		}
+	}
+}
+
+// Test country lookups against a small range database
+func TestGeoIP(t *testing.T) {
+	db := `1.0.0.0,1.0.0.255,au
+8.8.8.0,8.8.8.255,US
+2001:db8::,2001:db8::ffff,NZ
+`
+	geo, err := ParseGeoIP(strings.NewReader(db))
+	if err != nil {
+		t.Fatalf("Failed to parse GeoIP database: %v", err)
+	}
+	cases := map[string]string{
+		"1.0.0.1":        "AU",
+		"8.8.8.8":        "US",
+		"::ffff:8.8.8.8": "US",
+		"2001:db8::1":    "NZ",
+		"9.9.9.9":        "",
+		"not-an-ip":      "",
+	}
+	for ip, expected := range cases {
+		if got := geo.Country(ip); got != expected {
+			t.Errorf("Country(%q) = %q, want %q", ip, got, expected)
+		}
+	}
+
+	// A nil database never knows the country
+	var none *GeoIP
+	if got := none.Country("8.8.8.8"); got != "" {
+		t.Errorf("Expected no country without a database, got %q", got)
+	}
+}
+
+// Test that queued events are written when the recorder is closed
+func TestRecorderFlushesOnClose(t *testing.T) {
+	repo := repository.NewMemoryRepo()
+	rec := NewRecorder(repo, "salt", nil)
+
+	req := httptest.NewRequest("GET", "/r/bc", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set("Referer", "https://news.example.com/story")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (iPhone) Mobile")
+	for i := 0; i < 3; i++ {
+		rec.RecordRequest(req, 1)
+	}
+
+	if err := rec.Close(context.TODO()); err != nil {
+		t.Fatalf("Failed to close recorder: %v", err)
+	}
+	// Events after close are ignored rather than panicking
+	rec.RecordRequest(req, 1)
+
+	stats, err := repo.ClickStats(context.TODO(), 1, time.Now().Add(-time.Hour), time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to load click stats: %v", err)
+	}
+	if len(stats.TopReferrers) != 1 || stats.TopReferrers[0].Value != "news.example.com" || stats.TopReferrers[0].Count != 3 {
+		t.Errorf("Unexpected referrers: %+v", stats.TopReferrers)
+	}
+	if len(stats.UserAgents) != 1 || stats.UserAgents[0].Value != AgentMobile {
+		t.Errorf("Unexpected user agents: %+v", stats.UserAgents)
+	}
+}
+
+// failingRepo fails batched increments until told otherwise
+type failingRepo struct {
+	*repository.MemoryRepo
+	fail bool
+}
+
+func (f *failingRepo) IncrementAccessCounts(ctx context.Context, counts map[int64]int) error {
+	if f.fail {
+		return context.DeadlineExceeded
+	}
+	return f.MemoryRepo.IncrementAccessCounts(ctx, counts)
+}
+
+// Test that buffered clicks survive a failed flush and are written on close
+func TestClickCounter(t *testing.T) {
+	ctx := context.TODO()
+	repo := &failingRepo{MemoryRepo: repository.NewMemoryRepo(), fail: true}
+	urlDoc, err := repo.SaveURL(ctx, "https://example.com", repository.LinkOptions{})
+	if err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+
+	counter := NewClickCounter(repo, time.Hour)
+	for i := 0; i < 5; i++ {
+		counter.Add(urlDoc.ID)
+	}
+
+	if err := counter.Flush(ctx); err == nil {
+		t.Fatalf("Expected flush to fail")
+	}
+	counter.Add(urlDoc.ID)
+
+	repo.fail = false
+	if err := counter.Close(ctx); err != nil {
+		t.Fatalf("Failed to close counter: %v", err)
+	}
+
+	found, err := repo.FindURLByID(ctx, urlDoc.ID)
+	if err != nil {
+		t.Fatalf("Failed to find URL: %v", err)
+	}
+	if found.AccessCount != 6 {
+		t.Errorf("Expected access count 6, got %d", found.AccessCount)
+	}
+}
+
+// partialRepo applies every buffered count but the ones of failID, like a bulk write that partly failed,
+// and fails every batch while down is above zero
+type partialRepo struct {
+	*repository.MemoryRepo
+	failID int64
+	down   int
+}
+
+func (p *partialRepo) IncrementAccessCounts(ctx context.Context, counts map[int64]int) error {
+	if p.down > 0 {
+		p.down--
+		return context.DeadlineExceeded
+	}
+	failed := make(map[int64]int)
+	applied := make(map[int64]int)
+	for id, n := range counts {
+		if id == p.failID {
+			failed[id] = n
+		} else {
+			applied[id] = n
+		}
+	}
+	if err := p.MemoryRepo.IncrementAccessCounts(ctx, applied); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &repository.IncrementError{Failed: failed, Err: errors.New("write error")}
+	}
+	return nil
+}
+
+// Test that only the counts a partly failed flush didn't apply are retried
+func TestClickCounterPartialFailure(t *testing.T) {
+	ctx := context.TODO()
+	repo := &partialRepo{MemoryRepo: repository.NewMemoryRepo()}
+	first, _ := repo.SaveURL(ctx, "https://example.com/a", repository.LinkOptions{})
+	second, _ := repo.SaveURL(ctx, "https://example.com/b", repository.LinkOptions{})
+	repo.failID = second.ID
+
+	counter := NewClickCounter(repo, time.Hour)
+	counter.Add(first.ID)
+	counter.Add(first.ID)
+	counter.Add(second.ID)
+	if err := counter.Flush(ctx); err == nil {
+		t.Fatalf("Expected flush to fail")
+	}
+
+	repo.failID = 0
+	if err := counter.Close(ctx); err != nil {
+		t.Fatalf("Failed to close counter: %v", err)
+	}
+	for id, want := range map[int64]int{first.ID: 2, second.ID: 1} {
+		found, err := repo.FindURLByID(ctx, id)
+		if err != nil {
+			t.Fatalf("Failed to find URL: %v", err)
+		}
+		if found.AccessCount != want {
+			t.Errorf("Expected access count %d for link %d, got %d", want, id, found.AccessCount)
+		}
+	}
+}
+
+// Test that Close retries the final flush until storage answers
+func TestClickCounterCloseRetries(t *testing.T) {
+	minCloseRetryDelay = time.Millisecond
+	defer func() { minCloseRetryDelay = 100 * time.Millisecond }()
+
+	ctx := context.TODO()
+	repo := &partialRepo{MemoryRepo: repository.NewMemoryRepo(), down: 3}
+	urlDoc, _ := repo.SaveURL(ctx, "https://example.com", repository.LinkOptions{})
+
+	counter := NewClickCounter(repo, time.Hour)
+	counter.Add(urlDoc.ID)
+	closeCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := counter.Close(closeCtx); err != nil {
+		t.Fatalf("Failed to close counter: %v", err)
+	}
+	if found, _ := repo.FindURLByID(ctx, urlDoc.ID); found.AccessCount != 1 {
+		t.Errorf("Expected access count 1, got %d", found.AccessCount)
+	}
+}
+
+// Test that Close gives up once its context is done and keeps nothing back silently
+func TestClickCounterCloseGivesUp(t *testing.T) {
+	minCloseRetryDelay = time.Millisecond
+	defer func() { minCloseRetryDelay = 100 * time.Millisecond }()
+
+	ctx := context.TODO()
+	repo := &partialRepo{MemoryRepo: repository.NewMemoryRepo(), down: 1 << 30}
+	urlDoc, _ := repo.SaveURL(ctx, "https://example.com", repository.LinkOptions{})
+
+	counter := NewClickCounter(repo, time.Hour)
+	counter.Add(urlDoc.ID)
+	closeCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := counter.Close(closeCtx); err == nil {
+		t.Fatalf("Expected close to fail with storage down")
+	}
+	if counter.pending[urlDoc.ID] != 1 {
+		t.Errorf("Expected the count to stay pending, got %v", counter.pending)
+	}
+}
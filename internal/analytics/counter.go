@@ -0,0 +1,137 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gochop-it/internal/repository"
+)
+
+// ClickCounter buffers access count increments in memory and flushes them to the
+// repository in batches, keeping the database write off the redirect hot path
+type ClickCounter struct {
+	repo     repository.URLRepository
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending map[int64]int
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewClickCounter starts a counter that flushes to repo every interval
+func NewClickCounter(repo repository.URLRepository, interval time.Duration) *ClickCounter {
+	c := &ClickCounter{
+		repo:     repo,
+		interval: interval,
+		pending:  make(map[int64]int),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Add counts one click for the link
+func (c *ClickCounter) Add(id int64) {
+	c.mu.Lock()
+	c.pending[id]++
+	c.mu.Unlock()
+}
+
+// Flush writes the buffered counts. On failure the counts that weren't applied are put back
+// to retry on the next flush, so a batch that partly failed isn't counted twice.
+func (c *ClickCounter) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	if len(c.pending) == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	batch := c.pending
+	c.pending = make(map[int64]int)
+	c.mu.Unlock()
+
+	if err := c.repo.IncrementAccessCounts(ctx, batch); err != nil {
+		failed := batch
+		var incErr *repository.IncrementError
+		if errors.As(err, &incErr) {
+			failed = incErr.Failed
+		}
+		c.mu.Lock()
+		for id, n := range failed {
+			c.pending[id] += n
+		}
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Retry delays of the final flush on Close
+var (
+	minCloseRetryDelay = 100 * time.Millisecond
+	maxCloseRetryDelay = 2 * time.Second
+)
+
+// Close stops the background flusher and writes any remaining counts, retrying until they
+// are written or ctx is done. Counts that still couldn't be written are logged one link at a
+// time, so they can be applied by hand. Call it after the HTTP server has shut down so no
+// clicks arrive afterwards, with a context of its own rather than what is left of the server's.
+func (c *ClickCounter) Close(ctx context.Context) error {
+	c.once.Do(func() { close(c.stop) })
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.logPending(ctx)
+		return ctx.Err()
+	}
+
+	delay := minCloseRetryDelay
+	for {
+		err := c.Flush(ctx)
+		if err == nil {
+			return nil
+		}
+		slog.WarnContext(ctx, "Failed to flush click counts on close, retrying", "error", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			c.logPending(ctx)
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxCloseRetryDelay)
+	}
+}
+
+// logPending logs every buffered count that is about to be lost
+func (c *ClickCounter) logPending(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, n := range c.pending {
+		slog.ErrorContext(ctx, "Click count lost", "link_id", id, "clicks", n)
+	}
+}
+
+// run flushes on every tick until Close is called
+func (c *ClickCounter) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+			if err := c.Flush(ctx); err != nil {
+				slog.ErrorContext(ctx, "Failed to flush click counts, retrying next interval", "error", err)
+			}
+			cancel()
+		case <-c.stop:
+			return
+		}
+	}
+}
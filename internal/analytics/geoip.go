@@ -0,0 +1,91 @@
+package analytics
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GeoIP maps IP addresses to ISO country codes using a local range database
+type GeoIP struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// LoadGeoIP reads a CSV database of "start_ip,end_ip,country" rows, the format used
+// by the free DB-IP and IP2Location country lite downloads
+func LoadGeoIP(path string) (*GeoIP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open GeoIP database: %w", err)
+	}
+	defer f.Close()
+	return ParseGeoIP(f)
+}
+
+// ParseGeoIP reads a CSV range database from r
+func ParseGeoIP(r io.Reader) (*GeoIP, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	geo := &GeoIP{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("GeoIP line %d: expected start, end and country", line)
+		}
+		start, err := netip.ParseAddr(strings.TrimSpace(record[0]))
+		if err != nil {
+			return nil, fmt.Errorf("GeoIP line %d: %w", line, err)
+		}
+		end, err := netip.ParseAddr(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("GeoIP line %d: %w", line, err)
+		}
+		geo.ranges = append(geo.ranges, ipRange{
+			start:   start.Unmap(),
+			end:     end.Unmap(),
+			country: strings.ToUpper(strings.TrimSpace(record[2])),
+		})
+	}
+	sort.Slice(geo.ranges, func(i, j int) bool { return geo.ranges[i].start.Less(geo.ranges[j].start) })
+	return geo, nil
+}
+
+// Country returns the country code for ip, or "" if it is not in the database
+func (g *GeoIP) Country(ip string) string {
+	if g == nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	// Find the last range starting at or before addr
+	i := sort.Search(len(g.ranges), func(i int) bool { return addr.Less(g.ranges[i].start) }) - 1
+	if i < 0 {
+		return ""
+	}
+	r := g.ranges[i]
+	if addr.Compare(r.end) > 0 {
+		return ""
+	}
+	return r.country
+}
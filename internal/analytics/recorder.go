@@ -0,0 +1,135 @@
+package analytics
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"gochop-it/internal/middleware"
+	"gochop-it/internal/repository"
+)
+
+const (
+	// recorderBuffer is how many click events can queue before new ones are dropped
+	recorderBuffer = 1024
+	// recorderBatchSize is the most events written in one call
+	recorderBatchSize = 100
+	// recorderFlushInterval is the longest an event waits before being written
+	recorderFlushInterval = time.Second
+)
+
+// Recorder writes click events in the background so redirects never wait on analytics
+type Recorder struct {
+	repo   repository.URLRepository
+	salt   string
+	geo    *GeoIP
+	events chan repository.ClickEvent
+	done   chan struct{}
+
+	// mu guards closed so Record never sends on the closed channel
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewRecorder starts a recorder writing to repo. geo may be nil when no GeoIP database is configured.
+func NewRecorder(repo repository.URLRepository, salt string, geo *GeoIP) *Recorder {
+	rec := &Recorder{
+		repo:   repo,
+		salt:   salt,
+		geo:    geo,
+		events: make(chan repository.ClickEvent, recorderBuffer),
+		done:   make(chan struct{}),
+	}
+	go rec.run()
+	return rec
+}
+
+// RecordRequest queues a click event for the link built from the redirect request
+func (rec *Recorder) RecordRequest(r *http.Request, linkID int64) {
+	// Prefer the address resolved behind trusted proxies
+	ip := middleware.ClientIP(r.Context())
+	if ip == "" {
+		var err error
+		if ip, _, err = net.SplitHostPort(r.RemoteAddr); err != nil {
+			ip = r.RemoteAddr
+		}
+	}
+	rec.Record(repository.ClickEvent{
+		LinkID:    linkID,
+		Timestamp: time.Now().UTC(),
+		Referrer:  ReferrerHost(r.Referer()),
+		UserAgent: ClassifyUserAgent(r.UserAgent()),
+		IPHash:    HashIP(rec.salt, ip),
+		Country:   rec.geo.Country(ip),
+	})
+}
+
+// Record queues a click event, dropping it if the buffer is full
+func (rec *Recorder) Record(ev repository.ClickEvent) {
+	rec.mu.RLock()
+	defer rec.mu.RUnlock()
+	if rec.closed {
+		return
+	}
+	select {
+	case rec.events <- ev:
+	default:
+		slog.Warn("Click event buffer full, dropping event", "link_id", ev.LinkID)
+	}
+}
+
+// Close stops accepting events and waits for queued events to be written
+func (rec *Recorder) Close(ctx context.Context) error {
+	rec.mu.Lock()
+	if !rec.closed {
+		rec.closed = true
+		close(rec.events)
+	}
+	rec.mu.Unlock()
+
+	select {
+	case <-rec.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run batches queued events and writes them until the channel is closed
+func (rec *Recorder) run() {
+	defer close(rec.done)
+	ticker := time.NewTicker(recorderFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]repository.ClickEvent, 0, recorderBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := rec.repo.RecordClicks(ctx, batch); err != nil {
+			slog.ErrorContext(ctx, "Failed to record click events", "count", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case ev, ok := <-rec.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) >= recorderBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,602 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"gochop-it/internal/utils"
+)
+
+// Config holds every setting for the server.
+// Values are layered: defaults, then the optional YAML file named by CONFIG_FILE, then environment variables.
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Mongo     MongoConfig     `yaml:"mongo"`
+	Redis     RedisConfig     `yaml:"redis"`
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
+	Analytics AnalyticsConfig `yaml:"analytics"`
+	Codes     CodesConfig     `yaml:"codes"`
+	Links     LinksConfig     `yaml:"links"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Screening ScreeningConfig `yaml:"screening"`
+	Log       LogConfig       `yaml:"log"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+}
+
+// ServerConfig controls the HTTP server and the links it hands out
+type ServerConfig struct {
+	Addr    string `yaml:"addr"`
+	BaseURL string `yaml:"baseURL"`
+	// TrustedProxies lists the addresses or CIDRs of reverse proxies whose forwarding headers are believed
+	TrustedProxies []string `yaml:"trustedProxies"`
+	// ClientIPHeader is the header the trusted proxies put the client address in, others are ignored
+	ClientIPHeader string `yaml:"clientIPHeader"`
+}
+
+// StorageConfig selects the link storage backend
+type StorageConfig struct {
+	Backend    string `yaml:"backend"`
+	SQLitePath string `yaml:"sqlitePath"`
+	// IDLeaseSize is how many IDs an instance takes from the counter at a time, 1 takes them one by one
+	IDLeaseSize int64 `yaml:"idLeaseSize"`
+}
+
+// MongoConfig holds the MongoDB connection settings.
+// URI takes precedence over Host and the credentials; Database is always required.
+type MongoConfig struct {
+	URI      string `yaml:"uri"`
+	Host     string `yaml:"host"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Database string `yaml:"database"`
+}
+
+// RedisConfig holds the Redis cache settings
+type RedisConfig struct {
+	Addr     string        `yaml:"addr"`
+	Password string        `yaml:"password"`
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+	// LocalCacheTTL is how long each instance keeps hot links in memory, zero disables the local cache
+	LocalCacheTTL time.Duration `yaml:"localCacheTTL"`
+	// LocalCacheSize caps the number of links held by the local cache
+	LocalCacheSize int `yaml:"localCacheSize"`
+	// BreakerThreshold is how many Redis errors in a row make redirects skip Redis, zero disables the breaker
+	BreakerThreshold int `yaml:"breakerThreshold"`
+	// BreakerCooldown is how long Redis is skipped before it is tried again
+	BreakerCooldown time.Duration `yaml:"breakerCooldown"`
+}
+
+// RateLimitConfig declares the rate limit policies. RPS and Burst are the default per-client
+// token bucket, Routes override it for a route and Tiers for callers whose API key has that tier.
+type RateLimitConfig struct {
+	RPS   float64 `yaml:"rps"`
+	Burst int     `yaml:"burst"`
+	// Store keeps the buckets in "redis", shared by every instance, or per instance in "memory"
+	Store string `yaml:"store"`
+	// Routes maps a route name (see RateLimitRoutes) to its policy
+	Routes map[string]RateLimitPolicy `yaml:"routes"`
+	// Tiers maps an API key tier to its policy, which applies on every route
+	Tiers map[string]RateLimitPolicy `yaml:"tiers"`
+	// AllowList holds addresses or CIDRs that are never limited
+	AllowList []string `yaml:"allowList"`
+	// AllowOwners holds API key owners that are never limited
+	AllowOwners []string `yaml:"allowOwners"`
+}
+
+// RateLimitPolicy is a token bucket refilling RPS tokens per second up to Burst
+type RateLimitPolicy struct {
+	RPS   float64 `yaml:"rps"`
+	Burst int     `yaml:"burst"`
+}
+
+// RateLimitRoutes names the routes that can be given their own rate limit policy
+var RateLimitRoutes = []string{"shorten", "bulk", "redirect", "api", "keys", "auth"}
+
+// minIPHashSaltLength is the shortest IP hash salt accepted, enough to rule out guessing it
+const minIPHashSaltLength = 16
+
+// AnalyticsConfig controls click event recording
+type AnalyticsConfig struct {
+	// IPHashSalt is mixed into hashed client IPs so they can't be reversed with a lookup table.
+	// The server requires it, as every IPv4 hash can be brute forced without it, see CheckIPHashSalt.
+	IPHashSalt string `yaml:"ipHashSalt"`
+	// GeoIPPath is an optional CSV country database, countries are not recorded without it
+	GeoIPPath string `yaml:"geoIPPath"`
+	// ClickFlushInterval is how often buffered access counts are written to storage
+	ClickFlushInterval time.Duration `yaml:"clickFlushInterval"`
+}
+
+// CodesConfig controls how IDs are turned into short codes
+type CodesConfig struct {
+	// Secret keys the ID permutation, codes are plain sequential base 52 without it
+	Secret string `yaml:"secret"`
+	// MinLength is the shortest obfuscated code
+	MinLength int `yaml:"minLength"`
+	// LegacyMaxID is the last ID issued before obfuscation was enabled, those links keep their plain codes
+	LegacyMaxID int64 `yaml:"legacyMaxID"`
+}
+
+// LinksConfig controls how new links are deduplicated
+type LinksConfig struct {
+	// StripTrackingParams ignores utm_* and click ID parameters when comparing URLs, so campaign
+	// variants of a page share one link. The link still redirects to the URL as given.
+	StripTrackingParams bool `yaml:"stripTrackingParams"`
+}
+
+// AuthConfig controls API key management
+type AuthConfig struct {
+	// AdminToken guards the API key endpoint, keys can't be issued over HTTP without it
+	AdminToken string `yaml:"adminToken"`
+}
+
+// ScreeningConfig controls the checks run on destinations before they are shortened
+type ScreeningConfig struct {
+	// BlocklistPath is an optional file of blocked domains, one per line
+	BlocklistPath string `yaml:"blocklistPath"`
+	// BlocklistReloadInterval is how often the blocklist file is checked for changes
+	BlocklistReloadInterval time.Duration `yaml:"blocklistReloadInterval"`
+	// SafeBrowsingAPIKey enables Google Safe Browsing lookups
+	SafeBrowsingAPIKey string `yaml:"safeBrowsingAPIKey"`
+	// AllowPrivateHosts accepts destinations on private, loopback and link-local addresses
+	AllowPrivateHosts bool `yaml:"allowPrivateHosts"`
+}
+
+// LogConfig controls the server's log output
+type LogConfig struct {
+	// Level is the lowest level written: debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is "text" for key=value lines or "json" for one JSON object per line
+	Format string `yaml:"format"`
+}
+
+// TracingConfig controls OpenTelemetry tracing
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP collector URL, such as http://otel-collector:4318. Tracing is off without it.
+	Endpoint string `yaml:"endpoint"`
+	// ServiceName identifies the server in traces
+	ServiceName string `yaml:"serviceName"`
+	// SampleRatio is the share of new traces recorded, from 0 to 1. Requests continuing a trace follow its decision.
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+// Default returns the settings used by the Docker Compose deployment
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:           ":8080",
+			BaseURL:        "http://smallchop.net",
+			ClientIPHeader: "X-Forwarded-For",
+		},
+		Storage: StorageConfig{
+			Backend:     "mongo",
+			SQLitePath:  "smallchop.db",
+			IDLeaseSize: 1000,
+		},
+		Mongo: MongoConfig{
+			Host: "mongo:27017",
+		},
+		Redis: RedisConfig{
+			Addr:           "redis:6379",
+			CacheTTL:       time.Hour,
+			LocalCacheTTL:  10 * time.Second,
+			LocalCacheSize: 10000,
+			// Redirects stop waiting on Redis timeouts after a few failures
+			BreakerThreshold: 5,
+			BreakerCooldown:  10 * time.Second,
+		},
+		RateLimit: RateLimitConfig{
+			RPS:   2,
+			Burst: 4,
+			Store: "redis",
+			Routes: map[string]RateLimitPolicy{
+				// Redirects are cheap cached reads, shortening is a write
+				"redirect": {RPS: 20, Burst: 40},
+				// Bulk shortens take a token per row, a full batch fits in the bucket
+				"bulk": {RPS: 10, Burst: 1000},
+				// API key lookups per client address, ahead of the owner's own limit
+				"auth": {RPS: 20, Burst: 40},
+			},
+		},
+		Analytics: AnalyticsConfig{
+			ClickFlushInterval: 5 * time.Second,
+		},
+		Codes: CodesConfig{
+			MinLength: 7,
+		},
+		Screening: ScreeningConfig{
+			BlocklistReloadInterval: 30 * time.Second,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: TracingConfig{
+			ServiceName: "smallchop",
+			SampleRatio: 1,
+		},
+	}
+}
+
+// Load reads the configuration from CONFIG_FILE (if set) and the environment
+func Load() (*Config, error) {
+	return LoadFile(os.Getenv("CONFIG_FILE"))
+}
+
+// LoadFile reads the configuration from the YAML file at path, if any, then applies
+// environment overrides and validates the result
+func LoadFile(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("could not parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides settings with any environment variables that are set
+func (c *Config) applyEnv() error {
+	setString(&c.Server.Addr, "APP_ADDR")
+	setString(&c.Server.BaseURL, "BASE_URL")
+	setString(&c.Server.ClientIPHeader, "CLIENT_IP_HEADER")
+	setString(&c.Storage.Backend, "STORAGE_BACKEND")
+	setString(&c.Storage.SQLitePath, "SQLITE_PATH")
+	setString(&c.Mongo.URI, "MONGO_URI")
+	setString(&c.Mongo.Host, "MONGO_HOST")
+	setString(&c.Mongo.Username, "MONGO_APP_USERNAME")
+	setString(&c.Mongo.Password, "MONGO_APP_PASSWORD")
+	setString(&c.Mongo.Database, "MONGO_DB_NAME")
+	setString(&c.Redis.Addr, "REDIS_ADDR")
+	setString(&c.Redis.Password, "REDIS_PASSWORD")
+	setString(&c.Analytics.IPHashSalt, "ANALYTICS_IP_SALT")
+	setString(&c.Analytics.GeoIPPath, "GEOIP_DB_PATH")
+	setString(&c.Codes.Secret, "SHORT_CODE_SECRET")
+	setString(&c.Auth.AdminToken, "ADMIN_TOKEN")
+	setString(&c.RateLimit.Store, "RATE_LIMIT_STORE")
+	setString(&c.Screening.BlocklistPath, "BLOCKLIST_PATH")
+	setString(&c.Screening.SafeBrowsingAPIKey, "SAFE_BROWSING_API_KEY")
+	setString(&c.Log.Level, "LOG_LEVEL")
+	setString(&c.Log.Format, "LOG_FORMAT")
+	setString(&c.Tracing.Endpoint, "OTEL_EXPORTER_OTLP_ENDPOINT")
+	setString(&c.Tracing.ServiceName, "OTEL_SERVICE_NAME")
+
+	setList(&c.Server.TrustedProxies, "TRUSTED_PROXIES")
+	setList(&c.RateLimit.AllowList, "RATE_LIMIT_ALLOW_LIST")
+	if v, ok := os.LookupEnv("CACHE_TTL"); ok {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("CACHE_TTL: %w", err)
+		}
+		c.Redis.CacheTTL = ttl
+	}
+	if v, ok := os.LookupEnv("LOCAL_CACHE_TTL"); ok {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("LOCAL_CACHE_TTL: %w", err)
+		}
+		c.Redis.LocalCacheTTL = ttl
+	}
+	if v, ok := os.LookupEnv("LOCAL_CACHE_SIZE"); ok {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("LOCAL_CACHE_SIZE: %w", err)
+		}
+		c.Redis.LocalCacheSize = size
+	}
+	if v, ok := os.LookupEnv("REDIS_BREAKER_THRESHOLD"); ok {
+		threshold, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("REDIS_BREAKER_THRESHOLD: %w", err)
+		}
+		c.Redis.BreakerThreshold = threshold
+	}
+	if v, ok := os.LookupEnv("REDIS_BREAKER_COOLDOWN"); ok {
+		cooldown, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("REDIS_BREAKER_COOLDOWN: %w", err)
+		}
+		c.Redis.BreakerCooldown = cooldown
+	}
+	if v, ok := os.LookupEnv("CLICK_FLUSH_INTERVAL"); ok {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("CLICK_FLUSH_INTERVAL: %w", err)
+		}
+		c.Analytics.ClickFlushInterval = interval
+	}
+	if v, ok := os.LookupEnv("BLOCKLIST_RELOAD_INTERVAL"); ok {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("BLOCKLIST_RELOAD_INTERVAL: %w", err)
+		}
+		c.Screening.BlocklistReloadInterval = interval
+	}
+	if v, ok := os.LookupEnv("STRIP_TRACKING_PARAMS"); ok {
+		strip, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("STRIP_TRACKING_PARAMS: %w", err)
+		}
+		c.Links.StripTrackingParams = strip
+	}
+	if v, ok := os.LookupEnv("ALLOW_PRIVATE_HOSTS"); ok {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("ALLOW_PRIVATE_HOSTS: %w", err)
+		}
+		c.Screening.AllowPrivateHosts = allow
+	}
+	if v, ok := os.LookupEnv("SHORT_CODE_MIN_LENGTH"); ok {
+		minLength, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("SHORT_CODE_MIN_LENGTH: %w", err)
+		}
+		c.Codes.MinLength = minLength
+	}
+	if v, ok := os.LookupEnv("SHORT_CODE_LEGACY_MAX_ID"); ok {
+		legacyMaxID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("SHORT_CODE_LEGACY_MAX_ID: %w", err)
+		}
+		c.Codes.LegacyMaxID = legacyMaxID
+	}
+	if v, ok := os.LookupEnv("ID_LEASE_SIZE"); ok {
+		leaseSize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("ID_LEASE_SIZE: %w", err)
+		}
+		c.Storage.IDLeaseSize = leaseSize
+	}
+	if v, ok := os.LookupEnv("TRACE_SAMPLE_RATIO"); ok {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("TRACE_SAMPLE_RATIO: %w", err)
+		}
+		c.Tracing.SampleRatio = ratio
+	}
+	if v, ok := os.LookupEnv("RATE_LIMIT_RPS"); ok {
+		rps, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("RATE_LIMIT_RPS: %w", err)
+		}
+		c.RateLimit.RPS = rps
+	}
+	if v, ok := os.LookupEnv("RATE_LIMIT_BURST"); ok {
+		burst, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("RATE_LIMIT_BURST: %w", err)
+		}
+		c.RateLimit.Burst = burst
+	}
+	return nil
+}
+
+// setString overrides dst when the environment variable is set and non-empty
+func setString(dst *string, key string) {
+	if v := os.Getenv(key); v != "" {
+		*dst = v
+	}
+}
+
+// setList overrides dst with a comma separated environment variable when it is set and non-empty
+func setList(dst *[]string, key string) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	*dst = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*dst = append(*dst, item)
+		}
+	}
+}
+
+// Validate checks the configuration is usable, reporting every problem at once
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Server.Addr == "" {
+		errs = append(errs, errors.New("server address must be set"))
+	}
+	if u, err := url.Parse(c.Server.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("base URL %q must be an absolute http or https URL", c.Server.BaseURL))
+	}
+	if _, err := c.Server.TrustedProxyNets(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Server.ClientIPHeader == "" {
+		errs = append(errs, errors.New("client IP header must be set"))
+	}
+	switch c.Storage.Backend {
+	case "mongo":
+		if c.Mongo.Database == "" {
+			errs = append(errs, errors.New("mongo database name must be set"))
+		}
+	case "sqlite":
+		if c.Storage.SQLitePath == "" {
+			errs = append(errs, errors.New("sqlite path must be set"))
+		}
+	case "memory":
+	default:
+		errs = append(errs, fmt.Errorf("unknown storage backend %q", c.Storage.Backend))
+	}
+	if c.Storage.IDLeaseSize < 1 {
+		errs = append(errs, errors.New("ID lease size must be at least 1"))
+	}
+	if c.Redis.Addr == "" {
+		errs = append(errs, errors.New("redis address must be set"))
+	}
+	if c.Redis.CacheTTL < 0 {
+		errs = append(errs, errors.New("cache TTL must not be negative"))
+	}
+	if c.Redis.LocalCacheTTL < 0 {
+		errs = append(errs, errors.New("local cache TTL must not be negative"))
+	}
+	if c.Redis.LocalCacheTTL > 0 && c.Redis.LocalCacheSize < 1 {
+		errs = append(errs, errors.New("local cache size must be at least 1"))
+	}
+	if c.Redis.BreakerThreshold < 0 {
+		errs = append(errs, errors.New("redis breaker threshold must not be negative"))
+	}
+	if c.Redis.BreakerThreshold > 0 && c.Redis.BreakerCooldown <= 0 {
+		errs = append(errs, errors.New("redis breaker cooldown must be positive"))
+	}
+	errs = append(errs, RateLimitPolicy{RPS: c.RateLimit.RPS, Burst: c.RateLimit.Burst}.validate("default")...)
+	for name, policy := range c.RateLimit.Routes {
+		if !slices.Contains(RateLimitRoutes, name) {
+			errs = append(errs, fmt.Errorf("unknown rate limit route %q, must be one of %s", name, strings.Join(RateLimitRoutes, ", ")))
+		}
+		errs = append(errs, policy.validate("route "+name)...)
+	}
+	for name, policy := range c.RateLimit.Tiers {
+		errs = append(errs, policy.validate("tier "+name)...)
+	}
+	if _, err := parseNets(c.RateLimit.AllowList, "rate limit allow list entry"); err != nil {
+		errs = append(errs, err)
+	}
+	if c.RateLimit.Store != "redis" && c.RateLimit.Store != "memory" {
+		errs = append(errs, fmt.Errorf("unknown rate limit store %q", c.RateLimit.Store))
+	}
+	if _, err := utils.NewShortCodec(c.Codes.Secret, c.Codes.MinLength, c.Codes.LegacyMaxID); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Analytics.ClickFlushInterval <= 0 {
+		errs = append(errs, errors.New("click flush interval must be positive"))
+	}
+	if c.Screening.BlocklistPath != "" && c.Screening.BlocklistReloadInterval <= 0 {
+		errs = append(errs, errors.New("blocklist reload interval must be positive"))
+	}
+	if _, err := c.Log.SlogLevel(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("unknown log format %q, must be text or json", c.Log.Format))
+	}
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing endpoint %q must be an absolute http or https URL", c.Tracing.Endpoint))
+		}
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, errors.New("trace sample ratio must be between 0 and 1"))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// ShortURL returns the public URL for a short code
+func (c ServerConfig) ShortURL(shortCode string) string {
+	return strings.TrimSuffix(c.BaseURL, "/") + "/r/" + shortCode
+}
+
+// validate checks the policy is a usable token bucket
+func (p RateLimitPolicy) validate(name string) []error {
+	var errs []error
+	if p.RPS <= 0 {
+		errs = append(errs, fmt.Errorf("%s rate limit must be positive", name))
+	}
+	if p.Burst < 1 {
+		errs = append(errs, fmt.Errorf("%s rate limit burst must be at least 1", name))
+	}
+	return errs
+}
+
+// CheckIPHashSalt reports an IP hash salt too short to keep hashed client IPs secret.
+// It isn't part of Validate, only the server records clicks and the tools sharing the config don't need it.
+func (c AnalyticsConfig) CheckIPHashSalt() error {
+	if len(c.IPHashSalt) < minIPHashSaltLength {
+		return fmt.Errorf("IP hash salt must be a secret of at least %d characters", minIPHashSaltLength)
+	}
+	return nil
+}
+
+// TrustedProxyNets parses TrustedProxies, single addresses are treated as /32 or /128 networks.
+// It is checked by Validate so never fails on a loaded config.
+func (c ServerConfig) TrustedProxyNets() ([]*net.IPNet, error) {
+	return parseNets(c.TrustedProxies, "trusted proxy")
+}
+
+// AllowListNets parses AllowList like ServerConfig.TrustedProxyNets, it is checked by Validate
+func (c RateLimitConfig) AllowListNets() ([]*net.IPNet, error) {
+	return parseNets(c.AllowList, "rate limit allow list entry")
+}
+
+// parseNets parses a list of addresses and CIDRs, single addresses become /32 or /128 networks
+func parseNets(list []string, what string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, entry := range list {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%s %q is not an IP address or CIDR", what, entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q is not an IP address or CIDR", what, entry)
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// ShortCodec builds the short code codec, it is checked by Validate so never fails on a loaded config
+func (c CodesConfig) ShortCodec() (*utils.ShortCodec, error) {
+	return utils.NewShortCodec(c.Secret, c.MinLength, c.LegacyMaxID)
+}
+
+// Canonicalizer builds the URL canonicalizer used to dedupe links
+func (c LinksConfig) Canonicalizer() *utils.Canonicalizer {
+	return &utils.Canonicalizer{StripTracking: c.StripTrackingParams}
+}
+
+// SlogLevel parses Level, it is checked by Validate so never fails on a loaded config
+func (c LogConfig) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q, must be debug, info, warn or error", c.Level)
+	}
+	return level, nil
+}
+
+// ConnectionURI returns the MongoDB connection string
+func (c MongoConfig) ConnectionURI() string {
+	if c.URI != "" {
+		return c.URI
+	}
+	u := url.URL{Scheme: "mongodb", Host: c.Host, Path: "/" + c.Database}
+	if c.Username != "" {
+		u.User = url.UserPassword(c.Username, c.Password)
+	}
+	return u.String()
+}
@@ -1,26 +1,45 @@
 package handlers
 
 import (
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"gochop-it/internal/analytics"
+	"gochop-it/internal/config"
+	"gochop-it/internal/logging"
+	"gochop-it/internal/middleware"
 	"gochop-it/internal/repository"
+	"gochop-it/internal/screening"
 	"gochop-it/internal/utils"
 )
 
 type Handlers struct {
-	MongoRepo    *repository.MongoRepo
+	Repo         repository.URLRepository
 	RedisRepo    *repository.RedisRepo
 	Template     *template.Template
 	TemplatePath string
+	Server       config.ServerConfig
+	CacheTTL     time.Duration
+	Analytics    *analytics.Recorder
+	Clicks       *analytics.ClickCounter
+	AdminToken   string
+	Screener     *screening.Screener
 }
 
-func NewHandlers(mongoRepo *repository.MongoRepo, redisRepo *repository.RedisRepo) (*Handlers, error) {
+func NewHandlers(repo repository.URLRepository, redisRepo *repository.RedisRepo, recorder *analytics.Recorder, clicks *analytics.ClickCounter, screener *screening.Screener, cfg *config.Config) (*Handlers, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
 		return nil, fmt.Errorf("could not get working directory: %v", err)
@@ -29,10 +48,16 @@ func NewHandlers(mongoRepo *repository.MongoRepo, redisRepo *repository.RedisRep
 	tmpl := template.Must(template.ParseFiles(templatePath))
 
 	return &Handlers{
-		MongoRepo:    mongoRepo,
+		Repo:         repo,
 		RedisRepo:    redisRepo,
 		Template:     tmpl,
 		TemplatePath: templatePath,
+		Server:       cfg.Server,
+		CacheTTL:     cfg.Redis.CacheTTL,
+		Analytics:    recorder,
+		Clicks:       clicks,
+		AdminToken:   cfg.Auth.AdminToken,
+		Screener:     screener,
 	}, nil
 }
 
@@ -42,30 +67,313 @@ func (h *Handlers) RootHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err := h.Template.Execute(w, nil); err != nil {
-		log.Printf("Error executing template: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to execute template", "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 
 }
 
+// shortenRequest is the JSON body accepted by the links API
+type shortenRequest struct {
+	URL       string     `json:"url"`
+	Alias     string     `json:"alias,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	MaxClicks int        `json:"maxClicks,omitempty"`
+}
+
+// LinkResponse is the JSON representation of a shortened link
+type LinkResponse struct {
+	ShortCode string     `json:"shortCode"`
+	ShortURL  string     `json:"shortURL"`
+	LongURL   string     `json:"longURL"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	MaxClicks int        `json:"maxClicks,omitempty"`
+}
+
+// linkResponse builds the JSON representation of a stored link
+func (h *Handlers) linkResponse(urlDoc *repository.URL) LinkResponse {
+	shortCode := urlDoc.ShortCode()
+	return LinkResponse{
+		ShortCode: shortCode,
+		ShortURL:  h.Server.ShortURL(shortCode),
+		LongURL:   urlDoc.LongURL,
+		CreatedAt: urlDoc.CreatedAt,
+		ExpiresAt: urlDoc.ExpiresAt,
+		MaxClicks: urlDoc.MaxClicks,
+	}
+}
+
+// ErrorResponse is the JSON body returned by the API when a request fails
+type ErrorResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// maxJSONBody caps the body of a request for a single link or API key
+const maxJSONBody = 64 << 10
+
+// ShortenURLHandler creates a short link from either an HTMX form post or a JSON API call.
+// The response format is negotiated from the request, so both share the same logic.
 func (h *Handlers) ShortenURLHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, "Invalid request method")
 		return
 	}
 
-	url := r.FormValue("url")
-	fmt.Println("Payload: ", url)
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBody)
+	var payload shortenRequest
+	if isJSONRequest(r) {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+	} else {
+		var err error
+		if payload, err = parseShortenForm(r); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	slog.DebugContext(ctx, "Shortening URL", "url", logging.RedactURL(payload.URL))
 
-	shortCode, err := h.MongoRepo.SaveURL(ctx, url)
+	if err := h.Screener.Check(ctx, payload.URL); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	urlDoc, err := h.Repo.SaveURL(ctx, payload.URL, repository.LinkOptions{
+		Alias:     payload.Alias,
+		ExpiresAt: payload.ExpiresAt,
+		MaxClicks: payload.MaxClicks,
+		OwnerID:   middleware.OwnerID(ctx),
+	})
 	if err != nil {
-		http.Error(w, "Failed to save URL", http.StatusInternalServerError)
+		status, message := saveError(err)
+		writeError(w, r, status, message)
+		return
+	}
+
+	link := h.linkResponse(urlDoc)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusCreated, link)
 		return
 	}
+	fmt.Fprintf(w, `<p class="mt-4 text-green-600">Shortened URL: <a href="/r/%s">%s</a></p>`, link.ShortCode, link.ShortURL)
+}
+
+// saveError maps an error from saving a link to its status code and message
+func saveError(err error) (int, string) {
+	var urlErr *utils.URLError
+	if errors.As(err, &urlErr) {
+		return http.StatusBadRequest, urlErr.Error()
+	}
+	if errors.Is(err, repository.ErrAliasTaken) {
+		return http.StatusConflict, err.Error()
+	}
+	return http.StatusInternalServerError, "Failed to save URL"
+}
+
+// maxBulkLinks caps the rows of a bulk shorten, maxBulkBody the size of its body
+const (
+	maxBulkLinks = 1000
+	maxBulkBody  = 5 << 20
+)
+
+// BulkLinkResult is the outcome of one row of a bulk shorten, Row counts from 1
+type BulkLinkResult struct {
+	Row int `json:"row"`
+	*LinkResponse
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BulkResponse is the JSON body returned by a bulk shorten
+type BulkResponse struct {
+	Saved   int              `json:"saved"`
+	Failed  int              `json:"failed"`
+	Results []BulkLinkResult `json:"results"`
+}
+
+// bulkRow is a parsed row of a bulk shorten, with the error if it couldn't be parsed
+type bulkRow struct {
+	shortenRequest
+	err error
+}
+
+// BulkShortenHandler shortens a JSON array of links or a CSV upload in one request.
+// Each row costs a rate limit token and is screened and saved on its own, so a bad row
+// is reported in its result without failing the rest of the batch.
+func (h *Handlers) BulkShortenHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	r.Body = http.MaxBytesReader(w, r.Body, maxBulkBody)
+	rows, err := parseBulkRows(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(rows) == 0 {
+		writeError(w, r, http.StatusBadRequest, "No links to shorten")
+		return
+	}
+	if len(rows) > maxBulkLinks {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("At most %d links can be shortened at once", maxBulkLinks))
+		return
+	}
+
+	// Every row costs a token, the middleware took the first
+	if !middleware.Charge(w, r, len(rows)-1) {
+		return
+	}
+
+	// Screen the parsed rows together, concurrently and with one reputation lookup
+	var screenURLs []string
+	var screenRows []int
+	for i, row := range rows {
+		if row.err == nil {
+			screenURLs = append(screenURLs, row.URL)
+			screenRows = append(screenRows, i)
+		}
+	}
+	for n, err := range h.Screener.CheckAll(ctx, screenURLs) {
+		rows[screenRows[n]].err = err
+	}
+
+	results := make([]BulkLinkResult, len(rows))
+	var links []repository.BulkLink
+	var linkRows []int
+	for i, row := range rows {
+		results[i].Row = i + 1
+		if row.err != nil {
+			results[i].Status, results[i].Error = http.StatusBadRequest, row.err.Error()
+			continue
+		}
+		links = append(links, repository.BulkLink{
+			LongURL: row.URL,
+			Options: repository.LinkOptions{
+				Alias:     row.Alias,
+				ExpiresAt: row.ExpiresAt,
+				MaxClicks: row.MaxClicks,
+				OwnerID:   middleware.OwnerID(ctx),
+			},
+		})
+		linkRows = append(linkRows, i)
+	}
+
+	if len(links) > 0 {
+		saved, err := h.Repo.SaveURLs(ctx, links)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to save links in bulk", "error", err)
+			writeError(w, r, http.StatusInternalServerError, "Failed to save URLs")
+			return
+		}
+		for n, result := range saved {
+			i := linkRows[n]
+			if result.Err != nil {
+				results[i].Status, results[i].Error = saveError(result.Err)
+				continue
+			}
+			link := h.linkResponse(result.URL)
+			results[i].LinkResponse = &link
+		}
+	}
+
+	response := BulkResponse{Results: results}
+	for _, result := range results {
+		if result.Error != "" {
+			response.Failed++
+		} else {
+			response.Saved++
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// parseBulkRows reads the rows of a bulk shorten from a JSON array, a text/csv body
+// or a CSV file uploaded in the "file" field of a multipart form
+func parseBulkRows(r *http.Request) ([]bulkRow, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var payload []shortenRequest
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			return nil, errors.New("invalid JSON body, expected an array of links")
+		}
+		rows := make([]bulkRow, len(payload))
+		for i, link := range payload {
+			rows[i].shortenRequest = link
+		}
+		return rows, nil
+	case "text/csv":
+		return parseBulkCSV(r.Body)
+	case "multipart/form-data":
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, errors.New("expected a CSV upload in the file field")
+		}
+		defer file.Close()
+		return parseBulkCSV(file)
+	default:
+		return nil, errors.New("expected a JSON array or a CSV upload")
+	}
+}
 
-	fullShortURL := fmt.Sprintf("http://smallchop.net/r/%s", shortCode)
-	fmt.Fprintf(w, `<p class="mt-4 text-green-600">Shortened URL: <a href="/r/%s">%s</a></p>`, shortCode, fullShortURL)
+// parseBulkCSV reads CSV rows with a header naming the url, alias, expiresAt and maxClicks columns.
+// Only url is required, unknown columns are ignored.
+func parseBulkCSV(body io.Reader) ([]bulkRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["url"]; !ok {
+		return nil, errors.New("the CSV header must name a url column")
+	}
+	field := func(record []string, name string) string {
+		i, ok := columns[strings.ToLower(name)]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows []bulkRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		row := bulkRow{shortenRequest: shortenRequest{
+			URL:   field(record, "url"),
+			Alias: field(record, "alias"),
+		}}
+		if v := field(record, "expiresAt"); v != "" {
+			expiresAt, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				row.err = errors.New("expiresAt must be an RFC 3339 timestamp")
+			} else {
+				row.ExpiresAt = &expiresAt
+			}
+		}
+		if v := field(record, "maxClicks"); v != "" && row.err == nil {
+			if row.MaxClicks, err = strconv.Atoi(v); err != nil {
+				row.err = errors.New("maxClicks must be a number")
+			}
+		}
+		rows = append(rows, row)
+	}
 }
 
 func (h *Handlers) RedirectHandler(w http.ResponseWriter, r *http.Request) {
@@ -75,42 +383,481 @@ func (h *Handlers) RedirectHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Links can be edited, disabled or expire at any time, so no answer may be reused
+	// and every click comes back to the server to be counted
+	w.Header().Set("Cache-Control", "private, no-store")
+
 	key := r.URL.Path[len("/r/"):]
 	if key == "" {
 		http.Error(w, "Invalid URL", http.StatusBadRequest)
 		return
 	}
 
-	// Decode the short code to get the integer ID
-	id := utils.Decode(key)
-	if id == -1 {
+	// Short codes are either base 52 encoded IDs or custom aliases
+	if !utils.IsValidShortCode(key) {
 		http.Error(w, "Invalid short URL", http.StatusBadRequest)
 		return
 	}
 
-	// Try to get the long URL from Redis cache
-	longURL, err := h.RedisRepo.GetLongURL(ctx, key, h.MongoRepo, 1*time.Hour)
-	if err != nil {
-		// If not found in Redis, get the URL from MongoDB
-		urlDoc, err := h.MongoRepo.FindURLByID(ctx, id)
+	// Get the URL document from the cache, which falls back to the repository when Redis misses or is down
+	urlDoc, err := h.RedisRepo.GetURL(ctx, key, h.Repo, h.CacheTTL)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, "Shortened URL not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to load link", "short_code", key, "error", err)
+		http.Error(w, "Failed to load link", http.StatusInternalServerError)
+		return
+	}
+
+	if urlDoc.Deleted() {
+		http.Error(w, "Shortened URL has been deleted", http.StatusGone)
+		return
+	}
+	if urlDoc.Disabled() {
+		http.Error(w, "Shortened URL has been disabled", http.StatusGone)
+		return
+	}
+	// Destinations are screened again on every redirect, so blocking a domain disables its existing links
+	if h.Screener.Blocked(urlDoc.LongURL) {
+		http.Error(w, "Shortened URL has been disabled", http.StatusGone)
+		return
+	}
+	if urlDoc.Expired(time.Now()) {
+		h.expireLink(w, r, key)
+		return
+	}
+
+	if urlDoc.MaxClicks > 0 {
+		// Click limited links are counted atomically so the limit can't be overshot
+		if err := h.Repo.ConsumeClick(ctx, urlDoc.ID); err != nil {
+			if errors.Is(err, repository.ErrLinkExpired) {
+				h.expireLink(w, r, key)
+				return
+			}
+			slog.ErrorContext(ctx, "Failed to count click", "link_id", urlDoc.ID, "error", err)
+		}
+	} else if h.Clicks != nil {
+		// Buffer the access count, it is written to storage in batches
+		h.Clicks.Add(urlDoc.ID)
+	} else {
+		// Increment the access count
+		err = h.Repo.IncrementAccessCount(ctx, urlDoc.ID)
 		if err != nil {
-			http.Error(w, "Shortened URL not found", http.StatusNotFound)
-			return
+			slog.ErrorContext(ctx, "Failed to increment access count", "link_id", urlDoc.ID, "error", err)
 		}
-		longURL = urlDoc.LongURL
+	}
+
+	if h.Analytics != nil {
+		h.Analytics.RecordRequest(r, urlDoc.ID)
+	}
+
+	// A temporary redirect, browsers and proxies cache permanent ones with no expiry
+	http.Redirect(w, r, urlDoc.LongURL, http.StatusFound)
+}
+
+// LinkStatsResponse is the JSON body returned by the link stats API
+type LinkStatsResponse struct {
+	ShortCode   string    `json:"shortCode"`
+	TotalClicks int       `json:"totalClicks"`
+	Since       time.Time `json:"since"`
+	Bucket      string    `json:"bucket"`
+	repository.ClickStats
+}
+
+// statsBuckets maps the bucket query parameter to its size
+var statsBuckets = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+// LinkStatsHandler returns time bucketed click counts and top referrers for a link.
+// The window is set with ?since=<RFC 3339> (default 30 days) and ?bucket=hour|day (default day).
+func (h *Handlers) LinkStatsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	code := r.PathValue("code")
+	if !utils.IsValidShortCode(code) {
+		writeError(w, r, http.StatusBadRequest, "Invalid short URL")
+		return
+	}
 
-		// Store in Redis for future requests
-		err = h.RedisRepo.SetKey(ctx, key, longURL, 1*time.Hour)
+	bucketName := r.URL.Query().Get("bucket")
+	if bucketName == "" {
+		bucketName = "day"
+	}
+	bucket, ok := statsBuckets[bucketName]
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "bucket must be hour or day")
+		return
+	}
+	since := time.Now().Add(-30 * 24 * time.Hour).UTC().Truncate(bucket)
+	if v := r.URL.Query().Get("since"); v != "" {
+		parsed, err := time.Parse(time.RFC3339, v)
 		if err != nil {
-			log.Printf("Failed to set Redis cache: %v", err)
+			writeError(w, r, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+			return
 		}
+		since = parsed
 	}
 
-	// Increment the access count
-	err = h.MongoRepo.IncrementAccessCount(ctx, id)
+	urlDoc, err := repository.FindURLByShortCode(ctx, h.Repo, code)
 	if err != nil {
-		log.Printf("Failed to increment access count: %v", err)
+		if errors.Is(err, repository.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Shortened URL not found")
+			return
+		}
+		slog.ErrorContext(ctx, "Failed to load link", "short_code", code, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "Failed to load link")
+		return
+	}
+	// Stats of owned links are private, answer as if the link didn't exist so codes can't be probed
+	if urlDoc.OwnerID != "" && urlDoc.OwnerID != middleware.OwnerID(ctx) {
+		writeError(w, r, http.StatusNotFound, "Shortened URL not found")
+		return
 	}
 
-	http.Redirect(w, r, longURL, http.StatusPermanentRedirect)
+	stats, err := h.Repo.ClickStats(ctx, urlDoc.ID, since, bucket)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to load click stats", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "Failed to load click stats")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, LinkStatsResponse{
+		ShortCode:   urlDoc.ShortCode(),
+		TotalClicks: urlDoc.AccessCount,
+		Since:       since,
+		Bucket:      bucketName,
+		ClickStats:  *stats,
+	})
+}
+
+// Page sizes for the link listing API
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+// LinkListResponse is a page of the authenticated owner's links.
+// NextCursor is passed back as ?cursor= to fetch the next page and is empty on the last one.
+type LinkListResponse struct {
+	Links      []LinkResponse `json:"links"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// ListLinksHandler lists the links created with the caller's API key, newest first.
+// Pages hold ?limit= links (default 50, at most 100) starting after the opaque ?cursor=.
+func (h *Handlers) ListLinksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	ownerID := middleware.OwnerID(ctx)
+	if ownerID == "" {
+		writeError(w, r, http.StatusUnauthorized, "An API key is required")
+		return
+	}
+
+	limit := defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+		limit = n
+	}
+	var beforeID int64
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		if beforeID = utils.DecodeID(v); beforeID <= 0 {
+			writeError(w, r, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+	}
+
+	// Fetch one extra link to know whether there is another page
+	urls, err := h.Repo.ListURLsByOwner(ctx, ownerID, beforeID, limit+1)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to list links", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "Failed to list links")
+		return
+	}
+
+	resp := LinkListResponse{Links: []LinkResponse{}}
+	if len(urls) > limit {
+		urls = urls[:limit]
+		resp.NextCursor = utils.EncodeID(urls[limit-1].ID)
+	}
+	for _, urlDoc := range urls {
+		resp.Links = append(resp.Links, h.linkResponse(urlDoc))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// updateLinkRequest is the JSON body accepted when editing a link.
+// An explicit "expiresAt": null removes the expiry, leaving the field out keeps it.
+type updateLinkRequest struct {
+	URL       string       `json:"url,omitempty"`
+	ExpiresAt optionalTime `json:"expiresAt"`
+}
+
+// optionalTime tells a missing JSON field apart from an explicit null
+type optionalTime struct {
+	Set   bool
+	Value *time.Time
+}
+
+func (o *optionalTime) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if string(data) == "null" {
+		o.Value = nil
+		return nil
+	}
+	return json.Unmarshal(data, &o.Value)
+}
+
+// UpdateLinkHandler changes the destination or expiry of one of the caller's links
+// and drops every cached copy of it
+func (h *Handlers) UpdateLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodPatch {
+		writeError(w, r, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBody)
+	var payload updateLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+
+	urlDoc, ok := h.ownedLink(w, r)
+	if !ok {
+		return
+	}
+	if payload.URL != "" {
+		if err := h.Screener.Check(ctx, payload.URL); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	updated, err := h.Repo.UpdateURL(ctx, urlDoc.ID, repository.LinkUpdate{
+		LongURL:   payload.URL,
+		SetExpiry: payload.ExpiresAt.Set,
+		ExpiresAt: payload.ExpiresAt.Value,
+	})
+	if err != nil {
+		var urlErr *utils.URLError
+		if errors.As(err, &urlErr) {
+			writeError(w, r, http.StatusBadRequest, urlErr.Error())
+			return
+		}
+		if errors.Is(err, repository.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Shortened URL not found")
+			return
+		}
+		slog.ErrorContext(ctx, "Failed to update link", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "Failed to update link")
+		return
+	}
+	h.invalidate(r, updated)
+
+	writeJSON(w, http.StatusOK, h.linkResponse(updated))
+}
+
+// DeleteLinkHandler soft deletes one of the caller's links, after which it redirects with 410 Gone
+func (h *Handlers) DeleteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodDelete {
+		writeError(w, r, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	urlDoc, ok := h.ownedLink(w, r)
+	if !ok {
+		return
+	}
+	if err := h.Repo.DeleteURL(ctx, urlDoc.ID); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			writeError(w, r, http.StatusNotFound, "Shortened URL not found")
+			return
+		}
+		slog.ErrorContext(ctx, "Failed to delete link", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "Failed to delete link")
+		return
+	}
+	h.invalidate(r, urlDoc)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownedLink loads the link named by the {code} path value, replying with an error
+// unless it exists, isn't deleted and belongs to the caller
+func (h *Handlers) ownedLink(w http.ResponseWriter, r *http.Request) (*repository.URL, bool) {
+	ownerID := middleware.OwnerID(r.Context())
+	if ownerID == "" {
+		writeError(w, r, http.StatusUnauthorized, "An API key is required")
+		return nil, false
+	}
+
+	code := r.PathValue("code")
+	if !utils.IsValidShortCode(code) {
+		writeError(w, r, http.StatusBadRequest, "Invalid short URL")
+		return nil, false
+	}
+	urlDoc, err := repository.FindURLByShortCode(r.Context(), h.Repo, code)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		slog.ErrorContext(r.Context(), "Failed to load link", "short_code", code, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "Failed to load link")
+		return nil, false
+	}
+	// Other owners' links are reported as missing so codes can't be probed
+	if err != nil || urlDoc.OwnerID != ownerID || urlDoc.Deleted() {
+		writeError(w, r, http.StatusNotFound, "Shortened URL not found")
+		return nil, false
+	}
+	return urlDoc, true
+}
+
+// invalidate drops every cached copy of a changed link. Failures are only logged,
+// cached entries still expire with the cache TTL.
+func (h *Handlers) invalidate(r *http.Request, urlDoc *repository.URL) {
+	if err := h.RedisRepo.InvalidateURL(r.Context(), urlDoc); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to invalidate cached link", "link_id", urlDoc.ID, "error", err)
+	}
+}
+
+// createAPIKeyRequest is the JSON body accepted by the API key endpoint
+type createAPIKeyRequest struct {
+	OwnerID string `json:"ownerID"`
+	Name    string `json:"name"`
+	Tier    string `json:"tier,omitempty"`
+}
+
+// APIKeyResponse returns a newly created key. The plaintext key is only ever shown here.
+type APIKeyResponse struct {
+	Key       string    `json:"key"`
+	OwnerID   string    `json:"ownerID"`
+	Name      string    `json:"name"`
+	Tier      string    `json:"tier,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// CreateAPIKeyHandler issues an API key for an owner. It requires the admin token
+// as a Bearer token and is disabled when no admin token is configured.
+func (h *Handlers) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if h.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.AdminToken)) != 1 {
+		writeError(w, r, http.StatusUnauthorized, "Invalid admin token")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBody)
+	var payload createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if payload.OwnerID == "" {
+		writeError(w, r, http.StatusBadRequest, "ownerID is required")
+		return
+	}
+
+	plaintext, key, err := repository.NewAPIKey(payload.OwnerID, payload.Name, payload.Tier)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to generate API key", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+	if err := h.Repo.CreateAPIKey(ctx, key); err != nil {
+		slog.ErrorContext(ctx, "Failed to save API key", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, APIKeyResponse{
+		Key:       plaintext,
+		OwnerID:   key.OwnerID,
+		Name:      key.Name,
+		Tier:      key.Tier,
+		CreatedAt: key.CreatedAt,
+	})
+}
+
+// expireLink drops an expired link from the cache and replies with 410 Gone
+func (h *Handlers) expireLink(w http.ResponseWriter, r *http.Request, key string) {
+	if err := h.RedisRepo.DeleteKey(r.Context(), key); err != nil {
+		slog.WarnContext(r.Context(), "Failed to evict expired link", "key", key, "error", err)
+	}
+	http.Error(w, "Shortened URL has expired", http.StatusGone)
+}
+
+// parseShortenForm reads the shorten fields from a form post
+func parseShortenForm(r *http.Request) (shortenRequest, error) {
+	payload := shortenRequest{
+		URL:   r.FormValue("url"),
+		Alias: r.FormValue("alias"),
+	}
+	if v := r.FormValue("expiresAt"); v != "" {
+		expiresAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return payload, errors.New("expiresAt must be an RFC 3339 timestamp")
+		}
+		payload.ExpiresAt = &expiresAt
+	}
+	if v := r.FormValue("maxClicks"); v != "" {
+		maxClicks, err := strconv.Atoi(v)
+		if err != nil {
+			return payload, errors.New("maxClicks must be a number")
+		}
+		payload.MaxClicks = maxClicks
+	}
+	return payload, nil
+}
+
+// isJSONRequest reports whether the request body is JSON
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// wantsJSON reports whether the client should receive a JSON response.
+// Requests to the versioned API, JSON bodies and explicit Accept headers all opt in.
+func wantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") || isJSONRequest(r) {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeJSON encodes v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to encode JSON response", "error", err)
+	}
+}
+
+// writeError replies with a JSON error body for API clients and plain text otherwise
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if wantsJSON(r) {
+		writeJSON(w, status, ErrorResponse{Status: status, Error: message})
+		return
+	}
+	http.Error(w, message, status)
 }
@@ -2,15 +2,23 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+
+	"gochop-it/internal/analytics"
+	"gochop-it/internal/middleware"
 	"gochop-it/internal/repository"
+	"gochop-it/internal/screening"
+	"gochop-it/internal/utils"
 )
 
 // Create a mock Redis client using miniredis
@@ -156,13 +164,13 @@ func TestRedirectHandler(t *testing.T) {
 		// Extract the short code from the path
 		code := "testShortCode" // Mock extracting the code from URL path
 
-		longURL, err := redisRepo.GetLongURL(ctx, code, nil, 0)
+		urlDoc, err := redisRepo.GetURL(ctx, code, nil, 0)
 		if err != nil {
 			http.Error(writer, "Shortened URL not found", http.StatusNotFound)
 			return
 		}
 
-		http.Redirect(writer, req, longURL, http.StatusPermanentRedirect)
+		http.Redirect(writer, req, urlDoc.LongURL, http.StatusPermanentRedirect)
 	})
 
 	// Call the handler
@@ -179,3 +187,675 @@ func TestRedirectHandler(t *testing.T) {
 		t.Errorf("Handler returned wrong redirect location: got %v want %v", location, expectedLocation)
 	}
 }
+
+// Test the JSON links API "/api/v1/links" using a mocked MongoDB
+func TestShortenHandlerJSON(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("creates link", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			// FindOne for the existing long URL (no document found)
+			mtest.CreateCursorResponse(0, "url_shortener.urls", mtest.FirstBatch),
+			// InsertOne success
+			mtest.CreateSuccessResponse(),
+		)
+
+		h := &Handlers{Repo: &repository.MongoRepo{
+			Client:     mt.Client,
+			Collection: mt.Coll,
+			GetNextIDFunc: func(ctx context.Context, counterName string) (int64, error) {
+				return 12345, nil
+			},
+		}}
+
+		req := httptest.NewRequest("POST", "/api/v1/links", strings.NewReader(`{"url":"https://example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		h.ShortenURLHandler(rr, req)
+
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		var resp LinkResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if resp.ShortCode != utils.Encode(12345) {
+			t.Errorf("Expected short code %s, got %s", utils.Encode(12345), resp.ShortCode)
+		}
+		if resp.LongURL != "https://example.com/" {
+			t.Errorf("Expected long URL %s, got %s", "https://example.com/", resp.LongURL)
+		}
+	})
+}
+
+// Test that invalid URLs are rejected with a 400 and a JSON error body
+func TestShortenHandlerInvalidURL(t *testing.T) {
+	h := &Handlers{Repo: &repository.MongoRepo{}}
+
+	req := httptest.NewRequest("POST", "/api/v1/links", strings.NewReader(`{"url":"ftp://example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	h.ShortenURLHandler(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	var resp ErrorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	if resp.Error != "URL must start with http or https" {
+		t.Errorf("Unexpected error message: %s", resp.Error)
+	}
+
+	// Form posts keep the plain text error
+	req = httptest.NewRequest("POST", "/shorten", strings.NewReader("url=ftp://example.com"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	h.ShortenURLHandler(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if ct := rr.Header().Get("Content-Type"); strings.Contains(ct, "application/json") {
+		t.Errorf("Expected a non-JSON error for form posts, got %s", ct)
+	}
+}
+
+// Test that the redirect handler resolves custom aliases
+func TestRedirectHandlerAlias(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("redirects alias", func(mt *mtest.T) {
+		// UpdateOne for the access count
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		rdb, mockRedis := createMockRedis()
+		defer mockRedis.Close()
+
+		h := &Handlers{
+			Repo:      &repository.MongoRepo{Client: mt.Client, Collection: mt.Coll},
+			RedisRepo: &repository.RedisRepo{Client: rdb},
+		}
+		urlDoc := &repository.URL{ID: 7, LongURL: "https://example.com/launch", Alias: "launch2026"}
+		if err := h.RedisRepo.CacheURL(context.TODO(), "launch2026", urlDoc, 0); err != nil {
+			t.Fatalf("Failed to cache URL: %v", err)
+		}
+
+		req := httptest.NewRequest("GET", "/r/launch2026", nil)
+		rr := httptest.NewRecorder()
+		h.RedirectHandler(rr, req)
+
+		if rr.Code != http.StatusFound {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusFound)
+		}
+		if location := rr.Header().Get("Location"); location != urlDoc.LongURL {
+			t.Errorf("Handler returned wrong redirect location: got %v want %v", location, urlDoc.LongURL)
+		}
+	})
+
+	mt.Run("rejects malformed code", func(mt *mtest.T) {
+		h := &Handlers{}
+		req := httptest.NewRequest("GET", "/r/bad.code!", nil)
+		rr := httptest.NewRecorder()
+		h.RedirectHandler(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+// Test that expired links respond with 410 Gone and are evicted from the cache
+func TestRedirectHandlerExpired(t *testing.T) {
+	rdb, mockRedis := createMockRedis()
+	defer mockRedis.Close()
+
+	h := &Handlers{RedisRepo: &repository.RedisRepo{Client: rdb}}
+	urlDoc := &repository.URL{ID: 7, LongURL: "https://example.com", MaxClicks: 1, AccessCount: 1}
+	if err := h.RedisRepo.CacheURL(context.TODO(), "j", urlDoc, 0); err != nil {
+		t.Fatalf("Failed to cache URL: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/r/j", nil)
+	rr := httptest.NewRecorder()
+	h.RedirectHandler(rr, req)
+
+	if rr.Code != http.StatusGone {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusGone)
+	}
+	if mockRedis.Exists("j") {
+		t.Errorf("Expected expired link to be evicted from Redis")
+	}
+}
+
+// Test shortening and redirecting end to end against the in-memory backend
+func TestShortenAndRedirectMemory(t *testing.T) {
+	rdb, mockRedis := createMockRedis()
+	defer mockRedis.Close()
+
+	h := &Handlers{
+		Repo:      repository.NewMemoryRepo(),
+		RedisRepo: &repository.RedisRepo{Client: rdb},
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/links", strings.NewReader(`{"url":"https://example.com/page"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	h.ShortenURLHandler(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	var resp LinkResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	req = httptest.NewRequest("GET", "/r/"+resp.ShortCode, nil)
+	rr = httptest.NewRecorder()
+	h.RedirectHandler(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusFound)
+	}
+	if location := rr.Header().Get("Location"); location != "https://example.com/page" {
+		t.Errorf("Handler returned wrong redirect location: got %v", location)
+	}
+	if cc := rr.Header().Get("Cache-Control"); cc != "private, no-store" {
+		t.Errorf("Expected the redirect not to be cached, got %q", cc)
+	}
+
+	urlDoc, err := h.Repo.FindURLByID(context.TODO(), utils.DecodeID(resp.ShortCode))
+	if err != nil {
+		t.Fatalf("Failed to find URL: %v", err)
+	}
+	if urlDoc.AccessCount != 1 {
+		t.Errorf("Expected access count 1, got %d", urlDoc.AccessCount)
+	}
+}
+
+// Test that redirects are served from storage while Redis is down, and unknown codes are still not found
+func TestRedirectHandlerRedisDown(t *testing.T) {
+	rdb, mockRedis := createMockRedis()
+	mockRedis.Close()
+
+	repo := repository.NewMemoryRepo()
+	h := &Handlers{
+		Repo:      repo,
+		RedisRepo: &repository.RedisRepo{Client: rdb, Breaker: repository.NewCircuitBreaker(1, time.Minute)},
+	}
+	urlDoc, err := repo.SaveURL(context.TODO(), "https://example.com/sale", repository.LinkOptions{})
+	if err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		h.RedirectHandler(rr, httptest.NewRequest("GET", "/r/"+urlDoc.ShortCode(), nil))
+		if rr.Code != http.StatusFound {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusFound)
+		}
+		if location := rr.Header().Get("Location"); location != urlDoc.LongURL {
+			t.Errorf("Handler returned wrong redirect location: got %v want %v", location, urlDoc.LongURL)
+		}
+	}
+	if h.RedisRepo.Breaker.Allow() {
+		t.Errorf("Expected the breaker to open with Redis down")
+	}
+
+	rr := httptest.NewRecorder()
+	h.RedirectHandler(rr, httptest.NewRequest("GET", "/r/no-such-alias", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+// Test the link stats API "/api/v1/links/{code}/stats"
+func TestLinkStatsHandler(t *testing.T) {
+	repo := repository.NewMemoryRepo()
+	h := &Handlers{Repo: repo}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/links/{code}/stats", h.LinkStatsHandler)
+
+	urlDoc, err := repo.SaveURL(context.TODO(), "https://example.com", repository.LinkOptions{})
+	if err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+	now := time.Now().UTC()
+	if err := repo.RecordClicks(context.TODO(), []repository.ClickEvent{
+		{LinkID: urlDoc.ID, Timestamp: now, Referrer: "news.example.com", UserAgent: "mobile"},
+		{LinkID: urlDoc.ID, Timestamp: now, Referrer: "direct", UserAgent: "desktop"},
+		{LinkID: urlDoc.ID, Timestamp: now, Referrer: "news.example.com", UserAgent: "desktop"},
+	}); err != nil {
+		t.Fatalf("Failed to record clicks: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/links/"+urlDoc.ShortCode()+"/stats?bucket=hour", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var resp LinkStatsResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Buckets) != 1 || resp.Buckets[0].Count != 3 {
+		t.Errorf("Unexpected buckets: %+v", resp.Buckets)
+	}
+	if len(resp.TopReferrers) == 0 || resp.TopReferrers[0].Value != "news.example.com" {
+		t.Errorf("Unexpected referrers: %+v", resp.TopReferrers)
+	}
+
+	// Unknown links and bad parameters are rejected
+	for path, status := range map[string]int{
+		"/api/v1/links/launch2026/stats":     http.StatusNotFound,
+		"/api/v1/links/bc/stats?bucket=week": http.StatusBadRequest,
+	} {
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != status {
+			t.Errorf("%s: got status %v want %v", path, rr.Code, status)
+		}
+	}
+}
+
+// Test that redirects buffer access counts until the click counter flushes
+func TestRedirectHandlerBufferedClicks(t *testing.T) {
+	rdb, mockRedis := createMockRedis()
+	defer mockRedis.Close()
+
+	repo := repository.NewMemoryRepo()
+	clicks := analytics.NewClickCounter(repo, time.Hour)
+	h := &Handlers{
+		Repo:      repo,
+		RedisRepo: &repository.RedisRepo{Client: rdb},
+		Clicks:    clicks,
+	}
+
+	urlDoc, err := repo.SaveURL(context.TODO(), "https://example.com", repository.LinkOptions{})
+	if err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		h.RedirectHandler(rr, httptest.NewRequest("GET", "/r/"+urlDoc.ShortCode(), nil))
+		if rr.Code != http.StatusFound {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusFound)
+		}
+	}
+
+	// Nothing is written until the buffer is drained
+	found, _ := repo.FindURLByID(context.TODO(), urlDoc.ID)
+	if found.AccessCount != 0 {
+		t.Errorf("Expected no access counts before flush, got %d", found.AccessCount)
+	}
+	if err := clicks.Close(context.TODO()); err != nil {
+		t.Fatalf("Failed to close click counter: %v", err)
+	}
+	found, _ = repo.FindURLByID(context.TODO(), urlDoc.ID)
+	if found.AccessCount != 3 {
+		t.Errorf("Expected access count 3 after flush, got %d", found.AccessCount)
+	}
+}
+
+// Test listing the owner's links page by page "/api/v1/links"
+func TestListLinksHandler(t *testing.T) {
+	ctx := context.TODO()
+	repo := repository.NewMemoryRepo()
+	h := &Handlers{Repo: repo}
+
+	for i := 0; i < 3; i++ {
+		if _, err := repo.SaveURL(ctx, fmt.Sprintf("https://example.com/%d", i), repository.LinkOptions{OwnerID: "team-a"}); err != nil {
+			t.Fatalf("Failed to save URL: %v", err)
+		}
+	}
+	if _, err := repo.SaveURL(ctx, "https://example.com/other", repository.LinkOptions{OwnerID: "team-b"}); err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+
+	// Anonymous callers can't list links
+	rr := httptest.NewRecorder()
+	h.ListLinksHandler(rr, httptest.NewRequest("GET", "/api/v1/links", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	var seen []string
+	cursor := ""
+	for page := 0; page < 3; page++ {
+		req := httptest.NewRequest("GET", "/api/v1/links?limit=2&cursor="+cursor, nil)
+		req = req.WithContext(middleware.WithOwnerID(req.Context(), "team-a"))
+		rr = httptest.NewRecorder()
+		h.ListLinksHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var resp LinkListResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		for _, link := range resp.Links {
+			seen = append(seen, link.LongURL)
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+
+	want := []string{"https://example.com/2", "https://example.com/1", "https://example.com/0"}
+	if strings.Join(seen, " ") != strings.Join(want, " ") {
+		t.Errorf("Unexpected links: got %v want %v", seen, want)
+	}
+}
+
+// Test that stats of owned links are only shown to their owner
+func TestLinkStatsHandlerOwned(t *testing.T) {
+	repo := repository.NewMemoryRepo()
+	h := &Handlers{Repo: repo}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/links/{code}/stats", h.LinkStatsHandler)
+
+	urlDoc, err := repo.SaveURL(context.TODO(), "https://example.com", repository.LinkOptions{OwnerID: "team-a"})
+	if err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+
+	for owner, status := range map[string]int{
+		"":       http.StatusNotFound,
+		"team-b": http.StatusNotFound,
+		"team-a": http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/api/v1/links/"+urlDoc.ShortCode()+"/stats", nil)
+		req = req.WithContext(middleware.WithOwnerID(req.Context(), owner))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != status {
+			t.Errorf("owner %q: got status %v want %v", owner, rr.Code, status)
+		}
+	}
+}
+
+// Test oversized JSON bodies are rejected before they are read into memory
+func TestJSONBodyTooLarge(t *testing.T) {
+	repo := repository.NewMemoryRepo()
+	h := &Handlers{Repo: repo, AdminToken: "admin-secret"}
+	// Valid JSON, only too large
+	padding := strings.Repeat(" ", maxJSONBody)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		body    string
+	}{
+		{"shorten", h.ShortenURLHandler, "POST", `{"url":"https://example.com"` + padding + `}`},
+		{"update", h.UpdateLinkHandler, "PATCH", `{"url":"https://example.com/new"` + padding + `}`},
+		{"api key", h.CreateAPIKeyHandler, "POST", `{"ownerID":"team-a"` + padding + `}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v1/links", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer admin-secret")
+			rr := httptest.NewRecorder()
+			tt.handler(rr, req)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+// Test issuing API keys "/api/v1/keys"
+func TestCreateAPIKeyHandler(t *testing.T) {
+	repo := repository.NewMemoryRepo()
+	h := &Handlers{Repo: repo, AdminToken: "admin-secret"}
+
+	newRequest := func(token string) *http.Request {
+		req := httptest.NewRequest("POST", "/api/v1/keys", strings.NewReader(`{"ownerID":"team-a","name":"ci"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+
+	rr := httptest.NewRecorder()
+	h.CreateAPIKeyHandler(rr, newRequest("wrong"))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	rr = httptest.NewRecorder()
+	h.CreateAPIKeyHandler(rr, newRequest("admin-secret"))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	var resp APIKeyResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	// Only the hash is stored, and it resolves to the owner
+	key, err := repo.FindAPIKey(context.TODO(), repository.HashAPIKey(resp.Key))
+	if err != nil {
+		t.Fatalf("Failed to find API key: %v", err)
+	}
+	if key.OwnerID != "team-a" || key.Hash == resp.Key {
+		t.Errorf("Unexpected stored key: %+v", key)
+	}
+
+	// Keys can't be issued when no admin token is configured
+	h.AdminToken = ""
+	rr = httptest.NewRecorder()
+	h.CreateAPIKeyHandler(rr, newRequest(""))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+// Test editing and deleting links "/api/v1/links/{code}" drops the cached copies
+func TestUpdateAndDeleteLinkHandler(t *testing.T) {
+	ctx := context.TODO()
+	rdb, mockRedis := createMockRedis()
+	defer mockRedis.Close()
+
+	repo := repository.NewMemoryRepo()
+	h := &Handlers{Repo: repo, RedisRepo: &repository.RedisRepo{Client: rdb}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("PATCH /api/v1/links/{code}", h.UpdateLinkHandler)
+	mux.HandleFunc("DELETE /api/v1/links/{code}", h.DeleteLinkHandler)
+	mux.HandleFunc("/r/", h.RedirectHandler)
+
+	urlDoc, err := repo.SaveURL(ctx, "https://example.com/old", repository.LinkOptions{OwnerID: "team-a"})
+	if err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+	code := urlDoc.ShortCode()
+	serve := func(method, path, body, owner string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req = req.WithContext(middleware.WithOwnerID(req.Context(), owner))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Warm the cache with the old destination
+	if rr := serve("GET", "/r/"+code, "", ""); rr.Header().Get("Location") != "https://example.com/old" {
+		t.Fatalf("Unexpected redirect: %v", rr.Header().Get("Location"))
+	}
+
+	// Only the owner may edit
+	if rr := serve("PATCH", "/api/v1/links/"+code, `{"url":"https://example.com/new"}`, "team-b"); rr.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := serve("PATCH", "/api/v1/links/"+code, `{"url":"https://example.com/new"}`, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	rr := serve("PATCH", "/api/v1/links/"+code, `{"url":"https://example.com/new"}`, "team-a")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serve("GET", "/r/"+code, "", ""); rr.Header().Get("Location") != "https://example.com/new" {
+		t.Errorf("Expected redirect to the new destination, got %v", rr.Header().Get("Location"))
+	}
+
+	if rr := serve("DELETE", "/api/v1/links/"+code, "", "team-a"); rr.Code != http.StatusNoContent {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+	if rr := serve("GET", "/r/"+code, "", ""); rr.Code != http.StatusGone {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusGone)
+	}
+	if rr := serve("DELETE", "/api/v1/links/"+code, "", "team-a"); rr.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+// Test screened destinations are rejected and links to blocked domains stop redirecting
+func TestScreenedLinks(t *testing.T) {
+	ctx := context.TODO()
+	rdb, mockRedis := createMockRedis()
+	defer mockRedis.Close()
+
+	repo := repository.NewMemoryRepo()
+	// A link created before its domain was blocked
+	urlDoc, err := repo.SaveURL(ctx, "https://login.phish.example/account", repository.LinkOptions{})
+	if err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+	h := &Handlers{
+		Repo:      repo,
+		RedisRepo: &repository.RedisRepo{Client: rdb},
+		Screener:  screening.NewScreener(screening.NewBlocklist("phish.example"), screening.StubReputation{"malware.example": "MALWARE"}, false),
+	}
+
+	for _, longURL := range []string{"https://phish.example/", "https://malware.example/", "http://127.0.0.1:6379/"} {
+		req := httptest.NewRequest("POST", "/api/v1/links", strings.NewReader(`{"url":"`+longURL+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		h.ShortenURLHandler(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected with %v, got %v", longURL, http.StatusBadRequest, rr.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/r/"+urlDoc.ShortCode(), nil)
+	rr := httptest.NewRecorder()
+	h.RedirectHandler(rr, req)
+	if rr.Code != http.StatusGone {
+		t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusGone)
+	}
+}
+
+// Test bulk shortening from a JSON array and a CSV upload, with bad rows reported on their own
+func TestBulkShortenHandler(t *testing.T) {
+	repo := repository.NewMemoryRepo()
+	h := &Handlers{
+		Repo:     repo,
+		Screener: screening.NewScreener(screening.NewBlocklist("phish.example"), nil, false),
+	}
+	serve := func(contentType, body string) BulkResponse {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/v1/links/bulk", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		h.BulkShortenHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+		var response BulkResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return response
+	}
+
+	response := serve("application/json", `[
+		{"url": "https://example.com/a"},
+		{"url": "ftp://example.com/b"},
+		{"url": "https://phish.example/login"},
+		{"url": "https://example.com/c", "alias": "spring-sale"},
+		{"url": "https://example.com/d", "alias": "spring-sale"}
+	]`)
+	if response.Saved != 2 || response.Failed != 3 || len(response.Results) != 5 {
+		t.Fatalf("Unexpected bulk response: %+v", response)
+	}
+	for i, want := range []int{0, http.StatusBadRequest, http.StatusBadRequest, 0, http.StatusConflict} {
+		result := response.Results[i]
+		if result.Row != i+1 || result.Status != want {
+			t.Errorf("Row %d: expected status %d, got %+v", i+1, want, result)
+		}
+		if want == 0 && (result.LinkResponse == nil || result.ShortCode == "") {
+			t.Errorf("Row %d: expected a link, got %+v", i+1, result)
+		}
+	}
+	if response.Results[3].ShortCode != "spring-sale" {
+		t.Errorf("Expected the alias spring-sale, got %s", response.Results[3].ShortCode)
+	}
+
+	csvBody := "url,alias,maxClicks\n" +
+		"https://example.com/a,,\n" +
+		"https://example.com/e,,ten\n" +
+		"https://example.com/f,,10\n"
+	response = serve("text/csv", csvBody)
+	if response.Saved != 2 || response.Failed != 1 {
+		t.Fatalf("Unexpected bulk response: %+v", response)
+	}
+	first, err := repository.FindURLByShortCode(context.TODO(), repo, response.Results[0].ShortCode)
+	if err != nil || first.LongURL != "https://example.com/a" {
+		t.Errorf("Expected the CSV row to reuse the existing link, got %+v, %v", first, err)
+	}
+	if response.Results[1].Error != "maxClicks must be a number" {
+		t.Errorf("Unexpected error for row 2: %q", response.Results[1].Error)
+	}
+	if response.Results[2].MaxClicks != 10 {
+		t.Errorf("Expected maxClicks 10, got %d", response.Results[2].MaxClicks)
+	}
+
+	for _, tt := range []struct{ contentType, body string }{
+		{"text/csv", "alias\nsale\n"},
+		{"application/json", `{"url": "https://example.com"}`},
+		{"application/json", `[]`},
+		{"text/plain", "https://example.com"},
+	} {
+		req := httptest.NewRequest("POST", "/api/v1/links/bulk", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		rr := httptest.NewRecorder()
+		h.BulkShortenHandler(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s body %q to be rejected, got %v", tt.contentType, tt.body, rr.Code)
+		}
+	}
+}
+
+// Test links disabled by an operator stop redirecting until they are enabled again
+func TestRedirectHandlerDisabled(t *testing.T) {
+	ctx := context.TODO()
+	rdb, mockRedis := createMockRedis()
+	defer mockRedis.Close()
+
+	repo := repository.NewMemoryRepo()
+	urlDoc, err := repo.SaveURL(ctx, "https://example.com/a", repository.LinkOptions{})
+	if err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+	h := &Handlers{Repo: repo, RedisRepo: &repository.RedisRepo{Client: rdb}}
+
+	for _, disabled := range []bool{true, false} {
+		if _, err := repo.SetDisabled(ctx, urlDoc.ID, disabled); err != nil {
+			t.Fatalf("Failed to update URL: %v", err)
+		}
+		mockRedis.FlushAll()
+		want := http.StatusFound
+		if disabled {
+			want = http.StatusGone
+		}
+		req := httptest.NewRequest("GET", "/r/"+urlDoc.ShortCode(), nil)
+		rr := httptest.NewRecorder()
+		h.RedirectHandler(rr, req)
+		if rr.Code != want {
+			t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Package health reports whether the server is alive and whether its dependencies are reachable,
+// and keeps retrying dependencies that are down so the server can start without them.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timeout bounds each dependency check of a readiness probe
+const Timeout = 2 * time.Second
+
+// Check is a dependency the server needs to serve requests
+type Check struct {
+	Name string
+	Ping func(ctx context.Context) error
+}
+
+// Checker runs the dependency checks for the readiness endpoint
+type Checker struct {
+	checks  []Check
+	timeout time.Duration
+}
+
+// NewChecker returns a checker running every check with the default timeout
+func NewChecker(checks ...Check) *Checker {
+	return &Checker{checks: checks, timeout: Timeout}
+}
+
+// Status values of a Report and its dependencies
+const (
+	StatusOK   = "ok"
+	StatusDown = "down"
+)
+
+// Report is the JSON body of the readiness endpoint
+type Report struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// DependencyStatus is the outcome of one dependency check. Errors are only logged,
+// as driver errors can name hosts and users.
+type DependencyStatus struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latencyMs"`
+}
+
+// Check pings every dependency at once, each with its own timeout, and reports
+// ok only when all of them answered
+func (c *Checker) Check(ctx context.Context) Report {
+	report := Report{Status: StatusOK, Dependencies: make(map[string]DependencyStatus, len(c.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+			start := time.Now()
+			err := check.Ping(checkCtx)
+			result := DependencyStatus{Status: StatusOK, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				slog.WarnContext(ctx, "Readiness check failed", "dependency", check.Name, "error", err)
+				result.Status = StatusDown
+				report.Status = StatusDown
+			}
+			report.Dependencies[check.Name] = result
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+// ServeHTTP is the readiness endpoint, it answers 200 when every dependency is reachable and 503 otherwise,
+// so load balancers stop sending traffic to an instance that can't serve it
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := c.Check(r.Context())
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// Live is the liveness endpoint, it answers 200 as long as the process is serving requests.
+// It doesn't check dependencies, an outage shouldn't get every instance restarted.
+func Live(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": StatusOK})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to encode JSON response", "error", err)
+	}
+}
+
+// Retry delays between attempts to reach a dependency that is down
+var (
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+// Connect runs connect, which should reach a dependency and prepare it for use, and returns
+// whether it succeeded within the timeout. When it doesn't, it is retried in the background with
+// exponential backoff until it succeeds or ctx is done, so the server can start degraded
+// and recover once the dependency comes back.
+func Connect(ctx context.Context, name string, timeout time.Duration, connect func(ctx context.Context) error) bool {
+	attempt := func() error {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return connect(attemptCtx)
+	}
+	err := attempt()
+	if err == nil {
+		slog.InfoContext(ctx, "Connected to dependency", "dependency", name)
+		return true
+	}
+	slog.WarnContext(ctx, "Dependency unavailable, starting degraded and retrying in the background", "dependency", name, "error", err)
+
+	delay, maxDelay := minRetryDelay, maxRetryDelay
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if err := attempt(); err != nil {
+				delay = min(2*delay, maxDelay)
+				slog.WarnContext(ctx, "Dependency still unavailable", "dependency", name, "error", err, "retry_in", delay)
+				continue
+			}
+			slog.InfoContext(ctx, "Reconnected to dependency", "dependency", name)
+			return
+		}
+	}()
+	return false
+}
@@ -0,0 +1,162 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// Test readiness is ok with every dependency reachable
+func TestCheckerReady(t *testing.T) {
+	checker := NewChecker(
+		Check{Name: "mongodb", Ping: func(ctx context.Context) error { return nil }},
+		Check{Name: "redis", Ping: func(ctx context.Context) error { return nil }},
+	)
+
+	w := httptest.NewRecorder()
+	checker.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	var report Report
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if report.Status != StatusOK || len(report.Dependencies) != 2 {
+		t.Errorf("Expected two ok dependencies, got %+v", report)
+	}
+}
+
+// Test a failing and a hanging dependency each report down and make the instance unready
+func TestCheckerDown(t *testing.T) {
+	checker := NewChecker(
+		Check{Name: "mongodb", Ping: func(ctx context.Context) error { return errors.New("connection refused") }},
+		Check{Name: "redis", Ping: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		Check{Name: "cache", Ping: func(ctx context.Context) error { return nil }},
+	)
+	checker.timeout = 50 * time.Millisecond
+
+	w := httptest.NewRecorder()
+	checker.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, got %d", w.Code)
+	}
+	body := w.Body.String()
+	var report Report
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatalf("Failed to decode report: %v", err)
+	}
+	if report.Status != StatusDown {
+		t.Errorf("Expected status down, got %s", report.Status)
+	}
+	if got := report.Dependencies["mongodb"]; got.Status != StatusDown {
+		t.Errorf("Expected mongodb down, got %+v", got)
+	}
+	if got := report.Dependencies["redis"]; got.Status != StatusDown {
+		t.Errorf("Expected redis to time out, got %+v", got)
+	}
+	if got := report.Dependencies["cache"]; got.Status != StatusOK {
+		t.Errorf("Expected cache ok, got %+v", got)
+	}
+	// Driver errors stay in the logs
+	if strings.Contains(body, "connection refused") {
+		t.Errorf("Expected no dependency errors in the body, got %s", body)
+	}
+}
+
+// Test a stopped Redis server is reported down
+func TestCheckerRedisOutage(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	checker := NewChecker(Check{Name: "redis", Ping: func(ctx context.Context) error { return rdb.Ping(ctx).Err() }})
+
+	if report := checker.Check(context.Background()); report.Status != StatusOK {
+		t.Fatalf("Expected redis ok, got %+v", report)
+	}
+	mr.Close()
+	if report := checker.Check(context.Background()); report.Dependencies["redis"].Status != StatusDown {
+		t.Errorf("Expected redis down, got %+v", report)
+	}
+}
+
+// Test liveness doesn't depend on anything
+func TestLive(t *testing.T) {
+	w := httptest.NewRecorder()
+	Live(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Expected no-store, got %q", got)
+	}
+}
+
+// Test Connect reports a failed first attempt and keeps retrying in the background until it succeeds
+func TestConnectRetries(t *testing.T) {
+	minRetryDelay, maxRetryDelay = time.Millisecond, 5*time.Millisecond
+	defer func() { minRetryDelay, maxRetryDelay = time.Second, 30*time.Second }()
+
+	var attempts atomic.Int32
+	connected := make(chan struct{})
+	ok := Connect(context.Background(), "mongodb", time.Second, func(ctx context.Context) error {
+		if attempts.Add(1) < 3 {
+			return errors.New("connection refused")
+		}
+		close(connected)
+		return nil
+	})
+	if ok {
+		t.Fatal("Expected the first attempt to fail")
+	}
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Connect to retry until the dependency is back")
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("Expected 3 attempts, got %d", got)
+	}
+}
+
+// Test Connect stops retrying once ctx is done
+func TestConnectStops(t *testing.T) {
+	minRetryDelay = time.Millisecond
+	defer func() { minRetryDelay = time.Second }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var attempts atomic.Int32
+	Connect(ctx, "redis", time.Second, func(ctx context.Context) error {
+		attempts.Add(1)
+		return errors.New("connection refused")
+	})
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	stopped := attempts.Load()
+	time.Sleep(20 * time.Millisecond)
+	if got := attempts.Load(); got != stopped {
+		t.Errorf("Expected no attempts after cancel, got %d more", got-stopped)
+	}
+}
+
+// Test a first successful attempt doesn't start retrying
+func TestConnectSucceeds(t *testing.T) {
+	if !Connect(context.Background(), "redis", time.Second, func(ctx context.Context) error { return nil }) {
+		t.Error("Expected Connect to succeed")
+	}
+}
@@ -0,0 +1,35 @@
+// Package httputil holds helpers shared by the HTTP middlewares
+package httputil
+
+import "net/http"
+
+// StatusRecorder remembers the status code written by a handler
+type StatusRecorder struct {
+	http.ResponseWriter
+	// Status is the status code sent, http.StatusOK until the handler writes a header
+	Status      int
+	wroteHeader bool
+}
+
+// NewStatusRecorder wraps w to record the status code written to it
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (s *StatusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.Status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *StatusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *StatusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
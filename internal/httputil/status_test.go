@@ -0,0 +1,29 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test the first status code written is kept, and a body alone means 200
+func TestStatusRecorder(t *testing.T) {
+	rec := NewStatusRecorder(httptest.NewRecorder())
+	rec.WriteHeader(http.StatusNotFound)
+	rec.WriteHeader(http.StatusInternalServerError)
+	if rec.Status != http.StatusNotFound {
+		t.Errorf("Expected the first status 404, got %d", rec.Status)
+	}
+
+	rec = NewStatusRecorder(httptest.NewRecorder())
+	rec.Write([]byte("ok"))
+	rec.WriteHeader(http.StatusTeapot)
+	if rec.Status != http.StatusOK {
+		t.Errorf("Expected 200 once the body is written, got %d", rec.Status)
+	}
+
+	w := httptest.NewRecorder()
+	if NewStatusRecorder(w).Unwrap() != w {
+		t.Errorf("Expected Unwrap to return the wrapped writer")
+	}
+}
@@ -0,0 +1,93 @@
+// Package logging sets up the structured logger of the server. Records logged with a request's
+// context carry its request ID, so every line written while serving a request can be correlated.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"gochop-it/internal/config"
+)
+
+// Log output formats selectable with config.LogConfig.Format
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// New returns a logger writing to w at the configured level and format.
+// The config is checked by config.Validate, so an invalid level falls back to info.
+func New(w io.Writer, cfg config.LogConfig) *slog.Logger {
+	level, _ := cfg.SlogLevel()
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if cfg.Format == FormatJSON {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID stored by WithRequestID, or an empty string
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request ID and, when tracing is on, the trace ID of the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// RedactURL strips the query string, fragment and credentials from a URL before it is logged,
+// as they often hold tokens, emails or session IDs. A removed query is marked with "?…".
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// Keep what is before the query without trying to make sense of the rest
+		rawURL, _, _ = strings.Cut(rawURL, "#")
+		if before, _, found := strings.Cut(rawURL, "?"); found {
+			return before + "?…"
+		}
+		return rawURL
+	}
+	hadQuery := u.RawQuery != "" || u.ForceQuery
+	u.User = nil
+	u.RawQuery, u.ForceQuery = "", false
+	u.Fragment, u.RawFragment = "", ""
+	if hadQuery {
+		return u.String() + "?…"
+	}
+	return u.String()
+}
@@ -0,0 +1,106 @@
+// Package metrics holds the Prometheus collectors of the server and serves them on /metrics.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"gochop-it/internal/httputil"
+)
+
+// Registry holds every collector of the server, along with the Go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+var (
+	// HTTPRequests counts requests by route pattern, method and status code
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "smallchop_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	// HTTPDuration observes how long requests take to serve by route pattern and method
+	HTTPDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "smallchop_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// CacheRequests counts redirect cache lookups, a hit in the local cache or Redis is a hit
+	// and a lookup that has to go to storage is a miss. Lookups that skip Redis while its
+	// circuit breaker is open are a bypass.
+	CacheRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "smallchop_cache_requests_total",
+		Help: "Redirect cache lookups by result: hit, miss, error or bypass.",
+	}, []string{"result"})
+
+	// RedisBreakerOpen is 1 while redirects skip Redis because it is failing
+	RedisBreakerOpen = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "smallchop_redis_breaker_open",
+		Help: "Whether the Redis circuit breaker is open and redirects skip the cache.",
+	})
+
+	// MongoDuration observes MongoDB command latencies by command name and outcome
+	MongoDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "smallchop_mongo_command_duration_seconds",
+		Help:    "Time taken by MongoDB commands by command name and status.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"command", "status"})
+
+	// RateLimitRejections counts requests rejected with 429 by route
+	RateLimitRejections = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "smallchop_rate_limit_rejections_total",
+		Help: "Requests rejected by the rate limiter by route.",
+	}, []string{"route"})
+
+	// LinksCreated counts new links by how they were created, single or bulk.
+	// Shortening a URL that already has a link returns that link and isn't counted.
+	LinksCreated = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "smallchop_links_created_total",
+		Help: "New links stored by source: single or bulk.",
+	}, []string{"source"})
+)
+
+// Handler serves the collectors in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Instrument counts and times the requests served by next. Requests are labelled with the
+// ServeMux pattern they matched rather than their path, which keeps the label set bounded.
+func Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := httputil.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		method := requestMethod(r.Method)
+		HTTPDuration.WithLabelValues(r.Pattern, method).Observe(time.Since(start).Seconds())
+		HTTPRequests.WithLabelValues(r.Pattern, method, strconv.Itoa(rec.Status)).Inc()
+	})
+}
+
+// requestMethod maps methods outside the standard set to "other", as clients can send any
+func requestMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return method
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Test requests are labelled with the route pattern and the status the handler wrote
+func TestInstrument(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /r/{code}", Instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("code") == "missing" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	})))
+
+	for _, path := range []string{"/r/a", "/r/b", "/r/missing"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if got := testutil.ToFloat64(HTTPRequests.WithLabelValues("GET /r/{code}", "GET", "200")); got != 2 {
+		t.Errorf("Expected 2 successful requests, got %v", got)
+	}
+	if got := testutil.ToFloat64(HTTPRequests.WithLabelValues("GET /r/{code}", "GET", "404")); got != 1 {
+		t.Errorf("Expected 1 not found request, got %v", got)
+	}
+	if got := testutil.CollectAndCount(HTTPDuration); got != 1 {
+		t.Errorf("Expected one latency histogram, got %d", got)
+	}
+}
+
+// Test the handler serves the collectors in the exposition format
+func TestHandler(t *testing.T) {
+	LinksCreated.WithLabelValues("single").Inc()
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(w.Result().Body)
+	for _, want := range []string{`smallchop_links_created_total{source="single"} 1`, "go_goroutines"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Expected the metrics to contain %q", want)
+		}
+	}
+}
+
+// Test unusual methods share one label value
+func TestRequestMethod(t *testing.T) {
+	if got := requestMethod("PROPFIND"); got != "other" {
+		t.Errorf("Expected other, got %s", got)
+	}
+	if got := requestMethod(http.MethodPatch); got != http.MethodPatch {
+		t.Errorf("Expected PATCH, got %s", got)
+	}
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"gochop-it/internal/repository"
+)
+
+// APIKeyFinder looks up hashed API keys, it is satisfied by every repository backend
+type APIKeyFinder interface {
+	FindAPIKey(ctx context.Context, hash string) (*repository.APIKey, error)
+}
+
+type (
+	ownerKey struct{}
+	tierKey  struct{}
+)
+
+// OwnerID returns the owner authenticated by Authenticate, or an empty string for anonymous requests
+func OwnerID(ctx context.Context) string {
+	ownerID, _ := ctx.Value(ownerKey{}).(string)
+	return ownerID
+}
+
+// WithOwnerID returns a copy of ctx carrying the authenticated owner
+func WithOwnerID(ctx context.Context, ownerID string) context.Context {
+	return context.WithValue(ctx, ownerKey{}, ownerID)
+}
+
+// APITier returns the rate limit tier of the API key authenticated by Authenticate
+func APITier(ctx context.Context) string {
+	tier, _ := ctx.Value(tierKey{}).(string)
+	return tier
+}
+
+// WithAPITier returns a copy of ctx carrying the API key's rate limit tier
+func WithAPITier(ctx context.Context, tier string) context.Context {
+	return context.WithValue(ctx, tierKey{}, tier)
+}
+
+// Authenticate resolves an `Authorization: Bearer <key>` header to the key's owner.
+// Requests without the header pass through anonymously, unknown keys are rejected with 401.
+func Authenticate(keys APIKeyFinder) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok || token == "" {
+				unauthorized(w, "Authorization header must be a Bearer token")
+				return
+			}
+			key, err := keys.FindAPIKey(r.Context(), repository.HashAPIKey(token))
+			if errors.Is(err, repository.ErrNotFound) {
+				unauthorized(w, "Invalid API key")
+				return
+			} else if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to look up API key", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			ctx := WithAPITier(WithOwnerID(r.Context(), key.OwnerID), key.Tier)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// unauthorized replies with 401 and a JSON message
+func unauthorized(w http.ResponseWriter, body string) {
+	message := Message{
+		Status: "Request Failed",
+		Body:   body,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.WriteHeader(http.StatusUnauthorized)
+	if err := json.NewEncoder(w).Encode(&message); err != nil {
+		slog.Error("Failed to encode JSON response", "error", err)
+	}
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gochop-it/internal/repository"
+)
+
+// ownerHandler echoes the authenticated owner
+func ownerHandler(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte(OwnerID(r.Context())))
+}
+
+func TestAuthenticate(t *testing.T) {
+	repo := repository.NewMemoryRepo()
+	plaintext, key, err := repository.NewAPIKey("team-a", "ci", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreateAPIKey(context.TODO(), key); err != nil {
+		t.Fatal(err)
+	}
+	handler := Authenticate(repo)(http.HandlerFunc(ownerHandler))
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+		wantOwner  string
+	}{
+		{"anonymous", "", http.StatusOK, ""},
+		{"valid key", "Bearer " + plaintext, http.StatusOK, "team-a"},
+		{"unknown key", "Bearer sc_nope", http.StatusUnauthorized, ""},
+		{"not bearer", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/v1/links", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if tt.wantStatus == http.StatusOK && w.Body.String() != tt.wantOwner {
+				t.Errorf("Expected owner %q, got %q", tt.wantOwner, w.Body.String())
+			}
+		})
+	}
+}
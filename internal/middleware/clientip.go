@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIPResolver finds the real client address of requests arriving through reverse proxies.
+// Only the header the trusted proxies set is read, and only when the peer is one of them,
+// otherwise any client could pick its own address by sending it or a header the proxy passes through.
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+	header  string
+}
+
+// NewClientIPResolver creates a resolver trusting the given proxy networks to set header
+func NewClientIPResolver(trusted []*net.IPNet, header string) *ClientIPResolver {
+	return &ClientIPResolver{trusted: trusted, header: http.CanonicalHeaderKey(header)}
+}
+
+type clientIPKey struct{}
+
+// ClientIP returns the client address resolved by ClientIPResolver.Middleware, or an empty string
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// WithClientIP returns a copy of ctx carrying the client address
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// Middleware resolves the client address and stores it in the request context for
+// the rate limiter, handlers and analytics
+func (c *ClientIPResolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithClientIP(r.Context(), c.Resolve(r))))
+	})
+}
+
+// Resolve returns the client address of the request. The hops in the configured header are
+// walked from the nearest one back, skipping trusted proxies, so a client can't spoof its
+// address by prepending entries. Forwarded is parsed as RFC 7239, other headers as address lists.
+func (c *ClientIPResolver) Resolve(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if !c.isTrusted(peer) {
+		return peer
+	}
+
+	var hops []string
+	if values := r.Header.Values(c.header); len(values) > 0 {
+		if c.header == "Forwarded" {
+			hops = parseForwarded(strings.Join(values, ","))
+		} else {
+			for _, hop := range strings.Split(strings.Join(values, ","), ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// Garbage or an obfuscated identifier, the last proxy we trust is as far as we can go
+			break
+		}
+		client = ip.String()
+		if !c.isTrusted(client) {
+			break
+		}
+	}
+	return client
+}
+
+// isTrusted reports whether ip is inside one of the trusted proxy networks
+func (c *ClientIPResolver) isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range c.trusted {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwarded returns the for= addresses of an RFC 7239 Forwarded header in order.
+// Quotes, IPv6 brackets and ports are removed.
+func parseForwarded(header string) []string {
+	var hops []string
+	for _, element := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !strings.EqualFold(key, "for") {
+				continue
+			}
+			value = strings.Trim(value, `"`)
+			if host, _, err := net.SplitHostPort(value); err == nil {
+				value = host
+			}
+			hops = append(hops, strings.Trim(value, "[]"))
+		}
+	}
+	return hops
+}
+
+// clientKey groups clients for rate limiting. IPv6 clients usually control a whole /64,
+// so they share one bucket per /64 rather than getting one per address.
+func clientKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return ip
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func TestClientIPResolver(t *testing.T) {
+	resolver := NewClientIPResolver([]*net.IPNet{mustCIDR(t, "172.16.0.0/12"), mustCIDR(t, "10.0.0.0/8")}, "X-Forwarded-For")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer can't spoof", "203.0.113.7:5000", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.7"},
+		{"x-forwarded-for via proxy", "172.18.0.5:5000", map[string]string{"X-Forwarded-For": "198.51.100.9"}, "198.51.100.9"},
+		{"spoofed entries are skipped", "172.18.0.5:5000", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.9, 10.0.0.2"}, "198.51.100.9"},
+		{"forwarded through a trusted hop is ignored", "172.18.0.5:5000", map[string]string{
+			"Forwarded":       "for=1.2.3.4",
+			"X-Forwarded-For": "198.51.100.9",
+		}, "198.51.100.9"},
+		{"only forwarded", "172.18.0.5:5000", map[string]string{"Forwarded": "for=1.2.3.4"}, "172.18.0.5"},
+		{"x-real-ip is ignored", "172.18.0.5:5000", map[string]string{"X-Real-IP": "1.2.3.4"}, "172.18.0.5"},
+		{"garbage stops at the proxy", "172.18.0.5:5000", map[string]string{"X-Forwarded-For": "nonsense"}, "172.18.0.5"},
+		{"only proxies", "172.18.0.5:5000", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if got := resolver.Resolve(req); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// Test that clients behind one proxy get their own buckets, and IPv6 clients share one per /64
+func TestRateLimiter_BehindProxy(t *testing.T) {
+	resolver := NewClientIPResolver([]*net.IPNet{mustCIDR(t, "172.16.0.0/12")}, "X-Forwarded-For")
+	limiter := resolver.Middleware(newTestLimiter(nil, 2, 4))
+
+	request := func(client string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "172.18.0.5:5000"
+		req.Header.Set("X-Forwarded-For", client)
+		w := httptest.NewRecorder()
+		limiter.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < 4; i++ {
+		request("198.51.100.1")
+	}
+	if code := request("198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected first client to be limited, got %v", code)
+	}
+	if code := request("198.51.100.2"); code != http.StatusOK {
+		t.Errorf("Expected second client behind the same proxy to be allowed, got %v", code)
+	}
+
+	for i := 0; i < 4; i++ {
+		request("2001:db8:1:2::1")
+	}
+	if code := request("2001:db8:1:2::ffff"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected addresses in the same /64 to share a bucket, got %v", code)
+	}
+	if code := request("2001:db8:1:3::1"); code != http.StatusOK {
+		t.Errorf("Expected another /64 to be allowed, got %v", code)
+	}
+}
+
+// Test that the resolved address reaches handlers through the context
+func TestClientIPContext(t *testing.T) {
+	resolver := NewClientIPResolver([]*net.IPNet{mustCIDR(t, "127.0.0.0/8")}, "x-real-ip")
+	handler := resolver.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(ClientIP(r.Context())))
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:5000"
+	req.Header.Set("X-Real-IP", "198.51.100.9")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Body.String() != "198.51.100.9" {
+		t.Errorf("Expected client IP in context, got %q", w.Body.String())
+	}
+}
@@ -1,14 +1,21 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
+
+	"gochop-it/internal/tracing"
 )
 
 type Message struct {
@@ -16,57 +23,137 @@ type Message struct {
 	Body   string `json:"body"`
 }
 
-func PerClientRateLimiter(next func(writer http.ResponseWriter, request *http.Request)) http.Handler {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
+// limiter decides whether the client identified by key may make another request costing n tokens
+type limiter interface {
+	Allow(ctx context.Context, key string, n int) (decision, error)
+}
+
+// decision is a limiter's answer for one request
+type decision struct {
+	allowed bool
+	// limit is the bucket size and remaining the whole tokens left after this request
+	limit     int
+	remaining int
+	// reset is how long until the bucket is full again
+	reset time.Duration
+	// retryAfter is how long until the next request would be allowed, set when denied
+	retryAfter time.Duration
+}
+
+// allow asks the limiter about a request costing n tokens inside a span, so slow Redis buckets show up in traces
+func allow(ctx context.Context, l limiter, key, route, policy string, n int) (decision, error) {
+	ctx, span := tracing.Start(ctx, "rate limit", trace.WithAttributes(
+		attribute.String("ratelimit.route", route),
+		attribute.String("ratelimit.policy", policy),
+		attribute.Int("ratelimit.cost", n),
+	))
+	d, err := l.Allow(ctx, key, n)
+	span.SetAttributes(attribute.Bool("ratelimit.allowed", d.allowed))
+	tracing.End(span, err)
+	return d, err
+}
+
+// requestIP returns the client address resolved behind trusted proxies, or the peer address
+func requestIP(r *http.Request) string {
+	if ip := ClientIP(r.Context()); ip != "" {
+		return ip
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return ip
+}
+
+// applyDecision sets the RateLimit headers and, when the request is denied,
+// replies with 429 and Retry-After. It reports whether the request may continue.
+func applyDecision(w http.ResponseWriter, d decision) bool {
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(d.limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.reset)))
+	if d.allowed {
+		return true
+	}
+
+	h.Set("Retry-After", strconv.Itoa(ceilSeconds(d.retryAfter)))
+	h.Set("Content-Type", "application/json")
+	message := Message{
+		Status: "Request Failed",
+		Body:   "The API is at capacity, try again later.",
+	}
+
+	w.WriteHeader(http.StatusTooManyRequests)
+	if err := json.NewEncoder(w).Encode(&message); err != nil {
+		slog.Error("Failed to encode JSON response", "error", err)
+	}
+	return false
+}
+
+// ceilSeconds rounds a duration up to whole seconds, as used by the rate limit headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// memoryLimiter keeps a token bucket per client in process memory
+type memoryLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*client
+	limit   rate.Limit
+	burst   int
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newMemoryLimiter creates the limiter and starts dropping clients that have gone quiet
+func newMemoryLimiter(limit rate.Limit, burst int) *memoryLimiter {
+	l := &memoryLimiter{
+		clients: make(map[string]*client),
+		limit:   limit,
+		burst:   burst,
 	}
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
 	go func() {
 		for {
 			time.Sleep(time.Minute)
 			// Lock the mutex to protect this section from race conditions.
-			mu.Lock()
-			for ip, client := range clients {
+			l.mu.Lock()
+			for ip, client := range l.clients {
 				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
+					delete(l.clients, ip)
 				}
 			}
-			mu.Unlock()
+			l.mu.Unlock()
 		}
 	}()
+	return l
+}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Extract the IP address from the request.
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		// Lock the mutex to protect this section from race conditions.
-		mu.Lock()
-		if _, found := clients[ip]; !found {
-			clients[ip] = &client{limiter: rate.NewLimiter(2, 4)}
-		}
-		clients[ip].lastSeen = time.Now()
-		if !clients[ip].limiter.Allow() {
-			mu.Unlock()
-
-			message := Message{
-				Status: "Request Failed",
-				Body:   "The API is at capacity, try again later.",
-			}
+// Allow takes n tokens from the client's bucket, it never fails
+func (l *memoryLimiter) Allow(ctx context.Context, key string, n int) (decision, error) {
+	// Lock the mutex to protect this section from race conditions.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, found := l.clients[key]; !found {
+		l.clients[key] = &client{limiter: rate.NewLimiter(l.limit, l.burst)}
+	}
+	c := l.clients[key]
+	c.lastSeen = time.Now()
 
-			w.WriteHeader(http.StatusTooManyRequests)
-			if err := json.NewEncoder(w).Encode(&message); err != nil {
-				log.Printf("Error during JSON encoding")
-			}
-			return
-		}
-		mu.Unlock()
-		next(w, r)
-	})
+	d := decision{limit: l.burst}
+	now := time.Now()
+	res := c.limiter.ReserveN(now, n)
+	if delay := res.DelayFrom(now); delay > 0 {
+		// Hand the token back, a rejected request doesn't use up the bucket
+		res.CancelAt(now)
+		d.retryAfter = delay
+	} else {
+		d.allowed = true
+	}
+	tokens := c.limiter.TokensAt(now)
+	d.remaining = max(0, int(tokens))
+	d.reset = time.Duration((float64(l.burst) - tokens) / float64(l.limit) * float64(time.Second))
+	return d, nil
 }
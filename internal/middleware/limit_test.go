@@ -5,6 +5,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"gochop-it/internal/config"
+	"gochop-it/internal/metrics"
 )
 
 // Mock handler to wrap with the rate limiter
@@ -15,10 +21,16 @@ func mockHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// newTestLimiter wraps the mock handler in the "shorten" route's limit, rps requests per second
+// with the given burst for each client, in Redis when client is not nil
+func newTestLimiter(client *redis.Client, rps float64, burst int) http.Handler {
+	return NewRateLimiter(config.RateLimitConfig{RPS: rps, Burst: burst}, client).Limit("shorten")(http.HandlerFunc(mockHandler))
+}
+
 // Test if the rate limiter allows requests within the limit
 func TestRateLimiter_AllowsRequests(t *testing.T) {
 	// Wrap the mock handler with the rate limiter
-	limiter := PerClientRateLimiter(mockHandler)
+	limiter := newTestLimiter(nil, 2, 4)
 
 	// Create a test HTTP server
 	req := httptest.NewRequest("GET", "/", nil)
@@ -37,21 +49,23 @@ func TestRateLimiter_AllowsRequests(t *testing.T) {
 // Test if the rate limiter rejects requests when the limit is exceeded
 func TestRateLimiter_RejectsExcessiveRequests(t *testing.T) {
 	// Wrap the mock handler with the rate limiter
-	limiter := PerClientRateLimiter(mockHandler)
+	limiter := newTestLimiter(nil, 2, 4)
 
 	// Create a test HTTP server
 	req := httptest.NewRequest("GET", "/", nil)
 	req.RemoteAddr = "192.168.1.1:1234"
 	w := httptest.NewRecorder()
 
-	// First, make allowed requests
-	for i := 0; i < 12; i++ {
+	// First, use up the burst
+	for i := 0; i < 4; i++ {
+		w = httptest.NewRecorder()
 		limiter.ServeHTTP(w, req)
 		if w.Result().StatusCode != http.StatusOK {
 			t.Errorf("Expected status OK, got %v", w.Result().StatusCode)
 		}
 	}
 
+	rejected := testutil.ToFloat64(metrics.RateLimitRejections.WithLabelValues("shorten"))
 	// Exceed the rate limit
 	for i := 0; i < 10; i++ {
 		w = httptest.NewRecorder() // Reset the response recorder
@@ -60,12 +74,15 @@ func TestRateLimiter_RejectsExcessiveRequests(t *testing.T) {
 			t.Errorf("Expected status TooManyRequests, got %v", w.Result().StatusCode)
 		}
 	}
+	if got := testutil.ToFloat64(metrics.RateLimitRejections.WithLabelValues("shorten")) - rejected; got != 10 {
+		t.Errorf("Expected 10 rejections to be counted, got %v", got)
+	}
 }
 
 // Test if the rate limiter is enforced on a per-client basis
 func TestRateLimiter_PerClientEnforcement(t *testing.T) {
 	// Wrap the mock handler with the rate limiter
-	limiter := PerClientRateLimiter(mockHandler)
+	limiter := newTestLimiter(nil, 2, 4)
 
 	// Create two different test clients
 	reqClient1 := httptest.NewRequest("GET", "/", nil)
@@ -0,0 +1,201 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/time/rate"
+
+	"gochop-it/internal/config"
+	"gochop-it/internal/metrics"
+)
+
+// RateLimiter applies the declarative rate limit policies from config.RateLimitConfig.
+// Each request is limited by its API key tier's policy when it has one, else by its
+// route's policy, else by the default. Authenticated callers are counted per owner and
+// anonymous ones per client address, with separate buckets on every route.
+type RateLimiter struct {
+	limiters map[string]limiter
+	// bursts is the bucket size of every policy, reported to allow-listed callers
+	bursts      map[string]int
+	routes      map[string]bool
+	tiers       map[string]bool
+	allowList   []*net.IPNet
+	allowOwners []string
+}
+
+// NewRateLimiter builds the policies. The buckets live in Redis when client is not nil,
+// falling back to memory while Redis is down, and in memory otherwise.
+func NewRateLimiter(cfg config.RateLimitConfig, client *redis.Client) *RateLimiter {
+	newLimiter := func(policy config.RateLimitPolicy) limiter {
+		memory := newMemoryLimiter(rate.Limit(policy.RPS), policy.Burst)
+		if client == nil {
+			return memory
+		}
+		return &fallbackLimiter{primary: newRedisLimiter(client, policy.RPS, policy.Burst), fallback: memory}
+	}
+
+	// Allow list entries are checked by config.Validate
+	allowList, _ := cfg.AllowListNets()
+	l := &RateLimiter{
+		limiters:    map[string]limiter{"default": newLimiter(config.RateLimitPolicy{RPS: cfg.RPS, Burst: cfg.Burst})},
+		bursts:      map[string]int{"default": cfg.Burst},
+		routes:      make(map[string]bool),
+		tiers:       make(map[string]bool),
+		allowList:   allowList,
+		allowOwners: cfg.AllowOwners,
+	}
+	for name, policy := range cfg.Routes {
+		l.limiters["route:"+name] = newLimiter(policy)
+		l.bursts["route:"+name] = policy.Burst
+		l.routes[name] = true
+	}
+	for name, policy := range cfg.Tiers {
+		l.limiters["tier:"+name] = newLimiter(policy)
+		l.bursts["tier:"+name] = policy.Burst
+		l.tiers[name] = true
+	}
+	return l
+}
+
+// Limit returns the middleware for the named route. It must run after Authenticate and
+// ClientIPResolver.Middleware so the caller's tier and address are known.
+func (l *RateLimiter) Limit(route string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			ip := requestIP(r)
+			if ip == "" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			ownerID := OwnerID(ctx)
+			policy := l.policy(route, APITier(ctx))
+			if l.allowed(ip, ownerID) {
+				// Allow-listed callers are never counted, so their bucket is always full
+				applyDecision(w, decision{allowed: true, limit: l.bursts[policy], remaining: l.bursts[policy]})
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			client := "ip:" + clientKey(ip)
+			if ownerID != "" {
+				client = "owner:" + ownerID
+			}
+			key := policy + " " + route + " " + client
+			d, ok := l.take(w, r, route, policy, key)
+			if !ok {
+				return
+			}
+			// Handlers doing the work of several requests charge the rest from the same bucket
+			bucket := &chargedBucket{limiter: l.limiters[policy], key: key, route: route, policy: policy, limit: d.limit}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, chargeKey{}, bucket)))
+		})
+	}
+}
+
+// LimitKeyLookups limits requests carrying an API key per client address under the "auth" route's
+// policy. It runs before Authenticate, so clients guessing keys are stopped before each guess costs
+// a storage lookup, and after ClientIPResolver.Middleware. Anonymous requests pass straight through.
+func (l *RateLimiter) LimitKeyLookups(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := requestIP(r)
+		if ip == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if l.allowed(ip, "") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		policy := l.policy("auth", "")
+		if _, ok := l.take(w, r, "auth", policy, policy+" auth ip:"+clientKey(ip)); ok {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// take charges a request to the bucket under key, replying with 500 or 429 when it may not continue
+func (l *RateLimiter) take(w http.ResponseWriter, r *http.Request, route, policy, key string) (decision, bool) {
+	ctx := r.Context()
+	d, err := allow(ctx, l.limiters[policy], key, route, policy, 1)
+	if err != nil {
+		slog.ErrorContext(ctx, "Rate limiter failed", "route", route, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return d, false
+	}
+	if !applyDecision(w, d) {
+		metrics.RateLimitRejections.WithLabelValues(route).Inc()
+		return d, false
+	}
+	return d, true
+}
+
+// policy names the limiter for a request, the tier's if it has one, else the route's, else the default
+func (l *RateLimiter) policy(route, tier string) string {
+	if tier != "" && l.tiers[tier] {
+		return "tier:" + tier
+	}
+	if l.routes[route] {
+		return "route:" + route
+	}
+	return "default"
+}
+
+// allowed reports whether the caller is on an allow list and skips rate limiting
+func (l *RateLimiter) allowed(ip, ownerID string) bool {
+	if ownerID != "" && slices.Contains(l.allowOwners, ownerID) {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	for _, network := range l.allowList {
+		if parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+type chargeKey struct{}
+
+// chargedBucket is the bucket that allowed a request, kept so the handler can charge more tokens
+type chargedBucket struct {
+	limiter            limiter
+	key, route, policy string
+	limit              int
+}
+
+// Charge takes n more tokens from the caller's bucket, for a request doing the work of several,
+// such as a bulk shorten charging one token per row. A request never costs more than a full
+// bucket, else it could never get through. When the tokens aren't available it replies with 429
+// and returns false. Requests that weren't rate limited, such as allow-listed ones, always pass.
+func Charge(w http.ResponseWriter, r *http.Request, n int) bool {
+	ctx := r.Context()
+	bucket, ok := ctx.Value(chargeKey{}).(*chargedBucket)
+	if !ok {
+		return true
+	}
+	n = min(n, bucket.limit-1)
+	if n <= 0 {
+		return true
+	}
+	d, err := allow(ctx, bucket.limiter, bucket.key, bucket.route, bucket.policy, n)
+	if err != nil {
+		slog.ErrorContext(ctx, "Rate limiter failed", "route", bucket.route, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	if !applyDecision(w, d) {
+		metrics.RateLimitRejections.WithLabelValues(bucket.route).Inc()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,261 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"gochop-it/internal/config"
+	"gochop-it/internal/repository"
+	"gochop-it/internal/tracing/tracingtest"
+)
+
+// testPolicies limits the default to 1 request, redirects to 3 and the pro tier to 5
+func testPolicies() config.RateLimitConfig {
+	return config.RateLimitConfig{
+		RPS:         0.01,
+		Burst:       1,
+		Routes:      map[string]config.RateLimitPolicy{"redirect": {RPS: 0.01, Burst: 3}},
+		Tiers:       map[string]config.RateLimitPolicy{"pro": {RPS: 0.01, Burst: 5}},
+		AllowList:   []string{"10.0.0.0/8"},
+		AllowOwners: []string{"internal"},
+	}
+}
+
+// allowedRequests counts the requests served before the first 429
+func allowedRequests(t *testing.T, handler http.Handler, newRequest func() *http.Request) int {
+	for i := 0; i < 20; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest())
+		if w.Code == http.StatusTooManyRequests {
+			return i
+		}
+	}
+	return 20
+}
+
+func TestRateLimiterPolicies(t *testing.T) {
+	limiter := NewRateLimiter(testPolicies(), nil)
+	shorten := limiter.Limit("shorten")(http.HandlerFunc(mockHandler))
+	redirect := limiter.Limit("redirect")(http.HandlerFunc(mockHandler))
+
+	request := func(ip, owner, tier string) func() *http.Request {
+		return func() *http.Request {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = ip + ":1234"
+			ctx := WithAPITier(WithOwnerID(req.Context(), owner), tier)
+			return req.WithContext(ctx)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		request func() *http.Request
+		want    int
+	}{
+		{"default policy", shorten, request("192.0.2.1", "", ""), 1},
+		{"route policy", redirect, request("192.0.2.1", "", ""), 3},
+		{"tier policy", shorten, request("192.0.2.2", "team-a", "pro"), 5},
+		{"unknown tier uses the route", redirect, request("192.0.2.3", "team-b", "gold"), 3},
+		{"allow listed address", shorten, request("10.1.2.3", "", ""), 20},
+		{"allow listed owner", shorten, request("192.0.2.4", "internal", ""), 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowedRequests(t, tt.handler, tt.request); got != tt.want {
+				t.Errorf("Expected %d requests to be allowed, got %d", tt.want, got)
+			}
+		})
+	}
+
+	// Owners are counted per key, not per address
+	if got := allowedRequests(t, shorten, request("192.0.2.99", "team-a", "pro")); got != 0 {
+		t.Errorf("Expected team-a to have used its bucket from another address, got %d allowed", got)
+	}
+}
+
+func TestRateLimiterHeaders(t *testing.T) {
+	limiter := NewRateLimiter(testPolicies(), nil)
+	handler := limiter.Limit("redirect")(http.HandlerFunc(mockHandler))
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if got := w.Header().Get("RateLimit-Limit"); got != "3" {
+			t.Errorf("Expected RateLimit-Limit 3, got %q", got)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != strconv.Itoa(2-i) {
+			t.Errorf("Request %d: expected RateLimit-Remaining %d, got %q", i+1, 2-i, got)
+		}
+		if w.Header().Get("Retry-After") != "" {
+			t.Errorf("Expected no Retry-After on an allowed request")
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status TooManyRequests, got %v", w.Code)
+	}
+	// One token refills every 100 seconds
+	if got := w.Header().Get("Retry-After"); got != "100" {
+		t.Errorf("Expected Retry-After 100, got %q", got)
+	}
+	if got := w.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("Expected RateLimit-Remaining 0, got %q", got)
+	}
+
+	// Allow-listed callers see the policy with a bucket that never empties
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.1.2.3:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected allow-listed callers to pass, got %d", w.Code)
+		}
+		if limit, remaining := w.Header().Get("RateLimit-Limit"), w.Header().Get("RateLimit-Remaining"); limit != "3" || remaining != "3" {
+			t.Errorf("Expected RateLimit-Limit 3 and RateLimit-Remaining 3, got %q and %q", limit, remaining)
+		}
+		if got := w.Header().Get("RateLimit-Reset"); got != "0" {
+			t.Errorf("Expected RateLimit-Reset 0, got %q", got)
+		}
+	}
+}
+
+// Test every limiter decision is traced with the route, policy and outcome
+func TestRateLimiterSpans(t *testing.T) {
+	recorder := tracingtest.Record(t)
+	limiter := NewRateLimiter(testPolicies(), nil)
+	redirect := limiter.Limit("redirect")(http.HandlerFunc(mockHandler))
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("GET", "/r/bc", nil)
+		req.RemoteAddr = "192.168.1.9:1234"
+		return req
+	}
+	if allowed := allowedRequests(t, redirect, newRequest); allowed != 3 {
+		t.Fatalf("Expected 3 allowed requests, got %d", allowed)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 4 {
+		t.Fatalf("Expected a span per decision, got %v", tracingtest.Names(recorder))
+	}
+	for n, span := range spans {
+		attrs := map[string]any{}
+		for _, attr := range span.Attributes() {
+			attrs[string(attr.Key)] = attr.Value.AsInterface()
+		}
+		if span.Name() != "rate limit" || attrs["ratelimit.route"] != "redirect" || attrs["ratelimit.policy"] != "route:redirect" || attrs["ratelimit.allowed"] != (n < 3) {
+			t.Errorf("Unexpected span %d: %s %v", n, span.Name(), attrs)
+		}
+	}
+}
+
+// Test handlers can charge more tokens from the bucket that let the request through,
+// never more than a full bucket
+func TestCharge(t *testing.T) {
+	limiter := NewRateLimiter(testPolicies(), nil)
+	rows := 0
+	bulk := limiter.Limit("redirect")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Charge(w, r, rows) {
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	request := func(ip string) *http.Request {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		return req
+	}
+
+	// The bucket holds 3, a request charging 1 more leaves 1
+	rows = 1
+	w := httptest.NewRecorder()
+	bulk.ServeHTTP(w, request("192.0.2.1"))
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "1" {
+		t.Fatalf("Expected the request to pass with 1 token left, got %d and %s", w.Code, w.Header().Get("RateLimit-Remaining"))
+	}
+	w = httptest.NewRecorder()
+	bulk.ServeHTTP(w, request("192.0.2.1"))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the extra token to be refused with 429, got %d", w.Code)
+	}
+
+	// A request costing more than the bucket takes all of it
+	rows = 100
+	w = httptest.NewRecorder()
+	bulk.ServeHTTP(w, request("192.0.2.2"))
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Expected the request to empty the bucket, got %d and %s", w.Code, w.Header().Get("RateLimit-Remaining"))
+	}
+
+	// Allow-listed callers aren't charged
+	w = httptest.NewRecorder()
+	bulk.ServeHTTP(w, request("10.0.0.1"))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected allow-listed callers to pass, got %d", w.Code)
+	}
+}
+
+// countingKeys counts API key lookups and never finds a key
+type countingKeys struct {
+	lookups int
+}
+
+func (k *countingKeys) FindAPIKey(ctx context.Context, hash string) (*repository.APIKey, error) {
+	k.lookups++
+	return nil, repository.ErrNotFound
+}
+
+// Test requests with API keys are limited per address before the key is looked up,
+// while anonymous and allow-listed requests aren't
+func TestLimitKeyLookups(t *testing.T) {
+	cfg := testPolicies()
+	cfg.Routes["auth"] = config.RateLimitPolicy{RPS: 0.01, Burst: 2}
+	limiter := NewRateLimiter(cfg, nil)
+	keys := &countingKeys{}
+	handler := limiter.LimitKeyLookups(Authenticate(keys)(http.HandlerFunc(mockHandler)))
+
+	request := func(ip, header string) func() *http.Request {
+		return func() *http.Request {
+			req := httptest.NewRequest("GET", "/api/v1/links", nil)
+			req.RemoteAddr = ip + ":1234"
+			if header != "" {
+				req.Header.Set("Authorization", header)
+			}
+			return req
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request("192.0.2.1", "Bearer sc_guess"+strconv.Itoa(i))())
+		want := http.StatusUnauthorized
+		if i >= 2 {
+			want = http.StatusTooManyRequests
+		}
+		if w.Code != want {
+			t.Errorf("Request %d: expected status %d, got %d", i, want, w.Code)
+		}
+	}
+	if keys.lookups != 2 {
+		t.Errorf("Expected 2 key lookups before the address was limited, got %d", keys.lookups)
+	}
+
+	if got := allowedRequests(t, handler, request("192.0.2.1", "")); got != 20 {
+		t.Errorf("Expected anonymous requests to skip the key lookup limit, got %d allowed", got)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, request("10.0.0.1", "Bearer sc_guess")())
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected allow-listed addresses to skip the key lookup limit, got %d", w.Code)
+	}
+}
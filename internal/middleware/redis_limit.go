@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// tokenBucketScript refills and takes tokens from the bucket in KEYS[1] atomically.
+// ARGV holds the refill rate per second, the burst, the idle key TTL and the tokens to take. Redis' own clock is
+// used so every instance agrees on the time. Returns whether the request is allowed (1 or 0),
+// the whole tokens left, and the milliseconds until the bucket is full and until the next token.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local cost = tonumber(ARGV[4])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= cost then
+	tokens = tokens - cost
+	allowed = 1
+else
+	retry = math.ceil((cost - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], tonumber(ARGV[3]))
+return {allowed, math.floor(tokens), math.ceil((burst - tokens) / rate * 1000), retry}
+`)
+
+// rateLimitKeyPrefix namespaces the bucket keys in Redis
+const rateLimitKeyPrefix = "ratelimit:"
+
+// redisLimiter keeps a token bucket per client in Redis
+type redisLimiter struct {
+	client *redis.Client
+	rps    float64
+	burst  int
+	// ttlMillis is how long an idle bucket is kept, the time it takes to refill plus a second
+	ttlMillis int64
+}
+
+func newRedisLimiter(client *redis.Client, rps float64, burst int) *redisLimiter {
+	return &redisLimiter{
+		client:    client,
+		rps:       rps,
+		burst:     burst,
+		ttlMillis: int64(math.Ceil(float64(burst)/rps*1000)) + 1000,
+	}
+}
+
+// Allow takes n tokens from the client's bucket in Redis
+func (l *redisLimiter) Allow(ctx context.Context, key string, n int) (decision, error) {
+	res, err := tokenBucketScript.Run(ctx, l.client, []string{rateLimitKeyPrefix + key}, l.rps, l.burst, l.ttlMillis, n).Int64Slice()
+	if err != nil {
+		return decision{}, err
+	}
+	if len(res) != 4 {
+		return decision{}, fmt.Errorf("unexpected rate limit script result %v", res)
+	}
+	return decision{
+		allowed:    res[0] == 1,
+		limit:      l.burst,
+		remaining:  int(res[1]),
+		reset:      time.Duration(res[2]) * time.Millisecond,
+		retryAfter: time.Duration(res[3]) * time.Millisecond,
+	}, nil
+}
+
+// fallbackRetryInterval is how long the fallback is used before Redis is tried again,
+// so an outage doesn't make every request wait for a Redis timeout
+const fallbackRetryInterval = 5 * time.Second
+
+// fallbackLimiter uses the primary limiter, switching to the fallback while the primary fails
+type fallbackLimiter struct {
+	primary  limiter
+	fallback limiter
+	// retryAt is when to try the primary again in Unix nanoseconds, zero while it is healthy
+	retryAt atomic.Int64
+}
+
+// Allow asks the primary limiter and falls back on errors, logging only when the state changes
+func (l *fallbackLimiter) Allow(ctx context.Context, key string, n int) (decision, error) {
+	retryAt := l.retryAt.Load()
+	if retryAt != 0 && time.Now().UnixNano() < retryAt {
+		return l.fallback.Allow(ctx, key, n)
+	}
+
+	d, err := l.primary.Allow(ctx, key, n)
+	if err == nil {
+		if retryAt != 0 && l.retryAt.CompareAndSwap(retryAt, 0) {
+			slog.InfoContext(ctx, "Rate limiter recovered, using Redis again")
+		}
+		return d, nil
+	}
+	if l.retryAt.Swap(time.Now().Add(fallbackRetryInterval).UnixNano()) == 0 {
+		slog.WarnContext(ctx, "Rate limiter falling back to in-memory buckets", "error", err)
+	}
+	return l.fallback.Allow(ctx, key, n)
+}
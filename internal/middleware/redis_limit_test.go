@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestRedis starts a miniredis server and a client connected to it
+func newTestRedis(t *testing.T) (*redis.Client, *miniredis.Miniredis) {
+	mock := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mock.Addr(), MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	t.Cleanup(func() { _ = client.Close() })
+	return client, mock
+}
+
+// Test that instances sharing Redis enforce one limit between them
+func TestRedisRateLimiter_SharedAcrossInstances(t *testing.T) {
+	client, _ := newTestRedis(t)
+	instanceA := newTestLimiter(client, 1, 4)
+	instanceB := newTestLimiter(client, 1, 4)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+
+	for i, limiter := range []http.Handler{instanceA, instanceB, instanceA, instanceB} {
+		w := httptest.NewRecorder()
+		limiter.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected status OK, got %v", i+1, w.Code)
+		}
+	}
+
+	// The burst is used up on both instances
+	for _, limiter := range []http.Handler{instanceA, instanceB} {
+		w := httptest.NewRecorder()
+		limiter.ServeHTTP(w, req)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected status TooManyRequests, got %v", w.Code)
+		}
+	}
+
+	// Other clients have their own bucket
+	other := httptest.NewRequest("GET", "/", nil)
+	other.RemoteAddr = "192.168.1.2:1234"
+	w := httptest.NewRecorder()
+	instanceA.ServeHTTP(w, other)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status OK for another client, got %v", w.Code)
+	}
+}
+
+// Test that the limiter keeps working from memory while Redis is down
+func TestRedisRateLimiter_FallsBackWhenRedisDown(t *testing.T) {
+	client, mock := newTestRedis(t)
+	limiter := newTestLimiter(client, 1, 2)
+	mock.Close()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		limiter.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected status OK, got %v", i+1, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	limiter.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected in-memory fallback to enforce the limit, got %v", w.Code)
+	}
+}
+
+// Test that policies backed by Redis report the same headers as the in-memory buckets
+func TestRateLimiterPoliciesRedis(t *testing.T) {
+	client, _ := newTestRedis(t)
+	handler := NewRateLimiter(testPolicies(), client).Limit("redirect")(http.HandlerFunc(mockHandler))
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Request %d: expected status OK, got %v", i+1, w.Code)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != strconv.Itoa(2-i) {
+			t.Errorf("Request %d: expected RateLimit-Remaining %d, got %q", i+1, 2-i, got)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status TooManyRequests, got %v", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "100" {
+		t.Errorf("Expected Retry-After 100, got %q", got)
+	}
+}
+
+// Test a request charging several tokens takes them from the shared bucket in one go
+func TestRedisLimiterCost(t *testing.T) {
+	client, _ := newTestRedis(t)
+	l := newRedisLimiter(client, 0.01, 5)
+
+	d, err := l.Allow(context.TODO(), "bulk", 3)
+	if err != nil || !d.allowed || d.remaining != 2 {
+		t.Fatalf("Expected 3 tokens to be taken, got %+v, %v", d, err)
+	}
+	d, err = l.Allow(context.TODO(), "bulk", 3)
+	if err != nil || d.allowed || d.remaining != 2 {
+		t.Fatalf("Expected 3 more tokens to be refused without taking any, got %+v, %v", d, err)
+	}
+	// The bucket refills a little between the calls, Retry-After rounds it back up
+	if got := ceilSeconds(d.retryAfter); got != 100 {
+		t.Errorf("Expected to retry in 100s once the missing token is back, got %v", d.retryAfter)
+	}
+}
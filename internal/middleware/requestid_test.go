@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gochop-it/internal/logging"
+)
+
+// Test a valid incoming request ID is kept and a missing or malformed one is replaced
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = logging.RequestID(r.Context())
+	}))
+
+	tests := []struct {
+		header string
+		keep   bool
+	}{
+		{"4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"", false},
+		{"spoofed\nlevel=ERROR", false},
+		{string(make([]byte, maxRequestIDLength+1)), false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			req.Header.Set(RequestIDHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		got := w.Header().Get(RequestIDHeader)
+		if got != seen {
+			t.Errorf("Expected the response to echo the context ID %q, got %q", seen, got)
+		}
+		if tt.keep && got != tt.header {
+			t.Errorf("Expected the incoming ID %q to be kept, got %q", tt.header, got)
+		}
+		if !tt.keep && (got == tt.header || len(got) != 32) {
+			t.Errorf("Expected a generated ID for %q, got %q", tt.header, got)
+		}
+	}
+}
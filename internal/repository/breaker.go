@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"gochop-it/internal/metrics"
+)
+
+// CircuitBreaker stops redirects from going to Redis while it is failing, so they are served from
+// storage at once instead of each waiting for a Redis timeout. After threshold errors in a row the
+// breaker opens, and once the cooldown has passed a single call is let through to probe Redis:
+// a success closes the breaker, another error keeps it open for another cooldown.
+// A nil *CircuitBreaker is valid and never opens.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	open      bool
+	// retryAt is when the next call may go through while the breaker is open
+	retryAt time.Time
+}
+
+// NewCircuitBreaker creates a breaker opening after threshold errors in a row for cooldown
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow reports whether a call may go to Redis. While the breaker is open it lets one probe
+// through per cooldown, and a probe that never reports back only holds Redis off for that long.
+func (b *CircuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.retryAt) {
+		return false
+	}
+	b.retryAt = now.Add(b.cooldown)
+	return true
+}
+
+// Success records a call Redis answered and closes the breaker
+func (b *CircuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	if b.open {
+		b.open = false
+		metrics.RedisBreakerOpen.Set(0)
+		slog.Info("Redis is back, using the cache again")
+	}
+}
+
+// Failure records a Redis error and opens the breaker once there are threshold in a row
+func (b *CircuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures < b.threshold {
+		return
+	}
+	b.retryAt = time.Now().Add(b.cooldown)
+	if !b.open {
+		b.open = true
+		metrics.RedisBreakerOpen.Set(1)
+		slog.Warn("Redis is failing, skipping the cache", "failures", b.failures, "retry_in", b.cooldown)
+	}
+}
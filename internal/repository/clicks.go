@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"sort"
+	"time"
+)
+
+// ClickEvent records a single redirect for analytics
+type ClickEvent struct {
+	LinkID    int64     `bson:"linkID"`
+	Timestamp time.Time `bson:"timestamp"`
+	Referrer  string    `bson:"referrer"`
+	UserAgent string    `bson:"userAgent"`
+	IPHash    string    `bson:"ipHash"`
+	Country   string    `bson:"country,omitempty"`
+}
+
+// ClickBucket is the number of clicks in the bucket starting at Start
+type ClickBucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// ClickCount is the number of clicks for a single value, such as a referrer
+type ClickCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// ClickStats summarises the click events of a link
+type ClickStats struct {
+	Buckets      []ClickBucket `json:"buckets"`
+	TopReferrers []ClickCount  `json:"topReferrers"`
+	Countries    []ClickCount  `json:"countries"`
+	UserAgents   []ClickCount  `json:"userAgents"`
+}
+
+// topClickCountLimit caps the number of entries in each ClickStats top list
+const topClickCountLimit = 10
+
+// aggregateClicks builds ClickStats from raw events, for backends without server side aggregation
+func aggregateClicks(events []ClickEvent, bucket time.Duration) *ClickStats {
+	buckets := make(map[time.Time]int)
+	referrers := make(map[string]int)
+	countries := make(map[string]int)
+	userAgents := make(map[string]int)
+	for _, ev := range events {
+		buckets[ev.Timestamp.Truncate(bucket)]++
+		referrers[ev.Referrer]++
+		if ev.Country != "" {
+			countries[ev.Country]++
+		}
+		userAgents[ev.UserAgent]++
+	}
+
+	stats := &ClickStats{
+		Buckets:      make([]ClickBucket, 0, len(buckets)),
+		TopReferrers: topClickCounts(referrers),
+		Countries:    topClickCounts(countries),
+		UserAgents:   topClickCounts(userAgents),
+	}
+	for start, count := range buckets {
+		stats.Buckets = append(stats.Buckets, ClickBucket{Start: start.UTC(), Count: count})
+	}
+	sort.Slice(stats.Buckets, func(i, j int) bool { return stats.Buckets[i].Start.Before(stats.Buckets[j].Start) })
+	return stats
+}
+
+// topClickCounts returns the most frequent values, highest count first
+func topClickCounts(counts map[string]int) []ClickCount {
+	top := make([]ClickCount, 0, len(counts))
+	for value, count := range counts {
+		top = append(top, ClickCount{Value: value, Count: count})
+	}
+	sortClickCounts(top)
+	if len(top) > topClickCountLimit {
+		top = top[:topClickCountLimit]
+	}
+	return top
+}
+
+// sortClickCounts orders by count descending, then value so results are stable
+func sortClickCounts(counts []ClickCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Value < counts[j].Value
+	})
+}
@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"context"
+	"sync"
+)
+
+// IDAllocator hands out IDs from blocks leased from a shared counter, so an instance writes
+// to the counter once per block instead of once per link. IDs left in a block when the
+// instance stops are never used, leaving gaps in the sequence, and links saved by different
+// instances are no longer numbered in the order they were created.
+type IDAllocator struct {
+	reserve   func(ctx context.Context, counterName string, n int64) (int64, error)
+	leaseSize int64
+
+	mu     sync.Mutex
+	leases map[string]*idLease
+}
+
+// idLease is the unused part of a leased block, from next up to but excluding end
+type idLease struct {
+	next, end int64
+}
+
+// NewIDAllocator creates an allocator leasing leaseSize IDs at a time with reserve,
+// usually the ReserveIDs method of a repository. A lease size below 2 takes every ID
+// straight from the counter.
+func NewIDAllocator(reserve func(ctx context.Context, counterName string, n int64) (int64, error), leaseSize int64) *IDAllocator {
+	if leaseSize < 1 {
+		leaseSize = 1
+	}
+	return &IDAllocator{
+		reserve:   reserve,
+		leaseSize: leaseSize,
+		leases:    make(map[string]*idLease),
+	}
+}
+
+// Next returns the next ID of the named counter, leasing a new block once the current one is used up.
+// The block is reserved with ctx, so a cancelled request gives up instead of holding the lock.
+func (a *IDAllocator) Next(ctx context.Context, counterName string) (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lease := a.leases[counterName]
+	if lease == nil || lease.next >= lease.end {
+		first, err := a.reserve(ctx, counterName, a.leaseSize)
+		if err != nil {
+			return 0, err
+		}
+		lease = &idLease{next: first, end: first + a.leaseSize}
+		a.leases[counterName] = lease
+	}
+	id := lease.next
+	lease.next++
+	return id, nil
+}
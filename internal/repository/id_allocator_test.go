@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// TestIDAllocator checks instances leasing blocks from one counter never hand out the same ID
+func TestIDAllocator(t *testing.T) {
+	repo := NewMemoryRepo()
+	var mu sync.Mutex
+	reserves := 0
+	reserve := func(ctx context.Context, counterName string, n int64) (int64, error) {
+		mu.Lock()
+		reserves++
+		mu.Unlock()
+		return repo.ReserveIDs(ctx, counterName, n)
+	}
+	instances := []*IDAllocator{NewIDAllocator(reserve, 10), NewIDAllocator(reserve, 10)}
+
+	const perWorker = 25
+	var wg sync.WaitGroup
+	ids := make(chan int64, 4*perWorker)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(allocator *IDAllocator) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				id, err := allocator.Next(context.TODO(), "url_counter")
+				if err != nil {
+					t.Errorf("Failed to allocate ID: %v", err)
+					return
+				}
+				ids <- id
+			}
+		}(instances[w%2])
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int64]bool)
+	for id := range ids {
+		if id < 1 || seen[id] {
+			t.Fatalf("Unexpected ID %d", id)
+		}
+		seen[id] = true
+	}
+	// 50 IDs per instance take exactly 5 blocks each
+	if reserves != 10 {
+		t.Errorf("Expected 10 leases, got %d", reserves)
+	}
+
+	// A new instance starts after every leased block, skipping what the others haven't used
+	id, err := NewIDAllocator(repo.ReserveIDs, 10).Next(context.TODO(), "url_counter")
+	if err != nil {
+		t.Fatalf("Failed to allocate ID: %v", err)
+	}
+	if id != 101 {
+		t.Errorf("Expected ID 101, got %d", id)
+	}
+}
+
+// TestIDAllocatorError checks a failed lease is retried on the next call
+func TestIDAllocatorError(t *testing.T) {
+	fail := true
+	allocator := NewIDAllocator(func(ctx context.Context, counterName string, n int64) (int64, error) {
+		if fail {
+			return 0, errors.New("counter unavailable")
+		}
+		return 1, nil
+	}, 100)
+
+	if _, err := allocator.Next(context.TODO(), "url_counter"); err == nil {
+		t.Fatalf("Expected the lease error")
+	}
+	fail = false
+	for want := int64(1); want <= 3; want++ {
+		id, err := allocator.Next(context.TODO(), "url_counter")
+		if err != nil || id != want {
+			t.Errorf("Expected ID %d, got %d, %v", want, id, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// APIKey is an API key document. Only the SHA-256 hash of the key is stored,
+// the plaintext is shown once when the key is created.
+type APIKey struct {
+	Hash    string `bson:"_id"`
+	OwnerID string `bson:"ownerID"`
+	Name    string `bson:"name"`
+	// Tier selects the key's rate limit policy, empty for the default limits
+	Tier      string    `bson:"tier,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// apiKeyPrefix marks SmallChop keys so they are easy to spot in logs and secret scanners
+const apiKeyPrefix = "sc_"
+
+// NewAPIKey generates a random key for the owner, returning the plaintext key and the document to store
+func NewAPIKey(ownerID, name, tier string) (string, *APIKey, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	plaintext := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	return plaintext, &APIKey{
+		Hash:      HashAPIKey(plaintext),
+		OwnerID:   ownerID,
+		Name:      name,
+		Tier:      tier,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// HashAPIKey returns the stored form of a key. Keys are 256 bit random values,
+// so a fast hash is enough and lets every request look the key up directly.
+func HashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
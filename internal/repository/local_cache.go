@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"sync"
+	"time"
+)
+
+// LocalCache is a small in-process cache in front of Redis, so hot links are served without a
+// network round trip. Entries live for a short TTL and edits on any instance drop them early
+// through the invalidation channel, see RedisRepo.ListenForInvalidations.
+// A nil *LocalCache is valid and caches nothing.
+type LocalCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]localEntry
+}
+
+type localEntry struct {
+	urlDoc  URL
+	expires time.Time
+}
+
+// NewLocalCache creates a cache holding up to size links for ttl each
+func NewLocalCache(ttl time.Duration, size int) *LocalCache {
+	return &LocalCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]localEntry),
+	}
+}
+
+// Get returns a copy of the cached link for a short code
+func (c *LocalCache) Get(shortCode string) (*URL, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[shortCode]
+	if !ok || !time.Now().Before(entry.expires) {
+		return nil, false
+	}
+	urlDoc := entry.urlDoc
+	return &urlDoc, true
+}
+
+// Set caches a link for a short code, never past the link's own expiry
+func (c *LocalCache) Set(shortCode string, urlDoc *URL) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	ttl, ok := urlDoc.cacheTTL(c.ttl, now)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[shortCode]; !exists && len(c.entries) >= c.size {
+		c.evictLocked(now)
+	}
+	c.entries[shortCode] = localEntry{urlDoc: *urlDoc, expires: now.Add(ttl)}
+}
+
+// evictLocked makes room for one entry, dropping expired entries first and an arbitrary one
+// if none have expired. The caller must hold mu.
+func (c *LocalCache) evictLocked(now time.Time) {
+	for code, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, code)
+		}
+	}
+	for code := range c.entries {
+		if len(c.entries) < c.size {
+			return
+		}
+		delete(c.entries, code)
+	}
+}
+
+// Delete drops the short codes from the cache
+func (c *LocalCache) Delete(shortCodes ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, code := range shortCodes {
+		delete(c.entries, code)
+	}
+}
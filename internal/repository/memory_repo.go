@@ -0,0 +1,402 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"gochop-it/internal/logging"
+	"gochop-it/internal/metrics"
+)
+
+// MemoryRepo is an in-memory URLRepository for tests and quick local runs.
+// Nothing is persisted, so every restart begins with an empty store.
+type MemoryRepo struct {
+	mu       sync.Mutex
+	urls     map[int64]*URL
+	counters map[string]int64
+	clicks   []ClickEvent
+	apiKeys  map[string]*APIKey
+}
+
+var _ URLRepository = (*MemoryRepo)(nil)
+
+// NewMemoryRepo creates an empty in-memory repository
+func NewMemoryRepo() *MemoryRepo {
+	return &MemoryRepo{
+		urls:     make(map[int64]*URL),
+		counters: make(map[string]int64),
+		apiKeys:  make(map[string]*APIKey),
+	}
+}
+
+// SaveURL stores a new link or returns the existing document for a duplicate plain link
+func (repo *MemoryRepo) SaveURL(ctx context.Context, longURL string, opts LinkOptions) (*URL, error) {
+	urlDoc, existing, err := prepareURL(ctx, repo, repo.GetNextID, longURL, opts)
+	if err != nil || existing {
+		return urlDoc, err
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	saved, err := repo.insertLocked(urlDoc)
+	if err != nil || saved != urlDoc {
+		return saved, err
+	}
+
+	metrics.LinksCreated.WithLabelValues("single").Inc()
+	slog.DebugContext(ctx, "Saved new link", "code", urlDoc.ShortCode(), "url", logging.RedactURL(urlDoc.LongURL))
+	return urlDoc, nil
+}
+
+// SaveURLs saves a batch of links, each row failing on its own
+func (repo *MemoryRepo) SaveURLs(ctx context.Context, links []BulkLink) ([]BulkResult, error) {
+	batch, err := prepareURLs(ctx, repo, repo.ReserveIDs, links)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	for _, row := range batch.pending {
+		urlDoc, err := repo.insertLocked(batch.results[row].URL)
+		batch.results[row] = BulkResult{URL: urlDoc, Err: err}
+	}
+	return batch.finish(), nil
+}
+
+// insertLocked stores a new link, or returns the existing link if an equivalent plain link was saved first.
+// The alias and canonical key are re-checked under the lock, as prepareURL ran without it,
+// the same way the unique indexes of the other backends do.
+func (repo *MemoryRepo) insertLocked(urlDoc *URL) (*URL, error) {
+	if urlDoc.Alias != "" && repo.findLocked(func(u *URL) bool { return u.Alias == urlDoc.Alias }) != nil {
+		return nil, ErrAliasTaken
+	}
+	if urlDoc.CanonicalKey != "" {
+		existing := repo.findLocked(func(u *URL) bool {
+			return u.CanonicalKey == urlDoc.CanonicalKey && u.OwnerID == urlDoc.OwnerID
+		})
+		if existing != nil {
+			return existing, nil
+		}
+	}
+	stored := *urlDoc
+	repo.urls[urlDoc.ID] = &stored
+	return urlDoc, nil
+}
+
+// FindURLByID returns a copy of the link with the given ID
+func (repo *MemoryRepo) FindURLByID(ctx context.Context, id int64) (*URL, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	urlDoc, ok := repo.urls[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := *urlDoc
+	return &found, nil
+}
+
+// FindURLByCanonicalKey returns the owner's plain link for a canonical URL, or nil if there is none
+func (repo *MemoryRepo) FindURLByCanonicalKey(ctx context.Context, canonicalKey string, ownerID string) (*URL, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return repo.findLocked(func(u *URL) bool {
+		return u.CanonicalKey == canonicalKey && u.OwnerID == ownerID
+	}), nil
+}
+
+// ListURLsByOwner returns up to limit of the owner's links, newest first, with IDs below beforeID (0 for the first page)
+func (repo *MemoryRepo) ListURLsByOwner(ctx context.Context, ownerID string, beforeID int64, limit int) ([]*URL, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	urls := []*URL{}
+	for _, urlDoc := range repo.urls {
+		if urlDoc.OwnerID == ownerID && !urlDoc.Deleted() && (beforeID <= 0 || urlDoc.ID < beforeID) {
+			found := *urlDoc
+			urls = append(urls, &found)
+		}
+	}
+	sort.Slice(urls, func(i, j int) bool { return urls[i].ID > urls[j].ID })
+	if len(urls) > limit {
+		urls = urls[:limit]
+	}
+	return urls, nil
+}
+
+// CreateAPIKey stores a hashed API key
+func (repo *MemoryRepo) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	stored := *key
+	repo.apiKeys[key.Hash] = &stored
+	return nil
+}
+
+// FindAPIKey looks up an API key by its hash
+func (repo *MemoryRepo) FindAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	key, ok := repo.apiKeys[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := *key
+	return &found, nil
+}
+
+// FindURLByAlias returns the link for a custom alias, or nil if the alias is unused
+func (repo *MemoryRepo) FindURLByAlias(ctx context.Context, alias string) (*URL, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return repo.findLocked(func(u *URL) bool { return u.Alias == alias }), nil
+}
+
+// findLocked returns a copy of the first link matching match. The caller must hold mu.
+func (repo *MemoryRepo) findLocked(match func(u *URL) bool) *URL {
+	for _, urlDoc := range repo.urls {
+		if match(urlDoc) {
+			found := *urlDoc
+			return &found
+		}
+	}
+	return nil
+}
+
+// IncrementAccessCount adds one to the link's access count
+func (repo *MemoryRepo) IncrementAccessCount(ctx context.Context, id int64) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	if urlDoc, ok := repo.urls[id]; ok {
+		urlDoc.AccessCount++
+	}
+	return nil
+}
+
+// IncrementAccessCounts applies a batch of buffered clicks
+func (repo *MemoryRepo) IncrementAccessCounts(ctx context.Context, counts map[int64]int) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	for id, n := range counts {
+		if urlDoc, ok := repo.urls[id]; ok {
+			urlDoc.AccessCount += n
+		}
+	}
+	return nil
+}
+
+// ConsumeClick counts a click on a click limited link, returning ErrLinkExpired once the limit is reached
+func (repo *MemoryRepo) ConsumeClick(ctx context.Context, id int64) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	urlDoc, ok := repo.urls[id]
+	if !ok || urlDoc.AccessCount >= urlDoc.MaxClicks {
+		return ErrLinkExpired
+	}
+	urlDoc.AccessCount++
+	return nil
+}
+
+// UpdateURL changes a link's destination or expiry and returns the updated document
+func (repo *MemoryRepo) UpdateURL(ctx context.Context, id int64, update LinkUpdate) (*URL, error) {
+	update, err := update.prepare()
+	if err != nil {
+		return nil, err
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	urlDoc, ok := repo.urls[id]
+	if !ok || urlDoc.Deleted() {
+		return nil, ErrNotFound
+	}
+	if update.LongURL != "" {
+		urlDoc.LongURL = update.LongURL
+	}
+	if update.SetExpiry {
+		urlDoc.ExpiresAt = update.ExpiresAt
+	}
+	urlDoc.CanonicalKey = ""
+	found := *urlDoc
+	return &found, nil
+}
+
+// DeleteURL soft deletes a link, it keeps its ID and alias but redirects answer 410 Gone
+func (repo *MemoryRepo) DeleteURL(ctx context.Context, id int64) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	urlDoc, ok := repo.urls[id]
+	if !ok || urlDoc.Deleted() {
+		return ErrNotFound
+	}
+	now := time.Now()
+	urlDoc.DeletedAt = &now
+	urlDoc.CanonicalKey = ""
+	return nil
+}
+
+// SetDisabled disables or re-enables a link and returns a copy of it
+func (repo *MemoryRepo) SetDisabled(ctx context.Context, id int64, disabled bool) (*URL, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	urlDoc, ok := repo.urls[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	urlDoc.DisabledAt = nil
+	if disabled {
+		now := time.Now()
+		urlDoc.DisabledAt = &now
+	}
+	updated := *urlDoc
+	return &updated, nil
+}
+
+// TopURLs returns up to limit links with the most clicks, deleted links excluded
+func (repo *MemoryRepo) TopURLs(ctx context.Context, limit int) ([]*URL, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	urls := []*URL{}
+	for _, urlDoc := range repo.urls {
+		if !urlDoc.Deleted() {
+			found := *urlDoc
+			urls = append(urls, &found)
+		}
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if urls[i].AccessCount != urls[j].AccessCount {
+			return urls[i].AccessCount > urls[j].AccessCount
+		}
+		return urls[i].ID < urls[j].ID
+	})
+	if len(urls) > limit {
+		urls = urls[:limit]
+	}
+	return urls, nil
+}
+
+// EachURL calls fn with a copy of every link in ID order, stopping at the first error
+func (repo *MemoryRepo) EachURL(ctx context.Context, fn func(urlDoc *URL) error) error {
+	repo.mu.Lock()
+	urls := make([]*URL, 0, len(repo.urls))
+	for _, urlDoc := range repo.urls {
+		found := *urlDoc
+		urls = append(urls, &found)
+	}
+	repo.mu.Unlock()
+
+	sort.Slice(urls, func(i, j int) bool { return urls[i].ID < urls[j].ID })
+	for _, urlDoc := range urls {
+		if err := fn(urlDoc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportURLs stores the links as given, replacing any link with the same ID.
+// Like the unique indexes of the other backends, an alias or an owner's canonical key held by
+// another link fails the whole batch with ErrAliasTaken or ErrCanonicalKeyTaken.
+func (repo *MemoryRepo) ImportURLs(ctx context.Context, urls []*URL) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	aliases := make(map[string]int64)
+	canonicalKeys := make(map[[2]string]int64)
+	for id, urlDoc := range repo.urls {
+		if urlDoc.Alias != "" {
+			aliases[urlDoc.Alias] = id
+		}
+		if urlDoc.CanonicalKey != "" {
+			canonicalKeys[[2]string{urlDoc.CanonicalKey, urlDoc.OwnerID}] = id
+		}
+	}
+	for _, urlDoc := range urls {
+		if old, ok := repo.urls[urlDoc.ID]; ok {
+			if old.Alias != "" && aliases[old.Alias] == urlDoc.ID {
+				delete(aliases, old.Alias)
+			}
+			oldKey := [2]string{old.CanonicalKey, old.OwnerID}
+			if old.CanonicalKey != "" && canonicalKeys[oldKey] == urlDoc.ID {
+				delete(canonicalKeys, oldKey)
+			}
+		}
+		if urlDoc.Alias != "" {
+			if id, ok := aliases[urlDoc.Alias]; ok && id != urlDoc.ID {
+				return fmt.Errorf("link %d: %w", urlDoc.ID, ErrAliasTaken)
+			}
+			aliases[urlDoc.Alias] = urlDoc.ID
+		}
+		if urlDoc.CanonicalKey != "" {
+			key := [2]string{urlDoc.CanonicalKey, urlDoc.OwnerID}
+			if id, ok := canonicalKeys[key]; ok && id != urlDoc.ID {
+				return fmt.Errorf("link %d: %w", urlDoc.ID, ErrCanonicalKeyTaken)
+			}
+			canonicalKeys[key] = urlDoc.ID
+		}
+	}
+	for _, urlDoc := range urls {
+		stored := *urlDoc
+		repo.urls[urlDoc.ID] = &stored
+	}
+	return nil
+}
+
+// EnsureCounter raises the named counter to at least min
+func (repo *MemoryRepo) EnsureCounter(ctx context.Context, counterName string, min int64) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.counters[counterName] = max(repo.counters[counterName], min)
+	return nil
+}
+
+// GetNextID returns the next value of the named counter
+func (repo *MemoryRepo) GetNextID(ctx context.Context, counterName string) (int64, error) {
+	return repo.ReserveIDs(ctx, counterName, 1)
+}
+
+// ReserveIDs advances the named counter by n and returns the first ID of the reserved block
+func (repo *MemoryRepo) ReserveIDs(ctx context.Context, counterName string, n int64) (int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.counters[counterName] += n
+	return repo.counters[counterName] - n + 1, nil
+}
+
+// RecordClicks appends the click events
+func (repo *MemoryRepo) RecordClicks(ctx context.Context, events []ClickEvent) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.clicks = append(repo.clicks, events...)
+	return nil
+}
+
+// ClickStats aggregates the link's click events since the given time
+func (repo *MemoryRepo) ClickStats(ctx context.Context, linkID int64, since time.Time, bucket time.Duration) (*ClickStats, error) {
+	repo.mu.Lock()
+	var events []ClickEvent
+	for _, ev := range repo.clicks {
+		if ev.LinkID == linkID && !ev.Timestamp.Before(since) {
+			events = append(events, ev)
+		}
+	}
+	repo.mu.Unlock()
+	return aggregateClicks(events, bucket), nil
+}
+
+// EnsureIndexes is a no-op, the maps need no indexes
+func (repo *MemoryRepo) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+// Ping always succeeds for the in-memory store
+func (repo *MemoryRepo) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close is a no-op for the in-memory store
+func (repo *MemoryRepo) Close(ctx context.Context) error {
+	return nil
+}
@@ -2,14 +2,24 @@ package repository
 
 import (
 	"context"
-	"log"
-	"os"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 
+	"gochop-it/internal/config"
+	"gochop-it/internal/logging"
+	"gochop-it/internal/metrics"
+	"gochop-it/internal/tracing"
 	"gochop-it/internal/utils"
 )
 
@@ -17,48 +27,27 @@ import (
 type MongoRepo struct {
 	Client        *mongo.Client
 	Collection    *mongo.Collection
-	GetNextIDFunc func(counterName string) (int64, error)
-}
-
-// URL struct represents a URL document in MongoDB
-type URL struct {
-	ID          int64     `bson:"_id,omitempty"`
-	CreatedAt   time.Time `bson:"createdAt"`
-	LongURL     string    `bson:"longURL"`
-	AccessCount int       `bson:"accessCount"`
-}
-
-type URLRepository interface {
-	FindURLByID(ctx context.Context, id int64) (*URL, error)
-	IncrementAccessCount(ctx context.Context, id int64) error
+	GetNextIDFunc func(ctx context.Context, counterName string) (int64, error)
+	// IDs leases blocks of IDs for new links, when nil every ID is taken from the counter
+	IDs *IDAllocator
 }
 
 var _ URLRepository = (*MongoRepo)(nil)
 
-// NewMongoRepo creates a new instance of MongoRepo and establishes the connection
-func NewMongoRepo(ctx context.Context) (*MongoRepo, error) {
-	// Fetch MongoDB credentials and URI from environment variables
-	mongoURI := "mongodb://" + os.Getenv("MONGO_APP_USERNAME") + ":" +
-		os.Getenv("MONGO_APP_PASSWORD") + "@mongo:27017/" + os.Getenv("MONGO_DB_NAME")
-
+// NewMongoRepo creates a new instance of MongoRepo. The driver connects in the background and
+// reconnects on its own, so an unreachable server isn't an error here, Ping reports it.
+func NewMongoRepo(ctx context.Context, cfg config.MongoConfig) (*MongoRepo, error) {
 	// Set MongoDB connection options
-	clientOptions := options.Client().ApplyURI(mongoURI)
+	clientOptions := options.Client().ApplyURI(cfg.ConnectionURI()).SetMonitor(commandMonitor())
 
-	// Connect to MongoDB
+	// Connect to MongoDB, this only fails on invalid options
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	// Ping the MongoDB server to verify connection
-	if err := client.Ping(ctx, nil); err != nil {
-		return nil, err
-	}
-
-	log.Println("Connected to MongoDB with RBAC credentials!")
-
 	// Initialize the collection
-	collection := client.Database(os.Getenv("MONGO_DB_NAME")).Collection("urls")
+	collection := client.Database(cfg.Database).Collection("urls")
 
 	repo := &MongoRepo{
 		Client:        client,
@@ -73,50 +62,91 @@ func NewMongoRepo(ctx context.Context) (*MongoRepo, error) {
 	return repo, nil
 }
 
-// SaveURL saves a new URL document into the MongoDB collection or returns the existing short URL if the long URL already exists
-func (repo *MongoRepo) SaveURL(ctx context.Context, longURL string) (string, error) {
-	log.Println("Checking if URL exists in the database:", longURL)
-
-	// Sanitize the URL
-	sanitizedURL, err := utils.SanitizeURL(longURL)
-	if err != nil {
-		return "", err
+// commandMonitor times every command the driver sends to MongoDB and wraps it in a client span,
+// so find, update and findAndModify calls show up under the request that made them
+func commandMonitor() *event.CommandMonitor {
+	var spans sync.Map
+	finish := func(requestID int64, command, status string, duration time.Duration, err error) {
+		metrics.MongoDuration.WithLabelValues(command, status).Observe(duration.Seconds())
+		if span, ok := spans.LoadAndDelete(requestID); ok {
+			tracing.End(span.(trace.Span), err)
+		}
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			_, span := tracing.Start(ctx, "mongodb "+e.CommandName, trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					semconv.DBSystemMongoDB,
+					semconv.DBOperationName(e.CommandName),
+					semconv.DBNamespace(e.DatabaseName),
+				))
+			spans.Store(e.RequestID, span)
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			finish(e.RequestID, e.CommandName, "ok", e.Duration, nil)
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			finish(e.RequestID, e.CommandName, "error", e.Duration, errors.New(e.Failure))
+		},
 	}
+}
 
-	// Check if the long URL already exists
-	existingURL, err := repo.FindURLByLongURL(ctx, sanitizedURL)
-	if err != nil {
-		return "", err
+// SaveURL saves a new URL document into the MongoDB collection or returns the existing document if the long URL already exists.
+// Links with a custom alias or an expiry always get their own document.
+func (repo *MongoRepo) SaveURL(ctx context.Context, longURL string, opts LinkOptions) (*URL, error) {
+	nextID := repo.GetNextIDFunc
+	if nextID == nil {
+		nextID = repo.GetNextID
 	}
-	if existingURL != nil {
-		// Return existing short code
-		shortCode := utils.Encode(existingURL.ID)
-		return shortCode, nil
+	urlDoc, existing, err := prepareURL(ctx, repo, nextID, longURL, opts)
+	if err != nil || existing {
+		return urlDoc, err
 	}
 
-	// Generate a new ID and encode it
-	id, err := repo.GetNextIDFunc("url_counter")
+	// Insert the new URL document. The unique indexes catch a concurrent save of the same
+	// link or alias that happened after the lookups in prepareURL.
+	_, err = repo.Collection.InsertOne(ctx, urlDoc)
+	if mongo.IsDuplicateKeyError(err) {
+		return resolveDuplicate(ctx, repo, urlDoc, err)
+	}
 	if err != nil {
-		return "", err
+		slog.ErrorContext(ctx, "Failed to save link", "error", err)
+		return nil, err
 	}
-	shortCode := utils.Encode(id)
 
-	urlDoc := URL{
-		ID:          id,
-		CreatedAt:   time.Now(),
-		LongURL:     sanitizedURL,
-		AccessCount: 0,
-	}
+	metrics.LinksCreated.WithLabelValues("single").Inc()
+	slog.DebugContext(ctx, "Saved new link", "code", urlDoc.ShortCode(), "url", logging.RedactURL(urlDoc.LongURL))
+	return urlDoc, nil
+}
 
-	// Insert the new URL document
-	_, err = repo.Collection.InsertOne(ctx, urlDoc)
+// SaveURLs saves a batch of links with a single InsertMany. The insert is unordered, so a row
+// that fails, such as one losing a race on a unique index, doesn't stop the rows after it.
+func (repo *MongoRepo) SaveURLs(ctx context.Context, links []BulkLink) ([]BulkResult, error) {
+	batch, err := prepareURLs(ctx, repo, repo.ReserveIDs, links)
 	if err != nil {
-		log.Printf("Error while saving URL: %v\n", err)
-		return "", err
+		return nil, err
+	}
+	if len(batch.pending) == 0 {
+		return batch.finish(), nil
 	}
 
-	log.Printf("Saved new URL with short URL: %s, long URL: %s\n", shortCode, sanitizedURL)
-	return shortCode, nil
+	docs := make([]interface{}, len(batch.pending))
+	for n, urlDoc := range batch.docs() {
+		docs[n] = urlDoc
+	}
+	_, err = repo.Collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		for _, writeErr := range bulkErr.WriteErrors {
+			batch.fail(ctx, repo, batch.pending[writeErr.Index], writeErr, writeErr.Code == 11000)
+		}
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to save links in bulk", "error", err)
+		return nil, err
+	}
+
+	slog.DebugContext(ctx, "Saved new links in bulk", "count", len(batch.pending)-len(bulkErr.WriteErrors))
+	return batch.finish(), nil
 }
 
 // FindURL retrieves a URL document based on the short URL
@@ -130,10 +160,16 @@ func (repo *MongoRepo) FindURL(ctx context.Context, shortURL string) (URL, error
 	return urlDoc, nil
 }
 
-// FindURLByLongURL checks if the long URL already exists in the database and returns the corresponding short URL if found
-func (repo *MongoRepo) FindURLByLongURL(ctx context.Context, longURL string) (*URL, error) {
+// FindURLByCanonicalKey returns the owner's plain link for a canonical URL, or nil if there is none.
+// Only plain links carry a canonical key, so plain shortens never hand out someone's vanity alias or a link
+// that will die, and each owner gets their own link so stats are never shared. An empty ownerID matches anonymous links.
+func (repo *MongoRepo) FindURLByCanonicalKey(ctx context.Context, canonicalKey string, ownerID string) (*URL, error) {
 	var existingURL URL
-	err := repo.Collection.FindOne(ctx, bson.M{"longURL": longURL}).Decode(&existingURL)
+	filter := bson.M{
+		"canonicalKey": canonicalKey,
+		"ownerID":      ownerFilter(ownerID),
+	}
+	err := repo.Collection.FindOne(ctx, filter).Decode(&existingURL)
 	if err == mongo.ErrNoDocuments {
 		return nil, nil // URL does not exist
 	} else if err != nil {
@@ -142,11 +178,74 @@ func (repo *MongoRepo) FindURLByLongURL(ctx context.Context, longURL string) (*U
 	return &existingURL, nil
 }
 
+// ownerFilter matches documents of the owner, or anonymous documents for an empty ownerID
+func ownerFilter(ownerID string) interface{} {
+	if ownerID == "" {
+		return bson.M{"$exists": false}
+	}
+	return ownerID
+}
+
+// ListURLsByOwner returns up to limit of the owner's links, newest first, with IDs below beforeID (0 for the first page)
+func (repo *MongoRepo) ListURLsByOwner(ctx context.Context, ownerID string, beforeID int64, limit int) ([]*URL, error) {
+	filter := bson.M{"ownerID": ownerID, "deletedAt": bson.M{"$exists": false}}
+	if beforeID > 0 {
+		filter["_id"] = bson.M{"$lt": beforeID}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := repo.Collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	urls := []*URL{}
+	if err := cursor.All(ctx, &urls); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// apiKeys returns the collection holding hashed API keys
+func (repo *MongoRepo) apiKeys() *mongo.Collection {
+	return repo.Collection.Database().Collection("api_keys")
+}
+
+// CreateAPIKey stores a hashed API key
+func (repo *MongoRepo) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	_, err := repo.apiKeys().InsertOne(ctx, key)
+	return err
+}
+
+// FindAPIKey looks up an API key by its hash
+func (repo *MongoRepo) FindAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	var key APIKey
+	err := repo.apiKeys().FindOne(ctx, bson.M{"_id": hash}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// FindURLByAlias returns the URL document for a custom alias, or nil if the alias is unused
+func (repo *MongoRepo) FindURLByAlias(ctx context.Context, alias string) (*URL, error) {
+	var urlDoc URL
+	err := repo.Collection.FindOne(ctx, bson.M{"alias": alias}).Decode(&urlDoc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &urlDoc, nil
+}
+
 // FindURLByID searches by id field
 func (repo *MongoRepo) FindURLByID(ctx context.Context, id int64) (*URL, error) {
 	var urlDoc URL
 	err := repo.Collection.FindOne(ctx, bson.M{"_id": id}).Decode(&urlDoc)
-	if err != nil {
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	} else if err != nil {
 		return nil, err
 	}
 	return &urlDoc, nil
@@ -160,18 +259,404 @@ func (repo *MongoRepo) IncrementAccessCount(ctx context.Context, id int64) error
 	return err
 }
 
-// GetNextID is used for encoding based on ID, returns ID
-func (repo *MongoRepo) GetNextID(counterName string) (int64, error) {
-	counters := repo.Client.Database(os.Getenv("MONGO_DB_NAME")).Collection("counters")
+// IncrementAccessCounts applies a batch of buffered clicks in a single unordered bulk write.
+// The other updates of the batch still apply when some fail, so a bulk write error reports only
+// the failed ones in an IncrementError. A write concern error alone means every update was applied.
+func (repo *MongoRepo) IncrementAccessCounts(ctx context.Context, counts map[int64]int) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(counts))
+	models := make([]mongo.WriteModel, 0, len(counts))
+	for id, n := range counts {
+		ids = append(ids, id)
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(bson.M{"$inc": bson.M{"accessCount": n}}))
+	}
+	_, err := repo.Collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		failed := make(map[int64]int, len(bulkErr.WriteErrors))
+		for _, writeErr := range bulkErr.WriteErrors {
+			if writeErr.Index >= 0 && writeErr.Index < len(ids) {
+				id := ids[writeErr.Index]
+				failed[id] = counts[id]
+			}
+		}
+		return &IncrementError{Failed: failed, Err: err}
+	}
+	return err
+}
+
+// ConsumeClick atomically counts a click on a link with a click limit.
+// It returns ErrLinkExpired once the limit has been reached, so concurrent redirects can't overshoot it.
+// Used up links are kept rather than given an expiry for the TTL index, so they keep answering 410 Gone.
+func (repo *MongoRepo) ConsumeClick(ctx context.Context, id int64) error {
+	filter := bson.M{
+		"_id":   id,
+		"$expr": bson.M{"$lt": bson.A{"$accessCount", "$maxClicks"}},
+	}
+	update := bson.M{"$inc": bson.M{"accessCount": 1}}
+	err := repo.Collection.FindOneAndUpdate(ctx, filter, update).Err()
+	if err == mongo.ErrNoDocuments {
+		return ErrLinkExpired
+	}
+	return err
+}
+
+// UpdateURL changes a link's destination or expiry and returns the updated document
+func (repo *MongoRepo) UpdateURL(ctx context.Context, id int64, update LinkUpdate) (*URL, error) {
+	update, err := update.prepare()
+	if err != nil {
+		return nil, err
+	}
+
+	// Edited links drop their canonical key, see LinkUpdate
+	set, unset := bson.M{}, bson.M{"canonicalKey": ""}
+	if update.LongURL != "" {
+		set["longURL"] = update.LongURL
+	}
+	if update.SetExpiry && update.ExpiresAt != nil {
+		set["expiresAt"] = update.ExpiresAt
+	} else if update.SetExpiry {
+		unset["expiresAt"] = ""
+	}
+	change := bson.M{"$unset": unset}
+	if len(set) > 0 {
+		change["$set"] = set
+	}
+
+	var urlDoc URL
+	filter := bson.M{"_id": id, "deletedAt": bson.M{"$exists": false}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = repo.Collection.FindOneAndUpdate(ctx, filter, change, opts).Decode(&urlDoc)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &urlDoc, nil
+}
+
+// DeleteURL soft deletes a link, it keeps its ID and alias but redirects answer 410 Gone
+func (repo *MongoRepo) DeleteURL(ctx context.Context, id int64) error {
+	filter := bson.M{"_id": id, "deletedAt": bson.M{"$exists": false}}
+	// Dropping the canonical key lets the owner shorten the URL again
+	res, err := repo.Collection.UpdateOne(ctx, filter, bson.M{
+		"$set":   bson.M{"deletedAt": time.Now()},
+		"$unset": bson.M{"canonicalKey": ""},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetDisabled disables or re-enables a link and returns the updated document
+func (repo *MongoRepo) SetDisabled(ctx context.Context, id int64, disabled bool) (*URL, error) {
+	update := bson.M{"$unset": bson.M{"disabledAt": ""}}
+	if disabled {
+		update = bson.M{"$set": bson.M{"disabledAt": time.Now()}}
+	}
+	var urlDoc URL
+	err := repo.Collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&urlDoc)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &urlDoc, nil
+}
+
+// TopURLs returns up to limit links with the most clicks, deleted links excluded
+func (repo *MongoRepo) TopURLs(ctx context.Context, limit int) ([]*URL, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "accessCount", Value: -1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(limit))
+	cursor, err := repo.Collection.Find(ctx, bson.M{"deletedAt": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	urls := []*URL{}
+	if err := cursor.All(ctx, &urls); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// clicks returns the collection holding click events
+func (repo *MongoRepo) clicks() *mongo.Collection {
+	return repo.Collection.Database().Collection("clicks")
+}
+
+// RecordClicks inserts the click events into the clicks collection
+func (repo *MongoRepo) RecordClicks(ctx context.Context, events []ClickEvent) error {
+	docs := make([]interface{}, len(events))
+	for i, ev := range events {
+		docs[i] = ev
+	}
+	_, err := repo.clicks().InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	return err
+}
+
+// ClickStats aggregates the link's click events since the given time in a single pipeline
+func (repo *MongoRepo) ClickStats(ctx context.Context, linkID int64, since time.Time, bucket time.Duration) (*ClickStats, error) {
+	bucketMillis := bucket.Milliseconds()
+	millis := bson.M{"$toLong": "$timestamp"}
+	topBy := func(field string) bson.A {
+		return bson.A{
+			bson.M{"$match": bson.M{field: bson.M{"$nin": bson.A{"", nil}}}},
+			bson.M{"$group": bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}},
+			bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+			bson.M{"$limit": topClickCountLimit},
+			bson.M{"$project": bson.M{"_id": 0, "value": "$_id", "count": 1}},
+		}
+	}
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"linkID": linkID, "timestamp": bson.M{"$gte": since}}},
+		bson.M{"$facet": bson.M{
+			"buckets": bson.A{
+				bson.M{"$group": bson.M{
+					"_id":   bson.M{"$subtract": bson.A{millis, bson.M{"$mod": bson.A{millis, bucketMillis}}}},
+					"count": bson.M{"$sum": 1},
+				}},
+				bson.M{"$sort": bson.M{"_id": 1}},
+			},
+			"referrers":  topBy("referrer"),
+			"countries":  topBy("country"),
+			"userAgents": topBy("userAgent"),
+		}},
+	}
+
+	cursor, err := repo.clicks().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		Buckets []struct {
+			Start int64 `bson:"_id"`
+			Count int   `bson:"count"`
+		} `bson:"buckets"`
+		Referrers  []ClickCount `bson:"referrers"`
+		Countries  []ClickCount `bson:"countries"`
+		UserAgents []ClickCount `bson:"userAgents"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	stats := &ClickStats{Buckets: []ClickBucket{}, TopReferrers: []ClickCount{}, Countries: []ClickCount{}, UserAgents: []ClickCount{}}
+	if len(results) == 0 {
+		return stats, nil
+	}
+	for _, b := range results[0].Buckets {
+		stats.Buckets = append(stats.Buckets, ClickBucket{Start: time.UnixMilli(b.Start).UTC(), Count: b.Count})
+	}
+	stats.TopReferrers = append(stats.TopReferrers, results[0].Referrers...)
+	stats.Countries = append(stats.Countries, results[0].Countries...)
+	stats.UserAgents = append(stats.UserAgents, results[0].UserAgents...)
+	return stats, nil
+}
+
+// EnsureIndexes creates the indexes the collections rely on.
+// The TTL index on expiresAt lets MongoDB purge time expired links by itself, and the unique
+// alias and canonical key indexes keep concurrent saves from creating duplicate links.
+func (repo *MongoRepo) EnsureIndexes(ctx context.Context) error {
+	_, err := repo.Collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = repo.Collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "ownerID", Value: 1}, {Key: "_id", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = repo.Collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "alias", Value: 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"alias": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return err
+	}
+	if err := repo.ensureCanonicalKeyIndex(ctx); err != nil {
+		return err
+	}
+	_, err = repo.clicks().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "linkID", Value: 1}, {Key: "timestamp", Value: 1}},
+	})
+	return err
+}
+
+// canonicalKeyIndex is the unique index plain links are deduped on
+const canonicalKeyIndex = "canonicalKey_1_ownerID_1"
+
+// ensureCanonicalKeyIndex creates the unique canonical key index. The first time, links created
+// before canonical keys are given theirs, so existing links keep being deduped.
+func (repo *MongoRepo) ensureCanonicalKeyIndex(ctx context.Context) error {
+	specs, err := repo.Collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if spec.Name == canonicalKeyIndex {
+			return nil
+		}
+	}
+	if err := repo.backfillCanonicalKeys(ctx); err != nil {
+		return fmt.Errorf("failed to backfill canonical keys: %w", err)
+	}
+	_, err = repo.Collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "canonicalKey", Value: 1}, {Key: "ownerID", Value: 1}},
+		Options: options.Index().
+			SetName(canonicalKeyIndex).
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"canonicalKey": bson.M{"$exists": true}}),
+	})
+	return err
+}
+
+// backfillCanonicalKeys sets the canonical key of plain links that lack one, oldest first.
+// Links equivalent to an older one are left without a key, they still redirect but aren't deduped onto.
+func (repo *MongoRepo) backfillCanonicalKeys(ctx context.Context) error {
+	filter := bson.M{
+		"canonicalKey": bson.M{"$exists": false},
+		"alias":        bson.M{"$exists": false},
+		"expiresAt":    bson.M{"$exists": false},
+		"maxClicks":    bson.M{"$exists": false},
+		"deletedAt":    bson.M{"$exists": false},
+	}
+	cursor, err := repo.Collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	seen := make(map[[2]string]bool)
+	for cursor.Next(ctx) {
+		var urlDoc URL
+		if err := cursor.Decode(&urlDoc); err != nil {
+			return err
+		}
+		canonicalKey, err := utils.CanonicalURL(urlDoc.LongURL)
+		if err != nil || seen[[2]string{canonicalKey, urlDoc.OwnerID}] {
+			continue
+		}
+		seen[[2]string{canonicalKey, urlDoc.OwnerID}] = true
+		_, err = repo.Collection.UpdateOne(ctx, bson.M{"_id": urlDoc.ID}, bson.M{"$set": bson.M{"canonicalKey": canonicalKey}})
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// Ping tests the MongoDB connection
+func (repo *MongoRepo) Ping(ctx context.Context) error {
+	return repo.Client.Ping(ctx, nil)
+}
+
+// Close disconnects the MongoDB client
+func (repo *MongoRepo) Close(ctx context.Context) error {
+	return repo.Client.Disconnect(ctx)
+}
+
+// EachURL calls fn with every link in ID order, stopping at the first error
+func (repo *MongoRepo) EachURL(ctx context.Context, fn func(urlDoc *URL) error) error {
+	cursor, err := repo.Collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var urlDoc URL
+		if err := cursor.Decode(&urlDoc); err != nil {
+			return err
+		}
+		if err := fn(&urlDoc); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// ImportURLs stores the links as given, replacing any link with the same ID.
+// An alias or an owner's canonical key held by another link stops the import at that link
+// with ErrAliasTaken or ErrCanonicalKeyTaken.
+func (repo *MongoRepo) ImportURLs(ctx context.Context, urls []*URL) error {
+	if len(urls) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, len(urls))
+	for i, urlDoc := range urls {
+		models[i] = mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": urlDoc.ID}).
+			SetReplacement(urlDoc).
+			SetUpsert(true)
+	}
+	_, err := repo.Collection.BulkWrite(ctx, models)
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+		// The write is ordered, so it stops at the first error
+		for _, writeErr := range bulkErr.WriteErrors {
+			if writeErr.Code != 11000 || writeErr.Index < 0 || writeErr.Index >= len(urls) {
+				continue
+			}
+			switch {
+			case strings.Contains(writeErr.Message, "alias_1"):
+				return fmt.Errorf("link %d: %w", urls[writeErr.Index].ID, ErrAliasTaken)
+			case strings.Contains(writeErr.Message, canonicalKeyIndex):
+				return fmt.Errorf("link %d: %w", urls[writeErr.Index].ID, ErrCanonicalKeyTaken)
+			}
+		}
+	}
+	return err
+}
+
+// EnsureCounter raises the named counter to at least min, so new IDs never reuse an imported one
+func (repo *MongoRepo) EnsureCounter(ctx context.Context, counterName string, min int64) error {
+	counters := repo.Collection.Database().Collection("counters")
+	_, err := counters.UpdateOne(ctx,
+		bson.M{"_id": counterName},
+		bson.M{"$max": bson.M{"seq": min}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// GetNextID is used for encoding based on ID, returns ID.
+// With IDs set it comes from the leased block, so the counter document isn't written on every shorten.
+func (repo *MongoRepo) GetNextID(ctx context.Context, counterName string) (int64, error) {
+	if repo.IDs != nil {
+		return repo.IDs.Next(ctx, counterName)
+	}
+	return repo.ReserveIDs(ctx, counterName, 1)
+}
+
+// ReserveIDs advances the named counter by n with a single $inc and returns the first ID of the reserved block
+func (repo *MongoRepo) ReserveIDs(ctx context.Context, counterName string, n int64) (int64, error) {
+	counters := repo.Collection.Database().Collection("counters")
 	filter := bson.M{"_id": counterName}
-	update := bson.M{"$inc": bson.M{"seq": 1}}
+	update := bson.M{"$inc": bson.M{"seq": n}}
 	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
 	var result struct {
 		Seq int64 `bson:"seq"`
 	}
-	err := counters.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&result)
+	err := counters.FindOneAndUpdate(ctx, filter, update, opts).Decode(&result)
 	if err != nil {
 		return 0, err
 	}
-	return result.Seq, nil
+	return result.Seq - n + 1, nil
 }
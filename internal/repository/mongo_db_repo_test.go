@@ -2,12 +2,19 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/codes"
 
+	"gochop-it/internal/tracing"
+	"gochop-it/internal/tracing/tracingtest"
 	"gochop-it/internal/utils"
 )
 
@@ -39,26 +46,193 @@ func TestSaveURL(t *testing.T) {
 		repo := &MongoRepo{
 			Client:     mt.Client,
 			Collection: mt.Coll,
-			GetNextIDFunc: func(counterName string) (int64, error) {
+			GetNextIDFunc: func(ctx context.Context, counterName string) (int64, error) {
 				return 12345, nil // Return fixed ID for testing
 			},
 		}
 
 		// Call SaveURL
 		longURL := "https://example.com"
-		shortCode, err := repo.SaveURL(context.TODO(), longURL)
+		urlDoc, err := repo.SaveURL(context.TODO(), longURL, LinkOptions{})
 		if err != nil {
 			t.Fatalf("Failed to save URL: %v", err)
 		}
 
 		// Assert the returned short code is correct
 		expectedShortCode := utils.Encode(12345)
-		if shortCode != expectedShortCode {
+		if shortCode := urlDoc.ShortCode(); shortCode != expectedShortCode {
 			t.Errorf("Expected short code %s, got %s", expectedShortCode, shortCode)
 		}
 	})
 }
 
+// TestSaveURLDuplicateKey tests a save that loses a race on the unique indexes
+func TestSaveURLDuplicateKey(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	duplicate := mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "E11000 duplicate key error"})
+
+	mt.Run("test concurrent save of the same URL", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			// Mock response for the canonical key lookup (not saved yet)
+			mtest.CreateCursorResponse(0, "url_shortener.urls", mtest.FirstBatch),
+			// Mock response for InsertOne (another request saved it first)
+			duplicate,
+			// Mock response for the canonical key lookup after the conflict
+			mtest.CreateCursorResponse(1, "url_shortener.urls", mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: int64(777)},
+				{Key: "longURL", Value: "https://example.com/"},
+				{Key: "canonicalKey", Value: "https://example.com/"},
+			}),
+		)
+
+		repo := &MongoRepo{
+			Client:     mt.Client,
+			Collection: mt.Coll,
+			GetNextIDFunc: func(ctx context.Context, counterName string) (int64, error) {
+				return 12345, nil
+			},
+		}
+
+		urlDoc, err := repo.SaveURL(context.TODO(), "https://example.com", LinkOptions{})
+		if err != nil {
+			t.Fatalf("Failed to save URL: %v", err)
+		}
+		if urlDoc.ID != 777 {
+			t.Errorf("Expected the existing link 777, got %d", urlDoc.ID)
+		}
+	})
+
+	mt.Run("test concurrent save of the same alias", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			// Mock response for the alias lookup (not taken yet)
+			mtest.CreateCursorResponse(0, "url_shortener.urls", mtest.FirstBatch),
+			// Mock response for InsertOne (another request claimed it first)
+			duplicate,
+		)
+
+		repo := &MongoRepo{
+			Client:     mt.Client,
+			Collection: mt.Coll,
+			GetNextIDFunc: func(ctx context.Context, counterName string) (int64, error) {
+				return 12345, nil
+			},
+		}
+
+		_, err := repo.SaveURL(context.TODO(), "https://example.com", LinkOptions{Alias: "launch2026"})
+		if !errors.Is(err, ErrAliasTaken) {
+			t.Errorf("Expected ErrAliasTaken, got %v", err)
+		}
+	})
+}
+
+// TestSaveURLs tests a bulk save reserving one block of IDs and inserting with InsertMany
+func TestSaveURLs(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("test save URLs", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			// Mock responses for the canonical key lookups (not saved yet)
+			mtest.CreateCursorResponse(0, "url_shortener.urls", mtest.FirstBatch),
+			mtest.CreateCursorResponse(0, "url_shortener.urls", mtest.FirstBatch),
+			// Mock response for the $inc reserving both IDs
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{
+				{Key: "_id", Value: "url_counter"},
+				{Key: "seq", Value: int64(101)},
+			}}),
+			// Mock response for InsertMany, the second row lost a race on the canonical key index
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 1, Code: 11000, Message: "E11000 duplicate key error"}),
+			// Mock response for the canonical key lookup after the conflict
+			mtest.CreateCursorResponse(1, "url_shortener.urls", mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: int64(7)},
+				{Key: "longURL", Value: "https://example.com/b"},
+				{Key: "canonicalKey", Value: "https://example.com/b"},
+			}),
+		)
+
+		repo := &MongoRepo{
+			Client:     mt.Client,
+			Collection: mt.Coll,
+		}
+
+		results, err := repo.SaveURLs(context.TODO(), []BulkLink{
+			{LongURL: "https://example.com/a"},
+			{LongURL: "https://example.com/b"},
+			{LongURL: "ftp://example.com/c"},
+		})
+		if err != nil {
+			t.Fatalf("Failed to save URLs: %v", err)
+		}
+		if results[0].Err != nil || results[0].URL.ID != 100 {
+			t.Errorf("Expected the first row to get ID 100, got %+v", results[0])
+		}
+		if results[1].Err != nil || results[1].URL.ID != 7 {
+			t.Errorf("Expected the second row to get the existing link 7, got %+v", results[1])
+		}
+		if results[2].Err == nil {
+			t.Errorf("Expected the third row to fail")
+		}
+	})
+}
+
+// TestSaveURLAlias tests saving links with a custom alias
+func TestSaveURLAlias(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("test save URL with alias", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			// Mock response for the alias lookup (not taken)
+			mtest.CreateCursorResponse(0, "url_shortener.urls", mtest.FirstBatch),
+			// Mock response for InsertOne (success)
+			mtest.CreateSuccessResponse(),
+		)
+
+		repo := &MongoRepo{
+			Client:     mt.Client,
+			Collection: mt.Coll,
+			GetNextIDFunc: func(ctx context.Context, counterName string) (int64, error) {
+				return 12345, nil
+			},
+		}
+
+		urlDoc, err := repo.SaveURL(context.TODO(), "https://example.com", LinkOptions{Alias: "launch2026"})
+		if err != nil {
+			t.Fatalf("Failed to save URL: %v", err)
+		}
+		if urlDoc.ShortCode() != "launch2026" {
+			t.Errorf("Expected short code launch2026, got %s", urlDoc.ShortCode())
+		}
+		if urlDoc.ID != 12345 {
+			t.Errorf("Expected ID 12345, got %d", urlDoc.ID)
+		}
+	})
+
+	mt.Run("test alias already taken", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(1, "url_shortener.urls", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: int64(1)},
+			{Key: "longURL", Value: "https://other.example.com"},
+			{Key: "alias", Value: "launch2026"},
+		}))
+
+		repo := &MongoRepo{Client: mt.Client, Collection: mt.Coll}
+
+		_, err := repo.SaveURL(context.TODO(), "https://example.com", LinkOptions{Alias: "launch2026"})
+		if !errors.Is(err, ErrAliasTaken) {
+			t.Errorf("Expected ErrAliasTaken, got %v", err)
+		}
+	})
+
+	mt.Run("test alias in generated code space", func(mt *mtest.T) {
+		repo := &MongoRepo{Client: mt.Client, Collection: mt.Coll}
+
+		_, err := repo.SaveURL(context.TODO(), "https://example.com", LinkOptions{Alias: utils.Encode(123456789)})
+		var urlErr *utils.URLError
+		if !errors.As(err, &urlErr) {
+			t.Errorf("Expected URLError, got %v", err)
+		}
+	})
+}
+
 // TestFindURLByID tests the FindURLByID function for retrieving a URL by its ID.
 func TestFindURLByID(t *testing.T) {
 	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
@@ -98,17 +272,18 @@ func TestFindURLByID(t *testing.T) {
 	})
 }
 
-// TestFindURLByLongURL tests the FindURLByLongURL function for retrieving a URL by its long URL.
-func TestFindURLByLongURL(t *testing.T) {
+// TestFindURLByCanonicalKey tests the FindURLByCanonicalKey function for retrieving a plain link by its canonical URL.
+func TestFindURLByCanonicalKey(t *testing.T) {
 	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
 
-	mt.Run("test find URL by long URL", func(mt *mtest.T) {
+	mt.Run("test find URL by canonical key", func(mt *mtest.T) {
 		// Prepare the expected URL document
 		expectedURL := URL{
-			ID:          12345,
-			CreatedAt:   (time.Now()),
-			LongURL:     "https://example.com",
-			AccessCount: 0,
+			ID:           12345,
+			CreatedAt:    (time.Now()),
+			LongURL:      "https://Example.com",
+			AccessCount:  0,
+			CanonicalKey: "https://example.com/",
 		}
 
 		// Set up mock MongoDB responses
@@ -117,6 +292,7 @@ func TestFindURLByLongURL(t *testing.T) {
 			{Key: "createdAt", Value: expectedURL.CreatedAt},
 			{Key: "longURL", Value: expectedURL.LongURL},
 			{Key: "accessCount", Value: expectedURL.AccessCount},
+			{Key: "canonicalKey", Value: expectedURL.CanonicalKey},
 		}))
 
 		repo := &MongoRepo{
@@ -124,10 +300,10 @@ func TestFindURLByLongURL(t *testing.T) {
 			Collection: mt.Coll,
 		}
 
-		// Call FindURLByLongURL
-		urlDoc, err := repo.FindURLByLongURL(context.TODO(), expectedURL.LongURL)
+		// Call FindURLByCanonicalKey
+		urlDoc, err := repo.FindURLByCanonicalKey(context.TODO(), expectedURL.CanonicalKey, "")
 		if err != nil {
-			t.Fatalf("Failed to find URL by long URL: %v", err)
+			t.Fatalf("Failed to find URL by canonical key: %v", err)
 		}
 
 		// Assert the ID is correct
@@ -157,3 +333,297 @@ func TestIncrementAccessCount(t *testing.T) {
 		}
 	})
 }
+
+// TestConsumeClick tests the atomic click counting for click limited links
+func TestConsumeClick(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("test click within limit", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{
+			{Key: "_id", Value: int64(12345)},
+			{Key: "accessCount", Value: 0},
+			{Key: "maxClicks", Value: 1},
+		}}))
+
+		repo := &MongoRepo{Client: mt.Client, Collection: mt.Coll}
+		if err := repo.ConsumeClick(context.TODO(), 12345); err != nil {
+			t.Fatalf("Failed to consume click: %v", err)
+		}
+		// The last click mustn't expire the link, the TTL index would purge it and it would answer 404
+		if update := mt.GetStartedEvent().Command.Lookup("update").String(); strings.Contains(update, "expiresAt") {
+			t.Errorf("Expected the click not to touch the expiry, got %s", update)
+		}
+	})
+
+	mt.Run("test click limit reached", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+
+		repo := &MongoRepo{Client: mt.Client, Collection: mt.Coll}
+		if err := repo.ConsumeClick(context.TODO(), 12345); !errors.Is(err, ErrLinkExpired) {
+			t.Errorf("Expected ErrLinkExpired, got %v", err)
+		}
+	})
+}
+
+// TestURLExpired tests the expiry rules for time and click limited links
+func TestURLExpired(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+
+	cases := []struct {
+		name    string
+		url     URL
+		expired bool
+	}{
+		{"no limits", URL{AccessCount: 100}, false},
+		{"expires in future", URL{ExpiresAt: &future}, false},
+		{"expired", URL{ExpiresAt: &past}, true},
+		{"clicks left", URL{MaxClicks: 2, AccessCount: 1}, false},
+		{"clicks used up", URL{MaxClicks: 2, AccessCount: 2}, true},
+	}
+	for _, c := range cases {
+		if got := c.url.Expired(now); got != c.expired {
+			t.Errorf("%s: expected expired=%v, got %v", c.name, c.expired, got)
+		}
+	}
+}
+
+// TestSaveURLExpiryInPast tests that links can't be created already expired
+func TestSaveURLExpiryInPast(t *testing.T) {
+	repo := &MongoRepo{}
+	past := time.Now().Add(-time.Hour)
+
+	_, err := repo.SaveURL(context.TODO(), "https://example.com", LinkOptions{ExpiresAt: &past})
+	var urlErr *utils.URLError
+	if !errors.As(err, &urlErr) {
+		t.Errorf("Expected URLError, got %v", err)
+	}
+}
+
+// TestClickStats tests decoding the click stats aggregation
+func TestClickStats(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("test click stats", func(mt *mtest.T) {
+		hour := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "url_shortener.clicks", mtest.FirstBatch, bson.D{
+			{Key: "buckets", Value: bson.A{bson.D{{Key: "_id", Value: hour.UnixMilli()}, {Key: "count", Value: 4}}}},
+			{Key: "referrers", Value: bson.A{bson.D{{Key: "value", Value: "news.example.com"}, {Key: "count", Value: 3}}}},
+			{Key: "countries", Value: bson.A{}},
+			{Key: "userAgents", Value: bson.A{bson.D{{Key: "value", Value: "mobile"}, {Key: "count", Value: 4}}}},
+		}))
+
+		repo := &MongoRepo{Client: mt.Client, Collection: mt.Coll}
+		stats, err := repo.ClickStats(context.TODO(), 12345, hour.Add(-time.Hour), time.Hour)
+		if err != nil {
+			t.Fatalf("Failed to load click stats: %v", err)
+		}
+		if len(stats.Buckets) != 1 || !stats.Buckets[0].Start.Equal(hour) || stats.Buckets[0].Count != 4 {
+			t.Errorf("Unexpected buckets: %+v", stats.Buckets)
+		}
+		if len(stats.TopReferrers) != 1 || stats.TopReferrers[0].Value != "news.example.com" {
+			t.Errorf("Unexpected referrers: %+v", stats.TopReferrers)
+		}
+	})
+}
+
+// TestIncrementAccessCounts tests applying a batch of buffered clicks
+func TestIncrementAccessCounts(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("test increment access counts", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}, bson.E{Key: "nModified", Value: 2}))
+
+		repo := &MongoRepo{Client: mt.Client, Collection: mt.Coll}
+		if err := repo.IncrementAccessCounts(context.TODO(), map[int64]int{1: 3, 2: 1}); err != nil {
+			t.Fatalf("Failed to increment access counts: %v", err)
+		}
+	})
+
+	mt.Run("reports only the failed updates", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 1, Code: 2, Message: "bad update"}))
+
+		repo := &MongoRepo{Client: mt.Client, Collection: mt.Coll}
+		counts := map[int64]int{1: 3, 2: 1}
+		err := repo.IncrementAccessCounts(context.TODO(), counts)
+		var incErr *IncrementError
+		if !errors.As(err, &incErr) {
+			t.Fatalf("Expected an IncrementError, got %v", err)
+		}
+		if len(incErr.Failed) != 1 {
+			t.Fatalf("Expected one failed update, got %v", incErr.Failed)
+		}
+		for id, n := range incErr.Failed {
+			if counts[id] != n {
+				t.Errorf("Expected the failed count of link %d to be %d, got %d", id, counts[id], n)
+			}
+		}
+	})
+}
+
+func TestImportURLsAliasTaken(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("reports the link whose alias is taken", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{
+			Index: 1, Code: 11000, Message: `E11000 duplicate key error collection: url_shortener.urls index: alias_1 dup key: { alias: "launch2026" }`,
+		}))
+
+		repo := &MongoRepo{Client: mt.Client, Collection: mt.Coll}
+		err := repo.ImportURLs(context.TODO(), []*URL{
+			{ID: 1, LongURL: "https://example.com/a"},
+			{ID: 2, LongURL: "https://example.com/b", Alias: "launch2026"},
+		})
+		if !errors.Is(err, ErrAliasTaken) || !strings.Contains(err.Error(), "link 2") {
+			t.Errorf("Expected ErrAliasTaken for link 2, got %v", err)
+		}
+	})
+
+	mt.Run("reports the link whose canonical key is taken", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{
+			Index: 0, Code: 11000, Message: `E11000 duplicate key error collection: url_shortener.urls index: canonicalKey_1_ownerID_1 dup key: { canonicalKey: "https://example.com/a", ownerID: "team-a" }`,
+		}))
+
+		repo := &MongoRepo{Client: mt.Client, Collection: mt.Coll}
+		err := repo.ImportURLs(context.TODO(), []*URL{
+			{ID: 2, LongURL: "https://example.com/a", CanonicalKey: "https://example.com/a", OwnerID: "team-a"},
+		})
+		if !errors.Is(err, ErrCanonicalKeyTaken) || !strings.Contains(err.Error(), "link 2") {
+			t.Errorf("Expected ErrCanonicalKeyTaken for link 2, got %v", err)
+		}
+	})
+}
+
+func TestListURLsByOwner(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("test list URLs by owner", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "url_shortener.urls", mtest.FirstBatch,
+			bson.D{{Key: "_id", Value: int64(7)}, {Key: "longURL", Value: "https://example.com/b"}, {Key: "ownerID", Value: "team-a"}},
+			bson.D{{Key: "_id", Value: int64(3)}, {Key: "longURL", Value: "https://example.com/a"}, {Key: "ownerID", Value: "team-a"}},
+		))
+
+		repo := &MongoRepo{
+			Client:     mt.Client,
+			Collection: mt.Coll,
+		}
+
+		urls, err := repo.ListURLsByOwner(context.TODO(), "team-a", 10, 2)
+		if err != nil {
+			t.Fatalf("Failed to list URLs: %v", err)
+		}
+		if len(urls) != 2 || urls[0].ID != 7 || urls[1].OwnerID != "team-a" {
+			t.Errorf("Unexpected URLs: %+v", urls)
+		}
+	})
+}
+
+func TestFindAPIKey(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("test find API key", func(mt *mtest.T) {
+		hash := HashAPIKey("sc_test")
+		mt.AddMockResponses(mtest.CreateCursorResponse(1, "url_shortener.api_keys", mtest.FirstBatch, bson.D{
+			{Key: "_id", Value: hash},
+			{Key: "ownerID", Value: "team-a"},
+			{Key: "name", Value: "ci"},
+		}))
+
+		repo := &MongoRepo{
+			Client:     mt.Client,
+			Collection: mt.Coll,
+		}
+
+		key, err := repo.FindAPIKey(context.TODO(), hash)
+		if err != nil {
+			t.Fatalf("Failed to find API key: %v", err)
+		}
+		if key.OwnerID != "team-a" {
+			t.Errorf("Expected owner team-a, got %s", key.OwnerID)
+		}
+
+		// An empty cursor means the key doesn't exist
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "url_shortener.api_keys", mtest.FirstBatch))
+		if _, err := repo.FindAPIKey(context.TODO(), HashAPIKey("sc_unknown")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+}
+
+// TestCommandMonitorSpans tests the FindOne, UpdateOne and FindOneAndUpdate calls each get a span under the caller's
+func TestCommandMonitorSpans(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock).ClientOptions(options.Client().SetMonitor(commandMonitor())))
+
+	mt.Run("test command spans", func(mt *mtest.T) {
+		recorder := tracingtest.Record(t)
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "url_shortener.urls", mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: int64(12345)},
+				{Key: "longURL", Value: "https://example.com"},
+			}),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 2, Message: "bad update"}),
+		)
+		repo := &MongoRepo{Client: mt.Client, Collection: mt.Coll}
+
+		ctx, parent := tracing.Start(context.TODO(), "redirect")
+		if _, err := repo.FindURLByID(ctx, 12345); err != nil {
+			t.Fatalf("Failed to find URL: %v", err)
+		}
+		if err := repo.IncrementAccessCount(ctx, 12345); err != nil {
+			t.Fatalf("Failed to increment access count: %v", err)
+		}
+		if err := repo.ConsumeClick(ctx, 12345); err == nil {
+			t.Fatalf("Expected the failed command to return an error")
+		}
+		parent.End()
+
+		spans := recorder.Ended()
+		if names := tracingtest.Names(recorder); !slices.Equal(names, []string{"mongodb find", "mongodb update", "mongodb findAndModify", "redirect"}) {
+			t.Fatalf("Unexpected spans %v", names)
+		}
+		for _, span := range spans[:3] {
+			if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+				t.Errorf("Expected %s to be a child of the caller's span", span.Name())
+			}
+		}
+		if spans[1].Status().Code != codes.Unset || spans[2].Status().Code != codes.Error {
+			t.Errorf("Expected only the failed command to be marked as an error, got %v and %v", spans[1].Status(), spans[2].Status())
+		}
+	})
+}
+
+// TestReserveIDsContext tests the counter increment of a leased block runs with the
+// caller's context, so it is traced under the request and stops when the request is cancelled
+func TestReserveIDsContext(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock).ClientOptions(options.Client().SetMonitor(commandMonitor())))
+
+	mt.Run("test counter span", func(mt *mtest.T) {
+		recorder := tracingtest.Record(t)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "seq", Value: int64(1000)}}}))
+		repo := &MongoRepo{Client: mt.Client, Collection: mt.Coll}
+		repo.IDs = NewIDAllocator(repo.ReserveIDs, 1000)
+
+		ctx, parent := tracing.Start(context.TODO(), "shorten")
+		id, err := repo.GetNextID(ctx, "url_counter")
+		if err != nil || id != 1 {
+			t.Fatalf("Expected ID 1 from the leased block, got %d, %v", id, err)
+		}
+		parent.End()
+
+		spans := recorder.Ended()
+		if names := tracingtest.Names(recorder); !slices.Equal(names, []string{"mongodb findAndModify", "shorten"}) {
+			t.Fatalf("Unexpected spans %v", names)
+		}
+		if spans[0].Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("Expected the counter update to be a child of the caller's span")
+		}
+
+		cancelled, cancel := context.WithCancel(context.TODO())
+		cancel()
+		if _, err := repo.ReserveIDs(cancelled, "url_counter", 1000); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected the cancelled request to stop the reservation, got %v", err)
+		}
+	})
+}
@@ -2,73 +2,290 @@ package repository
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"log/slog"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 
+	"gochop-it/internal/config"
+	"gochop-it/internal/metrics"
+	"gochop-it/internal/tracing"
 	"gochop-it/internal/utils"
 )
 
 type RedisRepo struct {
 	Client *redis.Client
+	// Local is an optional per-instance cache in front of Redis
+	Local *LocalCache
+	// Breaker is an optional circuit breaker skipping Redis on the redirect path while it is failing
+	Breaker *CircuitBreaker
+	// loads collapses concurrent storage reads of the same short code
+	loads singleflight.Group
 }
 
-// Initialize a new instance of the RedisRepo struct
-func NewRedisRepo() *RedisRepo {
-	password := os.Getenv("REDIS_PASSWORD")
+// loadTimeout bounds a shared storage read, which no single caller can cancel
+var loadTimeout = 5 * time.Second
+
+// invalidationChannel carries the short codes of edited links to every instance
+const invalidationChannel = "smallchop:invalidate"
 
+// Initialize a new instance of the RedisRepo struct
+func NewRedisRepo(cfg config.RedisConfig) *RedisRepo {
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     "redis:6379", // Docker
-		Password: password,
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
 	})
-	return &RedisRepo{Client: rdb}
+	rdb.AddHook(tracingHook{})
+	repo := &RedisRepo{Client: rdb}
+	if cfg.LocalCacheTTL > 0 {
+		repo.Local = NewLocalCache(cfg.LocalCacheTTL, cfg.LocalCacheSize)
+	}
+	if cfg.BreakerThreshold > 0 {
+		repo.Breaker = NewCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	}
+	return repo
+}
+
+// tracingHook wraps every Redis command in a client span. A missing key is a normal cache miss,
+// so redis.Nil isn't recorded as an error.
+type tracingHook struct{}
+
+var _ redis.Hook = tracingHook{}
+
+func (tracingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	ctx, _ = tracing.Start(ctx, "redis "+cmd.Name(), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemRedis, semconv.DBOperationName(cmd.Name())))
+	return ctx, nil
+}
+
+func (tracingHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	tracing.End(trace.SpanFromContext(ctx), redisError(cmd.Err()))
+	return nil
+}
+
+func (tracingHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	ctx, _ = tracing.Start(ctx, "redis pipeline", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemRedis, attribute.Int("db.redis.commands", len(cmds))))
+	return ctx, nil
+}
+
+func (tracingHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if err = redisError(cmd.Err()); err != nil {
+			break
+		}
+	}
+	tracing.End(trace.SpanFromContext(ctx), err)
+	return nil
+}
+
+// redisError drops redis.Nil, which only reports a missing key
+func redisError(err error) error {
+	if err == redis.Nil {
+		return nil
+	}
+	return err
 }
 
 // SetKey stores the short URL and original URL mapping to Redis
 func (r *RedisRepo) SetKey(ctx context.Context, key string, value string, ttl time.Duration) error {
-	fmt.Println("Setting key", key, "to", value, "in Redis")
 	err := r.Client.Set(ctx, key, value, ttl).Err()
 	if err != nil {
 		return fmt.Errorf("failed to set key in Redis: %w", err)
 	}
-	fmt.Println("The key", key, "has been set to", value, "successfully")
+	slog.DebugContext(ctx, "Cached key in Redis", "key", key, "ttl", ttl)
 	return nil
 }
 
-// GetLongURL retrieves the original URL from Redis based on the given short URL
-// If not found, it lazy-loads from MongoDB and stores it in Redis
-func (r *RedisRepo) GetLongURL(ctx context.Context, shortCode string, mongoRepo URLRepository, ttl time.Duration) (string, error) {
-	// Try to get the long URL from Redis first
-	longURL, err := r.Client.Get(ctx, shortCode).Result()
-	if err == redis.Nil {
-		// Decode the short code to get the ID
-		id := utils.Decode(shortCode)
-		if id == -1 {
-			return "", fmt.Errorf("invalid short URL")
-		}
-		// Get URL document from MongoDB
-		urlDoc, err := mongoRepo.FindURLByID(ctx, id)
-		if err != nil {
-			return "", fmt.Errorf("short URL not found in MongoDB: %w", err)
+// GetURL retrieves the URL document for a short code or alias from Redis.
+// If not found, it lazy-loads from MongoDB and caches it in Redis with a TTL.
+// A Redis error doesn't fail the lookup, the link is read from storage instead,
+// and while the circuit breaker is open Redis isn't asked at all.
+func (r *RedisRepo) GetURL(ctx context.Context, shortCode string, mongoRepo URLRepository, ttl time.Duration) (*URL, error) {
+	if urlDoc, ok := r.Local.Get(shortCode); ok {
+		metrics.CacheRequests.WithLabelValues("hit").Inc()
+		return urlDoc, nil
+	}
+
+	// Try to get the URL from Redis first. The link is only cached if Redis answered this
+	// request, so a Redis outage below the breaker threshold costs one timeout rather than two.
+	cache := false
+	if r.Breaker.Allow() {
+		cached, err := r.Client.Get(ctx, shortCode).Result()
+		switch {
+		case err == nil:
+			r.Breaker.Success()
+			metrics.CacheRequests.WithLabelValues("hit").Inc()
+			urlDoc := decodeCachedURL(shortCode, cached)
+			r.Local.Set(shortCode, urlDoc)
+			return urlDoc, nil
+		case err == redis.Nil:
+			cache = true
+			r.Breaker.Success()
+			metrics.CacheRequests.WithLabelValues("miss").Inc()
+		default:
+			r.failure(ctx, err)
+			metrics.CacheRequests.WithLabelValues("error").Inc()
+			slog.WarnContext(ctx, "Failed to read from Redis, falling back to storage", "error", err)
 		}
+	} else {
+		metrics.CacheRequests.WithLabelValues("bypass").Inc()
+	}
 
-		longURL = urlDoc.LongURL
+	if !utils.IsValidShortCode(shortCode) {
+		return nil, fmt.Errorf("invalid short URL")
+	}
+	return r.load(ctx, shortCode, mongoRepo, ttl, cache)
+}
 
-		// Store the long URL in Redis with a TTL
-		err = r.SetKey(ctx, shortCode, longURL, ttl)
+// load reads a link from storage and caches it. Concurrent misses for the same code wait for
+// one query, so a hot link dropping out of the cache doesn't send a burst of queries to storage.
+// The link is only written to Redis when cache is set.
+func (r *RedisRepo) load(ctx context.Context, shortCode string, mongoRepo URLRepository, ttl time.Duration, cache bool) (*URL, error) {
+	timeout := loadTimeout
+	loaded := r.loads.DoChan(shortCode, func() (any, error) {
+		// The query is shared, so a caller going away mustn't cancel it for the others,
+		// but it still mustn't outlive a storage outage
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		defer cancel()
+		// Get URL document from MongoDB, resolving aliases before numeric codes
+		urlDoc, err := FindURLByShortCode(ctx, mongoRepo, shortCode)
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		if !cache {
+			r.Local.Set(shortCode, urlDoc)
+			return urlDoc, nil
 		}
+		// Store the document in Redis with a TTL, the link is served either way
+		if err := r.CacheURL(ctx, shortCode, urlDoc, ttl); err != nil {
+			r.failure(ctx, err)
+			slog.WarnContext(ctx, "Failed to set Redis cache", "error", err)
+		} else {
+			r.Breaker.Success()
+		}
+		return urlDoc, nil
+	})
 
-		return longURL, nil
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-loaded:
+		if result.Err != nil {
+			return nil, fmt.Errorf("load short URL: %w", result.Err)
+		}
+		// Every waiting caller gets its own copy
+		urlDoc := *result.Val.(*URL)
+		return &urlDoc, nil
+	}
+}
+
+// failure counts a Redis error against the circuit breaker, unless the caller gave up first
+func (r *RedisRepo) failure(ctx context.Context, err error) {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	r.Breaker.Failure()
+}
+
+// CacheURL stores the URL document for a short code in Redis.
+// The TTL is capped at the link's expiry, and expired links are not cached at all
+func (r *RedisRepo) CacheURL(ctx context.Context, shortCode string, urlDoc *URL, ttl time.Duration) error {
+	ttl, ok := urlDoc.cacheTTL(ttl, time.Now())
+	if !ok {
+		return nil
+	}
+	value, err := json.Marshal(urlDoc)
+	if err != nil {
+		return fmt.Errorf("failed to encode URL for Redis: %w", err)
+	}
+	r.Local.Set(shortCode, urlDoc)
+	return r.SetKey(ctx, shortCode, string(value), ttl)
+}
+
+// decodeCachedURL turns a cached value back into a URL document.
+// Older entries hold only the long URL, so the ID is recovered from the short code.
+func decodeCachedURL(shortCode string, cached string) *URL {
+	var urlDoc URL
+	if strings.HasPrefix(cached, "{") && json.Unmarshal([]byte(cached), &urlDoc) == nil {
+		return &urlDoc
+	}
+	return &URL{ID: utils.DecodeID(shortCode), LongURL: cached}
+}
+
+// CachedURL returns the link cached in Redis for a short code with its remaining TTL,
+// or a nil link if the code isn't cached. A zero TTL means the entry never expires.
+func (r *RedisRepo) CachedURL(ctx context.Context, shortCode string) (*URL, time.Duration, error) {
+	cached, err := r.Client.Get(ctx, shortCode).Result()
+	if err == redis.Nil {
+		return nil, 0, nil
 	} else if err != nil {
-		return "", fmt.Errorf("failed to retrieve from Redis: %v", err)
+		return nil, 0, fmt.Errorf("failed to retrieve from Redis: %w", err)
+	}
+	ttl, err := r.Client.TTL(ctx, shortCode).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve TTL from Redis: %w", err)
 	}
+	return decodeCachedURL(shortCode, cached), max(ttl, 0), nil
+}
 
-	// Return the long URL if found in Redis
-	return longURL, nil
+// DeleteKey removes a short code from the Redis cache
+func (r *RedisRepo) DeleteKey(ctx context.Context, key string) error {
+	r.Local.Delete(key)
+	if err := r.Client.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("failed to delete key in Redis: %w", err)
+	}
+	return nil
+}
+
+// InvalidateURL removes every cached copy of an edited or deleted link, in Redis and,
+// through the invalidation channel, in the local cache of every instance
+func (r *RedisRepo) InvalidateURL(ctx context.Context, urlDoc *URL) error {
+	return r.InvalidateKeys(ctx, urlDoc.ShortCodes()...)
+}
+
+// InvalidateKeys removes cached short codes from Redis and the local cache of every instance
+func (r *RedisRepo) InvalidateKeys(ctx context.Context, codes ...string) error {
+	r.Local.Delete(codes...)
+	if err := r.Client.Del(ctx, codes...).Err(); err != nil {
+		return fmt.Errorf("failed to delete keys in Redis: %w", err)
+	}
+	if err := r.Client.Publish(ctx, invalidationChannel, strings.Join(codes, " ")).Err(); err != nil {
+		return fmt.Errorf("failed to publish invalidation: %w", err)
+	}
+	return nil
+}
+
+// ListenForInvalidations drops local copies of links edited on other instances until ctx is done.
+// The subscription reconnects by itself if Redis goes away.
+func (r *RedisRepo) ListenForInvalidations(ctx context.Context) {
+	if r.Local == nil {
+		return
+	}
+	sub := r.Client.Subscribe(ctx, invalidationChannel)
+	defer sub.Close()
+
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			r.Local.Delete(strings.Fields(msg.Payload)...)
+		}
+	}
 }
 
 // Ping tests the Redis connection
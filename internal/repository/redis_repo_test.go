@@ -2,12 +2,21 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/codes"
 
+	"gochop-it/internal/metrics"
+	"gochop-it/internal/tracing"
+	"gochop-it/internal/tracing/tracingtest"
 	"gochop-it/internal/utils"
 )
 
@@ -24,10 +33,128 @@ func (m *MockMongoRepo) FindURLByID(ctx context.Context, id int64) (*URL, error)
 	}, nil
 }
 
+func (m *MockMongoRepo) FindURLByAlias(ctx context.Context, alias string) (*URL, error) {
+	if alias != "launch2026" {
+		return nil, nil
+	}
+	return &URL{
+		ID:      99,
+		LongURL: "https://example.com/launch",
+		Alias:   alias,
+	}, nil
+}
+
 func (m *MockMongoRepo) IncrementAccessCount(ctx context.Context, id int64) error {
 	return nil
 }
 
+func (m *MockMongoRepo) IncrementAccessCounts(ctx context.Context, counts map[int64]int) error {
+	return nil
+}
+
+func (m *MockMongoRepo) SaveURL(ctx context.Context, longURL string, opts LinkOptions) (*URL, error) {
+	return &URL{ID: 12345, LongURL: longURL}, nil
+}
+
+func (m *MockMongoRepo) FindURLByCanonicalKey(ctx context.Context, canonicalKey string, ownerID string) (*URL, error) {
+	return nil, nil
+}
+
+func (m *MockMongoRepo) UpdateURL(ctx context.Context, id int64, update LinkUpdate) (*URL, error) {
+	return nil, ErrNotFound
+}
+
+func (m *MockMongoRepo) DeleteURL(ctx context.Context, id int64) error {
+	return ErrNotFound
+}
+
+func (m *MockMongoRepo) ListURLsByOwner(ctx context.Context, ownerID string, beforeID int64, limit int) ([]*URL, error) {
+	return nil, nil
+}
+
+func (m *MockMongoRepo) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	return nil
+}
+
+func (m *MockMongoRepo) FindAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	return nil, ErrNotFound
+}
+
+func (m *MockMongoRepo) ConsumeClick(ctx context.Context, id int64) error {
+	return nil
+}
+
+func (m *MockMongoRepo) GetNextID(ctx context.Context, counterName string) (int64, error) {
+	return 12345, nil
+}
+
+func (m *MockMongoRepo) ReserveIDs(ctx context.Context, counterName string, n int64) (int64, error) {
+	return 12345, nil
+}
+
+func (m *MockMongoRepo) SaveURLs(ctx context.Context, links []BulkLink) ([]BulkResult, error) {
+	return nil, nil
+}
+
+func (m *MockMongoRepo) SetDisabled(ctx context.Context, id int64, disabled bool) (*URL, error) {
+	return nil, ErrNotFound
+}
+
+func (m *MockMongoRepo) TopURLs(ctx context.Context, limit int) ([]*URL, error) {
+	return nil, nil
+}
+
+func (m *MockMongoRepo) EachURL(ctx context.Context, fn func(urlDoc *URL) error) error {
+	return nil
+}
+
+func (m *MockMongoRepo) ImportURLs(ctx context.Context, urls []*URL) error {
+	return nil
+}
+
+func (m *MockMongoRepo) EnsureCounter(ctx context.Context, counterName string, min int64) error {
+	return nil
+}
+
+func (m *MockMongoRepo) RecordClicks(ctx context.Context, events []ClickEvent) error {
+	return nil
+}
+
+func (m *MockMongoRepo) ClickStats(ctx context.Context, linkID int64, since time.Time, bucket time.Duration) (*ClickStats, error) {
+	return &ClickStats{}, nil
+}
+
+func (m *MockMongoRepo) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
+
+func (m *MockMongoRepo) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MockMongoRepo) Close(ctx context.Context) error {
+	return nil
+}
+
+// countingRepo counts storage reads and, when release is set, holds them until it is closed
+type countingRepo struct {
+	MockMongoRepo
+	finds   atomic.Int32
+	release chan struct{}
+}
+
+func (c *countingRepo) FindURLByID(ctx context.Context, id int64) (*URL, error) {
+	c.finds.Add(1)
+	if c.release != nil {
+		select {
+		case <-c.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return c.MockMongoRepo.FindURLByID(ctx, id)
+}
+
 // Create a mock Redis Client using miniredis
 func createMockRedis() (*redis.Client, *miniredis.Miniredis) {
 	// Start a mock Redis server
@@ -72,8 +199,8 @@ func TestSetKey(t *testing.T) {
 	}
 }
 
-// Test for GetLongURL: ensure that a stored key-value pair can be retrieved successfully.
-func TestGetLongURL(t *testing.T) {
+// Test for GetURL: ensure that a stored key-value pair can be retrieved successfully.
+func TestGetURL(t *testing.T) {
 	// Create a context for Redis operations
 	ctx := context.TODO()
 	// Create mock Redis Client and miniredis for testing
@@ -90,20 +217,25 @@ func TestGetLongURL(t *testing.T) {
 		t.Fatalf("Failed to set key in mock Redis: %v", err)
 	}
 
+	hits := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("hit"))
+
 	// Act: Try to retrieve the key from Redis
-	longURL, err := redisRepo.GetLongURL(ctx, key, nil, 10*time.Minute)
+	urlDoc, err := redisRepo.GetURL(ctx, key, nil, 10*time.Minute)
 	if err != nil {
 		t.Fatalf("Failed to retrieve key from Redis: %v", err)
 	}
 
 	// Assert: Check if the retrieved value matches the stored value
-	if longURL != value {
-		t.Errorf("Expected %s, got %s", value, longURL)
+	if urlDoc.LongURL != value {
+		t.Errorf("Expected %s, got %s", value, urlDoc.LongURL)
+	}
+	if got := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("hit")) - hits; got != 1 {
+		t.Errorf("Expected 1 cache hit, got %v", got)
 	}
 }
 
-// TestGetLongURLMiss tests the GetLongURL function when the key is not found in Redis and must be fetched from MongoDB
-func TestGetLongURLMiss(t *testing.T) {
+// TestGetURLMiss tests the GetURL function when the key is not found in Redis and must be fetched from MongoDB
+func TestGetURLMiss(t *testing.T) {
 	// Create a context for Redis operations
 	ctx := context.TODO()
 	// Create mock Redis Client and miniredis for testing
@@ -122,15 +254,20 @@ func TestGetLongURLMiss(t *testing.T) {
 	// Create an instance of MockMongoRepo
 	mongoRepo := &MockMongoRepo{}
 
+	misses := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("miss"))
+
 	// Act: Try to retrieve the key from Redis (will miss and fetch from MongoDB)
-	longURL, err := redisRepo.GetLongURL(ctx, key, mongoRepo, 10*time.Minute)
+	urlDoc, err := redisRepo.GetURL(ctx, key, mongoRepo, 10*time.Minute)
 	if err != nil {
 		t.Fatalf("Failed to retrieve key from Redis: %v", err)
 	}
 
 	// Assert: Check if the retrieved value matches the expected value
-	if longURL != expectedURL {
-		t.Errorf("Expected %s, got %s", expectedURL, longURL)
+	if urlDoc.LongURL != expectedURL {
+		t.Errorf("Expected %s, got %s", expectedURL, urlDoc.LongURL)
+	}
+	if got := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("miss")) - misses; got != 1 {
+		t.Errorf("Expected 1 cache miss, got %v", got)
 	}
 
 	// Verify that the key is now set in Redis
@@ -138,7 +275,344 @@ func TestGetLongURLMiss(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to get key from mock Redis: %v", err)
 	}
-	if storedValue != expectedURL {
+	if cached := decodeCachedURL(key, storedValue); cached.LongURL != expectedURL {
 		t.Errorf("Expected %s in Redis, got %s", expectedURL, storedValue)
 	}
 }
+
+// TestGetURLAlias tests that aliases are resolved through MongoDB and cached with their ID
+func TestGetURLAlias(t *testing.T) {
+	ctx := context.TODO()
+	rdb, mock := createMockRedis()
+	redisRepo := &RedisRepo{Client: rdb}
+
+	urlDoc, err := redisRepo.GetURL(ctx, "launch2026", &MockMongoRepo{}, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to resolve alias: %v", err)
+	}
+	if urlDoc.ID != 99 || urlDoc.LongURL != "https://example.com/launch" {
+		t.Errorf("Unexpected URL document: %+v", urlDoc)
+	}
+
+	// Served from the cache on the second call
+	storedValue, err := mock.Get("launch2026")
+	if err != nil {
+		t.Fatalf("Failed to get key from mock Redis: %v", err)
+	}
+	if cached := decodeCachedURL("launch2026", storedValue); cached.ID != 99 {
+		t.Errorf("Expected cached ID 99, got %d", cached.ID)
+	}
+
+	// Unknown aliases are reported as not found
+	if _, err := redisRepo.GetURL(ctx, "no-such-alias", &MockMongoRepo{}, 10*time.Minute); err == nil {
+		t.Errorf("Expected an error for an unknown alias")
+	}
+}
+
+// TestRedisSpans tests a cache miss traces the Redis Get and Set under the caller's span,
+// without marking the missing key as an error
+func TestRedisSpans(t *testing.T) {
+	ctx := context.TODO()
+	recorder := tracingtest.Record(t)
+	rdb, mock := createMockRedis()
+	defer mock.Close()
+	rdb.AddHook(tracingHook{})
+	redisRepo := &RedisRepo{Client: rdb}
+
+	ctx, parent := tracing.Start(ctx, "redirect")
+	if _, err := redisRepo.GetURL(ctx, utils.Encode(12345), &MockMongoRepo{}, 10*time.Minute); err != nil {
+		t.Fatalf("Failed to get URL: %v", err)
+	}
+	mock.Close()
+	if _, err := redisRepo.GetURL(ctx, utils.Encode(12345), &MockMongoRepo{}, 10*time.Minute); err != nil {
+		t.Fatalf("Expected the link to be read from storage with Redis down: %v", err)
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	// With Redis down the link isn't written back, so the failed read costs the only timeout
+	if names := tracingtest.Names(recorder); !slices.Equal(names, []string{"redis get", "redis set", "redis get", "redirect"}) {
+		t.Fatalf("Unexpected spans %v", names)
+	}
+	for n, span := range spans[:3] {
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("Expected %s to be a child of the caller's span", span.Name())
+		}
+		if failed := span.Status().Code == codes.Error; failed != (n >= 2) {
+			t.Errorf("Unexpected status %v for span %d", span.Status(), n)
+		}
+	}
+}
+
+// TestCacheURLExpiry tests that cached entries never outlive the link
+func TestCacheURLExpiry(t *testing.T) {
+	ctx := context.TODO()
+	rdb, mock := createMockRedis()
+	redisRepo := &RedisRepo{Client: rdb}
+
+	expiresAt := time.Now().Add(10 * time.Minute)
+	urlDoc := &URL{ID: 1, LongURL: "https://example.com", ExpiresAt: &expiresAt}
+	if err := redisRepo.CacheURL(ctx, "c", urlDoc, time.Hour); err != nil {
+		t.Fatalf("Failed to cache URL: %v", err)
+	}
+	if ttl := mock.TTL("c"); ttl > 10*time.Minute || ttl <= 0 {
+		t.Errorf("Expected TTL capped at 10m, got %v", ttl)
+	}
+
+	// Expired links are never cached
+	expired := time.Now().Add(-time.Minute)
+	urlDoc = &URL{ID: 2, LongURL: "https://example.com", ExpiresAt: &expired}
+	if err := redisRepo.CacheURL(ctx, "d", urlDoc, time.Hour); err != nil {
+		t.Fatalf("Failed to cache URL: %v", err)
+	}
+	if mock.Exists("d") {
+		t.Errorf("Expected expired link not to be cached")
+	}
+}
+
+func TestInvalidateURL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	rdb, mock := createMockRedis()
+
+	// Two instances sharing Redis, each with its own local cache
+	editor := &RedisRepo{Client: rdb, Local: NewLocalCache(time.Minute, 10)}
+	replica := &RedisRepo{Client: rdb, Local: NewLocalCache(time.Minute, 10)}
+	go replica.ListenForInvalidations(ctx)
+
+	urlDoc := &URL{ID: 1, LongURL: "https://example.com", Alias: "launch2026"}
+	for _, code := range urlDoc.ShortCodes() {
+		if err := editor.CacheURL(ctx, code, urlDoc, time.Hour); err != nil {
+			t.Fatalf("Failed to cache URL: %v", err)
+		}
+		replica.Local.Set(code, urlDoc)
+	}
+
+	// The subscription starts asynchronously, so publish until the replica has it
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if err := editor.InvalidateURL(ctx, urlDoc); err != nil {
+			t.Fatalf("Failed to invalidate URL: %v", err)
+		}
+		if _, ok := replica.Local.Get("launch2026"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected replica to drop its local copy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, code := range urlDoc.ShortCodes() {
+		if mock.Exists(code) {
+			t.Errorf("Expected %s to be deleted from Redis", code)
+		}
+		if _, ok := editor.Local.Get(code); ok {
+			t.Errorf("Expected %s to be dropped from the local cache", code)
+		}
+	}
+	if _, ok := replica.Local.Get(utils.EncodeID(1)); ok {
+		t.Errorf("Expected replica to drop the encoded ID as well")
+	}
+}
+
+func TestLocalCache(t *testing.T) {
+	cache := NewLocalCache(time.Minute, 2)
+	for i := int64(1); i <= 3; i++ {
+		cache.Set(utils.EncodeID(i), &URL{ID: i, LongURL: "https://example.com"})
+	}
+	if n := len(cache.entries); n != 2 {
+		t.Errorf("Expected cache to hold 2 entries, got %d", n)
+	}
+	if urlDoc, ok := cache.Get(utils.EncodeID(3)); !ok || urlDoc.ID != 3 {
+		t.Errorf("Expected newest entry to be cached, got %+v", urlDoc)
+	}
+
+	// Links never outlive their expiry, and a nil cache is a no-op
+	expired := time.Now().Add(-time.Minute)
+	cache.Set("z", &URL{ID: 9, ExpiresAt: &expired})
+	if _, ok := cache.Get("z"); ok {
+		t.Errorf("Expected expired link not to be cached")
+	}
+	var disabled *LocalCache
+	disabled.Set("b", &URL{ID: 1})
+	if _, ok := disabled.Get("b"); ok {
+		t.Errorf("Expected nil cache to cache nothing")
+	}
+}
+
+// TestCircuitBreaker tests the breaker opens after enough errors in a row, lets one probe
+// through per cooldown and closes again on success
+func TestCircuitBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker(2, 20*time.Millisecond)
+
+	breaker.Failure()
+	if !breaker.Allow() {
+		t.Fatalf("Expected the breaker to stay closed below the threshold")
+	}
+	breaker.Success()
+	breaker.Failure()
+	if !breaker.Allow() {
+		t.Fatalf("Expected a success to reset the error count")
+	}
+	breaker.Failure()
+	if breaker.Allow() {
+		t.Fatalf("Expected the breaker to open after 2 errors in a row")
+	}
+	if got := testutil.ToFloat64(metrics.RedisBreakerOpen); got != 1 {
+		t.Errorf("Expected the open gauge to be 1, got %v", got)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !breaker.Allow() {
+		t.Fatalf("Expected a probe after the cooldown")
+	}
+	if breaker.Allow() {
+		t.Fatalf("Expected a single probe per cooldown")
+	}
+	breaker.Failure()
+	if breaker.Allow() {
+		t.Fatalf("Expected a failed probe to keep the breaker open")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !breaker.Allow() {
+		t.Fatalf("Expected another probe after the cooldown")
+	}
+	breaker.Success()
+	if !breaker.Allow() || !breaker.Allow() {
+		t.Errorf("Expected a successful probe to close the breaker")
+	}
+	if got := testutil.ToFloat64(metrics.RedisBreakerOpen); got != 0 {
+		t.Errorf("Expected the open gauge to be 0, got %v", got)
+	}
+
+	var disabled *CircuitBreaker
+	disabled.Failure()
+	if !disabled.Allow() {
+		t.Errorf("Expected a nil breaker to never open")
+	}
+}
+
+// TestGetURLRedisOutage tests lookups fall back to storage while Redis is down, skip Redis
+// once the breaker opens, and use it again after Redis comes back
+func TestGetURLRedisOutage(t *testing.T) {
+	ctx := context.TODO()
+	rdb, mock := createMockRedis()
+	defer mock.Close()
+	redisRepo := &RedisRepo{Client: rdb, Breaker: NewCircuitBreaker(2, 50*time.Millisecond)}
+	storage := &countingRepo{}
+	code := utils.Encode(12345)
+
+	mock.Close()
+	for i := 0; i < 2; i++ {
+		urlDoc, err := redisRepo.GetURL(ctx, code, storage, time.Hour)
+		if err != nil || urlDoc.LongURL != "https://example.com" {
+			t.Fatalf("Expected the link from storage with Redis down, got %+v, %v", urlDoc, err)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.RedisBreakerOpen); got != 1 {
+		t.Fatalf("Expected the breaker to open after 2 Redis errors, open gauge is %v", got)
+	}
+
+	bypass := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("bypass"))
+	errored := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("error"))
+	if _, err := redisRepo.GetURL(ctx, code, storage, time.Hour); err != nil {
+		t.Fatalf("Expected the link from storage with the breaker open: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("bypass")) - bypass; got != 1 {
+		t.Errorf("Expected 1 bypassed lookup, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("error")) - errored; got != 0 {
+		t.Errorf("Expected Redis to be skipped, got %v errors", got)
+	}
+	if got := storage.finds.Load(); got != 3 {
+		t.Errorf("Expected 3 storage reads, got %d", got)
+	}
+
+	// Once Redis is back the next probe closes the breaker and the link is cached again
+	if err := mock.Restart(); err != nil {
+		t.Fatalf("Failed to restart miniredis: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := redisRepo.GetURL(ctx, code, storage, time.Hour); err != nil {
+		t.Fatalf("Failed to get URL: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.RedisBreakerOpen); got != 0 {
+		t.Errorf("Expected the breaker to close with Redis back, open gauge is %v", got)
+	}
+	if !mock.Exists(code) {
+		t.Errorf("Expected the link to be cached in Redis again")
+	}
+}
+
+// TestGetURLSingleflight tests concurrent misses for the same code share one storage read
+func TestGetURLSingleflight(t *testing.T) {
+	ctx := context.TODO()
+	rdb, mock := createMockRedis()
+	defer mock.Close()
+	redisRepo := &RedisRepo{Client: rdb}
+	storage := &countingRepo{release: make(chan struct{})}
+	code := utils.Encode(12345)
+
+	var wg sync.WaitGroup
+	results := make(chan *URL, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			urlDoc, err := redisRepo.GetURL(ctx, code, storage, time.Hour)
+			if err != nil {
+				t.Errorf("Failed to get URL: %v", err)
+				return
+			}
+			results <- urlDoc
+		}()
+	}
+	// Give every lookup time to miss Redis and join the read in flight
+	time.Sleep(50 * time.Millisecond)
+	close(storage.release)
+	wg.Wait()
+	close(results)
+
+	if got := storage.finds.Load(); got != 1 {
+		t.Errorf("Expected 1 storage read, got %d", got)
+	}
+	seen := make(map[*URL]bool)
+	for urlDoc := range results {
+		if seen[urlDoc] {
+			t.Errorf("Expected every caller to get its own copy")
+		}
+		seen[urlDoc] = true
+	}
+}
+
+// TestGetURLCallerGone tests a caller giving up doesn't wait for a shared read
+func TestGetURLCallerGone(t *testing.T) {
+	rdb, mock := createMockRedis()
+	defer mock.Close()
+	redisRepo := &RedisRepo{Client: rdb}
+	storage := &countingRepo{release: make(chan struct{})}
+	defer close(storage.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := redisRepo.GetURL(ctx, utils.Encode(12345), storage, time.Hour); err != context.DeadlineExceeded {
+		t.Errorf("Expected the caller's deadline, got %v", err)
+	}
+}
+
+// TestGetURLLoadTimeout tests a shared storage read gives up on its own when storage hangs
+func TestGetURLLoadTimeout(t *testing.T) {
+	loadTimeout = 20 * time.Millisecond
+	defer func() { loadTimeout = 5 * time.Second }()
+	rdb, mock := createMockRedis()
+	defer mock.Close()
+	redisRepo := &RedisRepo{Client: rdb}
+	storage := &countingRepo{release: make(chan struct{})}
+	defer close(storage.release)
+
+	if _, err := redisRepo.GetURL(context.Background(), utils.Encode(12345), storage, time.Hour); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the storage read to time out, got %v", err)
+	}
+}
@@ -0,0 +1,439 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gochop-it/internal/config"
+	"gochop-it/internal/metrics"
+	"gochop-it/internal/utils"
+)
+
+// URL struct represents a stored short link
+type URL struct {
+	ID          int64      `bson:"_id,omitempty"`
+	CreatedAt   time.Time  `bson:"createdAt"`
+	LongURL     string     `bson:"longURL"`
+	AccessCount int        `bson:"accessCount"`
+	Alias       string     `bson:"alias,omitempty"`
+	ExpiresAt   *time.Time `bson:"expiresAt,omitempty"`
+	MaxClicks   int        `bson:"maxClicks,omitempty"`
+	OwnerID     string     `bson:"ownerID,omitempty"`
+	DeletedAt   *time.Time `bson:"deletedAt,omitempty"`
+	// CanonicalKey is the canonical form of LongURL (see utils.CanonicalURL), set on plain links only.
+	// It is unique per owner, so equivalent spellings of a URL share one link.
+	CanonicalKey string `bson:"canonicalKey,omitempty"`
+	// DisabledAt is set while an operator has disabled the link, see SetDisabled
+	DisabledAt *time.Time `bson:"disabledAt,omitempty"`
+}
+
+// Deleted reports whether the link has been deleted by its owner
+func (u *URL) Deleted() bool {
+	return u.DeletedAt != nil
+}
+
+// Disabled reports whether the link has been disabled by an operator
+func (u *URL) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
+// Expired reports whether the link has passed its expiry time or used up its clicks
+func (u *URL) Expired(now time.Time) bool {
+	if u.ExpiresAt != nil && !now.Before(*u.ExpiresAt) {
+		return true
+	}
+	return u.MaxClicks > 0 && u.AccessCount >= u.MaxClicks
+}
+
+// cacheTTL caps ttl so a cached entry never outlives the link itself.
+// A zero ttl means no expiry, matching Redis. Returns false if the link should not be cached.
+func (u *URL) cacheTTL(ttl time.Duration, now time.Time) (time.Duration, bool) {
+	if u.ExpiresAt == nil {
+		return ttl, true
+	}
+	remaining := u.ExpiresAt.Sub(now)
+	if remaining <= 0 {
+		return 0, false
+	}
+	if ttl == 0 || remaining < ttl {
+		ttl = remaining
+	}
+	return ttl, true
+}
+
+// ShortCode returns the public short code for the URL document, preferring its alias
+func (u *URL) ShortCode() string {
+	if u.Alias != "" {
+		return u.Alias
+	}
+	return utils.EncodeID(u.ID)
+}
+
+// ShortCodes returns every code the link resolves from. Aliased links also resolve
+// from their encoded ID, so both have to be dropped from caches when the link changes.
+func (u *URL) ShortCodes() []string {
+	codes := []string{utils.EncodeID(u.ID)}
+	if u.Alias != "" {
+		codes = append(codes, u.Alias)
+	}
+	return codes
+}
+
+// LinkOptions holds the optional settings for a new link
+type LinkOptions struct {
+	Alias     string
+	ExpiresAt *time.Time
+	MaxClicks int
+	// OwnerID is the owner of the API key that created the link, empty for anonymous links
+	OwnerID string
+}
+
+// plain reports whether the options describe a plain link that can be shared between requests of the same owner
+func (o LinkOptions) plain() bool {
+	return o.Alias == "" && o.ExpiresAt == nil && o.MaxClicks == 0
+}
+
+// LinkUpdate holds the changes to an existing link, unset fields are left as they are.
+// Updated links drop their canonical key, so plain shortens are never deduped onto a link its owner has edited.
+type LinkUpdate struct {
+	// LongURL is the new destination, if not empty
+	LongURL string
+	// SetExpiry replaces the expiry with ExpiresAt, a nil ExpiresAt removes it
+	SetExpiry bool
+	ExpiresAt *time.Time
+}
+
+// prepare validates the update the same way prepareURL validates new links
+func (u LinkUpdate) prepare() (LinkUpdate, error) {
+	if u.LongURL == "" && !u.SetExpiry {
+		return u, &utils.URLError{Reason: "nothing to update"}
+	}
+	if u.LongURL != "" {
+		sanitizedURL, err := utils.SanitizeURL(u.LongURL)
+		if err != nil {
+			return u, err
+		}
+		u.LongURL = sanitizedURL
+	}
+	if u.SetExpiry && u.ExpiresAt != nil && !u.ExpiresAt.After(time.Now()) {
+		return u, &utils.URLError{Reason: "expiry must be in the future"}
+	}
+	return u, nil
+}
+
+var (
+	// ErrNotFound is returned when no link matches a lookup
+	ErrNotFound = errors.New("link not found")
+	// ErrAliasTaken is returned when a custom alias is already in use
+	ErrAliasTaken = errors.New("alias is already in use")
+	// ErrCanonicalKeyTaken is returned when an import gives an owner a second plain link for the same URL
+	ErrCanonicalKeyTaken = errors.New("owner already has a plain link for this URL")
+	// ErrLinkExpired is returned when a link has expired or run out of clicks
+	ErrLinkExpired = errors.New("link has expired")
+)
+
+// IncrementError is returned by IncrementAccessCounts when only part of a batch was applied.
+// Failed holds the counts that weren't, so they can be retried without counting the rest twice.
+type IncrementError struct {
+	Failed map[int64]int
+	Err    error
+}
+
+func (e *IncrementError) Error() string {
+	return fmt.Sprintf("%d of the access counts were not applied: %v", len(e.Failed), e.Err)
+}
+
+func (e *IncrementError) Unwrap() error {
+	return e.Err
+}
+
+// URLRepository is implemented by every storage backend.
+// FindURLByID and FindAPIKey return ErrNotFound for unknown keys, while the dedupe lookups
+// FindURLByCanonicalKey and FindURLByAlias return a nil document instead. Deleted links are still
+// found by ID and alias, so they can answer 410 Gone, but UpdateURL and DeleteURL treat them as not found.
+// EachURL, ImportURLs and EnsureCounter back up and restore the links as they are stored, deleted links included.
+// SetDisabled and TopURLs serve operators: a disabled link keeps its codes and canonical key, so shortening
+// its URL again returns the disabled link rather than a working copy.
+type URLRepository interface {
+	SaveURL(ctx context.Context, longURL string, opts LinkOptions) (*URL, error)
+	FindURLByID(ctx context.Context, id int64) (*URL, error)
+	FindURLByCanonicalKey(ctx context.Context, canonicalKey string, ownerID string) (*URL, error)
+	FindURLByAlias(ctx context.Context, alias string) (*URL, error)
+	IncrementAccessCount(ctx context.Context, id int64) error
+	IncrementAccessCounts(ctx context.Context, counts map[int64]int) error
+	ConsumeClick(ctx context.Context, id int64) error
+	UpdateURL(ctx context.Context, id int64, update LinkUpdate) (*URL, error)
+	DeleteURL(ctx context.Context, id int64) error
+	SetDisabled(ctx context.Context, id int64, disabled bool) (*URL, error)
+	TopURLs(ctx context.Context, limit int) ([]*URL, error)
+	GetNextID(ctx context.Context, counterName string) (int64, error)
+	ReserveIDs(ctx context.Context, counterName string, n int64) (int64, error)
+	SaveURLs(ctx context.Context, links []BulkLink) ([]BulkResult, error)
+	EachURL(ctx context.Context, fn func(urlDoc *URL) error) error
+	ImportURLs(ctx context.Context, urls []*URL) error
+	EnsureCounter(ctx context.Context, counterName string, min int64) error
+	ListURLsByOwner(ctx context.Context, ownerID string, beforeID int64, limit int) ([]*URL, error)
+	CreateAPIKey(ctx context.Context, key *APIKey) error
+	FindAPIKey(ctx context.Context, hash string) (*APIKey, error)
+	RecordClicks(ctx context.Context, events []ClickEvent) error
+	ClickStats(ctx context.Context, linkID int64, since time.Time, bucket time.Duration) (*ClickStats, error)
+	EnsureIndexes(ctx context.Context) error
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// Storage backends selectable with config.StorageConfig.Backend
+const (
+	BackendMongo  = "mongo"
+	BackendSQLite = "sqlite"
+	BackendMemory = "memory"
+)
+
+// NewURLRepository opens the configured storage backend, defaulting to MongoDB.
+// Persistent backends lease IDs in blocks of cfg.Storage.IDLeaseSize.
+func NewURLRepository(ctx context.Context, cfg *config.Config) (URLRepository, error) {
+	switch backend := cfg.Storage.Backend; backend {
+	case "", BackendMongo:
+		repo, err := NewMongoRepo(ctx, cfg.Mongo)
+		if err != nil {
+			return nil, err
+		}
+		repo.IDs = NewIDAllocator(repo.ReserveIDs, cfg.Storage.IDLeaseSize)
+		return repo, nil
+	case BackendSQLite:
+		repo, err := NewSQLiteRepo(ctx, cfg.Storage.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		repo.IDs = NewIDAllocator(repo.ReserveIDs, cfg.Storage.IDLeaseSize)
+		return repo, nil
+	case BackendMemory:
+		return NewMemoryRepo(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// FindURLByShortCode resolves a short code to its URL document.
+// Aliases are resolved first; since utils.ValidateAlias never accepts a code made only of
+// base 52 characters, anything that is one is decoded into its numeric ID instead.
+func FindURLByShortCode(ctx context.Context, repo URLRepository, shortCode string) (*URL, error) {
+	if utils.Decode(shortCode) == -1 {
+		urlDoc, err := repo.FindURLByAlias(ctx, shortCode)
+		if err != nil {
+			return nil, err
+		}
+		if urlDoc == nil {
+			return nil, fmt.Errorf("alias %q: %w", shortCode, ErrNotFound)
+		}
+		return urlDoc, nil
+	}
+	id := utils.DecodeID(shortCode)
+	if id == -1 {
+		return nil, fmt.Errorf("short code %q: %w", shortCode, ErrNotFound)
+	}
+	return repo.FindURLByID(ctx, id)
+}
+
+// prepareURL holds the save logic shared by every backend. It validates the request and
+// either returns the existing document for a duplicate plain link (existing is true),
+// or a new document with a freshly allocated ID that the caller must insert.
+func prepareURL(ctx context.Context, repo URLRepository, nextID func(ctx context.Context, counterName string) (int64, error), longURL string, opts LinkOptions) (urlDoc *URL, existing bool, err error) {
+	urlDoc, existing, err = checkURL(ctx, repo, longURL, opts)
+	if err != nil || existing {
+		return urlDoc, existing, err
+	}
+
+	// Generate a new ID
+	if urlDoc.ID, err = nextID(ctx, "url_counter"); err != nil {
+		return nil, false, err
+	}
+	return urlDoc, false, nil
+}
+
+// checkURL validates a new link and looks up an existing document for a duplicate plain link.
+// The new document it returns has no ID yet.
+func checkURL(ctx context.Context, repo URLRepository, longURL string, opts LinkOptions) (urlDoc *URL, existing bool, err error) {
+	// Sanitize the URL
+	sanitizedURL, err := utils.SanitizeURL(longURL)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if opts.ExpiresAt != nil && !opts.ExpiresAt.After(time.Now()) {
+		return nil, false, &utils.URLError{Reason: "expiry must be in the future"}
+	}
+	if opts.MaxClicks < 0 {
+		return nil, false, &utils.URLError{Reason: "max clicks must not be negative"}
+	}
+
+	if opts.Alias != "" {
+		if err := utils.ValidateAlias(opts.Alias); err != nil {
+			return nil, false, err
+		}
+		// Check the alias is not already taken
+		taken, err := repo.FindURLByAlias(ctx, opts.Alias)
+		if err != nil {
+			return nil, false, err
+		}
+		if taken != nil {
+			return nil, false, ErrAliasTaken
+		}
+	}
+	var canonicalKey string
+	if opts.plain() {
+		// Check if an equivalent long URL already exists for this owner
+		if canonicalKey, err = utils.CanonicalURL(sanitizedURL); err != nil {
+			return nil, false, err
+		}
+		existingURL, err := repo.FindURLByCanonicalKey(ctx, canonicalKey, opts.OwnerID)
+		if err != nil {
+			return nil, false, err
+		}
+		if existingURL != nil {
+			return existingURL, true, nil
+		}
+	}
+
+	return &URL{
+		CreatedAt:    time.Now(),
+		LongURL:      sanitizedURL,
+		AccessCount:  0,
+		Alias:        opts.Alias,
+		ExpiresAt:    opts.ExpiresAt,
+		MaxClicks:    opts.MaxClicks,
+		OwnerID:      opts.OwnerID,
+		CanonicalKey: canonicalKey,
+	}, false, nil
+}
+
+// resolveDuplicate settles an insert that lost a race on a unique index. A plain link returns
+// the equivalent link saved first, as if the requests had run one after the other, and an
+// aliased link reports the alias as taken. Any other violation returns err unchanged.
+func resolveDuplicate(ctx context.Context, repo URLRepository, urlDoc *URL, err error) (*URL, error) {
+	if urlDoc.CanonicalKey != "" {
+		existing, findErr := repo.FindURLByCanonicalKey(ctx, urlDoc.CanonicalKey, urlDoc.OwnerID)
+		if findErr != nil {
+			return nil, findErr
+		}
+		if existing != nil {
+			return existing, nil
+		}
+	}
+	if urlDoc.Alias != "" {
+		return nil, ErrAliasTaken
+	}
+	return nil, err
+}
+
+// BulkLink is one row of a bulk shorten
+type BulkLink struct {
+	LongURL string
+	Options LinkOptions
+}
+
+// BulkResult is the outcome of one row of a bulk shorten, either the new or existing link or the error the row failed with
+type BulkResult struct {
+	URL *URL
+	Err error
+}
+
+// bulkBatch tracks the rows of a bulk shorten between prepareURLs and the insert
+type bulkBatch struct {
+	results []BulkResult
+	// pending lists the rows holding a new document to insert
+	pending []int
+	// copies maps a row to an earlier row of the batch for the same plain link, whose result it shares
+	copies map[int]int
+	// firstID is the ID reserved for the first pending row, the others follow in order
+	firstID int64
+}
+
+// prepareURLs validates every row like prepareURL, without failing the batch on a bad row.
+// Rows repeating a plain link or alias of an earlier row share its link or fail with ErrAliasTaken,
+// and the IDs of all new documents are reserved with a single call to reserveIDs.
+func prepareURLs(ctx context.Context, repo URLRepository, reserveIDs func(ctx context.Context, counterName string, n int64) (int64, error), links []BulkLink) (*bulkBatch, error) {
+	batch := &bulkBatch{
+		results: make([]BulkResult, len(links)),
+		copies:  make(map[int]int),
+	}
+	aliases := make(map[string]bool)
+	canonicalKeys := make(map[[2]string]int)
+	for row, link := range links {
+		urlDoc, existing, err := checkURL(ctx, repo, link.LongURL, link.Options)
+		if err != nil {
+			batch.results[row].Err = err
+			continue
+		}
+		batch.results[row].URL = urlDoc
+		if existing {
+			continue
+		}
+		if urlDoc.Alias != "" {
+			if aliases[urlDoc.Alias] {
+				batch.results[row] = BulkResult{Err: ErrAliasTaken}
+				continue
+			}
+			aliases[urlDoc.Alias] = true
+		}
+		if urlDoc.CanonicalKey != "" {
+			key := [2]string{urlDoc.CanonicalKey, urlDoc.OwnerID}
+			if first, ok := canonicalKeys[key]; ok {
+				batch.copies[row] = first
+				continue
+			}
+			canonicalKeys[key] = row
+		}
+		batch.pending = append(batch.pending, row)
+	}
+	if len(batch.pending) == 0 {
+		return batch, nil
+	}
+
+	first, err := reserveIDs(ctx, "url_counter", int64(len(batch.pending)))
+	if err != nil {
+		return nil, err
+	}
+	batch.firstID = first
+	for n, row := range batch.pending {
+		batch.results[row].URL.ID = first + int64(n)
+	}
+	return batch, nil
+}
+
+// docs returns the new documents to insert, in the order of pending
+func (b *bulkBatch) docs() []*URL {
+	docs := make([]*URL, len(b.pending))
+	for n, row := range b.pending {
+		docs[n] = b.results[row].URL
+	}
+	return docs
+}
+
+// fail records the insert error of a pending row. Duplicate key errors are settled with resolveDuplicate.
+func (b *bulkBatch) fail(ctx context.Context, repo URLRepository, row int, err error, duplicate bool) {
+	if duplicate {
+		urlDoc, err := resolveDuplicate(ctx, repo, b.results[row].URL, err)
+		b.results[row] = BulkResult{URL: urlDoc, Err: err}
+		return
+	}
+	b.results[row] = BulkResult{Err: err}
+}
+
+// finish fills in the rows that share the link of an earlier row and returns the results.
+// Pending rows still holding the ID reserved for them are the links the batch created.
+func (b *bulkBatch) finish() []BulkResult {
+	created := 0
+	for n, row := range b.pending {
+		if result := b.results[row]; result.Err == nil && result.URL.ID == b.firstID+int64(n) {
+			created++
+		}
+	}
+	metrics.LinksCreated.WithLabelValues("bulk").Add(float64(created))
+	for row, first := range b.copies {
+		b.results[row] = b.results[first]
+	}
+	return b.results
+}
@@ -0,0 +1,720 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"gochop-it/internal/metrics"
+	"gochop-it/internal/utils"
+)
+
+// backends returns a fresh instance of every non-Mongo backend, which run without external services
+func backends(t *testing.T) map[string]URLRepository {
+	sqliteRepo, err := NewSQLiteRepo(context.TODO(), filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite repo: %v", err)
+	}
+	t.Cleanup(func() { _ = sqliteRepo.Close(context.TODO()) })
+	if err := sqliteRepo.EnsureIndexes(context.TODO()); err != nil {
+		t.Fatalf("Failed to create SQLite indexes: %v", err)
+	}
+
+	return map[string]URLRepository{
+		BackendMemory: NewMemoryRepo(),
+		BackendSQLite: sqliteRepo,
+	}
+}
+
+// TestRepositorySaveAndFind checks every backend saves, dedupes and looks up links the same way
+func TestRepositorySaveAndFind(t *testing.T) {
+	for name, repo := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+
+			first, err := repo.SaveURL(ctx, "https://example.com/a", LinkOptions{})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			if first.ID != 1 {
+				t.Errorf("Expected first ID 1, got %d", first.ID)
+			}
+
+			// Plain links are deduped
+			again, err := repo.SaveURL(ctx, "https://example.com/a", LinkOptions{})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			if again.ID != first.ID {
+				t.Errorf("Expected duplicate to reuse ID %d, got %d", first.ID, again.ID)
+			}
+
+			// Aliased links get their own document
+			aliased, err := repo.SaveURL(ctx, "https://example.com/a", LinkOptions{Alias: "launch2026"})
+			if err != nil {
+				t.Fatalf("Failed to save aliased URL: %v", err)
+			}
+			if aliased.ID == first.ID {
+				t.Errorf("Expected aliased link to get a new ID")
+			}
+			if _, err := repo.SaveURL(ctx, "https://example.com/b", LinkOptions{Alias: "launch2026"}); !errors.Is(err, ErrAliasTaken) {
+				t.Errorf("Expected ErrAliasTaken, got %v", err)
+			}
+
+			found, err := FindURLByShortCode(ctx, repo, "launch2026")
+			if err != nil {
+				t.Fatalf("Failed to find alias: %v", err)
+			}
+			if found.ID != aliased.ID {
+				t.Errorf("Expected alias to resolve to ID %d, got %d", aliased.ID, found.ID)
+			}
+
+			found, err = FindURLByShortCode(ctx, repo, first.ShortCode())
+			if err != nil {
+				t.Fatalf("Failed to find short code: %v", err)
+			}
+			if found.LongURL != "https://example.com/a" {
+				t.Errorf("Unexpected long URL %s", found.LongURL)
+			}
+
+			if _, err := repo.FindURLByID(ctx, 999); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+// TestRepositoryOwners checks per-owner dedupe, listing and API keys on every backend
+func TestRepositoryOwners(t *testing.T) {
+	for name, repo := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+
+			anonymous, err := repo.SaveURL(ctx, "https://example.com/a", LinkOptions{})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			teamA, err := repo.SaveURL(ctx, "https://example.com/a", LinkOptions{OwnerID: "team-a"})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			teamB, err := repo.SaveURL(ctx, "https://example.com/a", LinkOptions{OwnerID: "team-b"})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			if anonymous.ID == teamA.ID || teamA.ID == teamB.ID {
+				t.Errorf("Expected each owner to get their own link, got IDs %d, %d, %d", anonymous.ID, teamA.ID, teamB.ID)
+			}
+			again, err := repo.SaveURL(ctx, "https://example.com/a", LinkOptions{OwnerID: "team-a"})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			if again.ID != teamA.ID || again.OwnerID != "team-a" {
+				t.Errorf("Expected duplicate to reuse team-a's link %d, got %+v", teamA.ID, again)
+			}
+
+			second, err := repo.SaveURL(ctx, "https://example.com/b", LinkOptions{OwnerID: "team-a"})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			page, err := repo.ListURLsByOwner(ctx, "team-a", 0, 1)
+			if err != nil {
+				t.Fatalf("Failed to list URLs: %v", err)
+			}
+			if len(page) != 1 || page[0].ID != second.ID {
+				t.Fatalf("Expected newest link first, got %+v", page)
+			}
+			page, err = repo.ListURLsByOwner(ctx, "team-a", page[0].ID, 10)
+			if err != nil {
+				t.Fatalf("Failed to list URLs: %v", err)
+			}
+			if len(page) != 1 || page[0].ID != teamA.ID {
+				t.Errorf("Expected second page to hold link %d, got %+v", teamA.ID, page)
+			}
+
+			_, key, err := NewAPIKey("team-a", "ci", "")
+			if err != nil {
+				t.Fatalf("Failed to generate API key: %v", err)
+			}
+			if err := repo.CreateAPIKey(ctx, key); err != nil {
+				t.Fatalf("Failed to save API key: %v", err)
+			}
+			found, err := repo.FindAPIKey(ctx, key.Hash)
+			if err != nil {
+				t.Fatalf("Failed to find API key: %v", err)
+			}
+			if found.OwnerID != "team-a" || found.Name != "ci" {
+				t.Errorf("Unexpected API key %+v", found)
+			}
+			if _, err := repo.FindAPIKey(ctx, HashAPIKey("sc_unknown")); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+// TestRepositoryCanonicalDedupe checks equivalent spellings of a URL share one link on every backend
+func TestRepositoryCanonicalDedupe(t *testing.T) {
+	for name, repo := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+
+			first, err := repo.SaveURL(ctx, "https://Example.com", LinkOptions{})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			for _, longURL := range []string{"https://example.com/", "https://EXAMPLE.com:443", "https://example.com/a/.."} {
+				again, err := repo.SaveURL(ctx, longURL, LinkOptions{})
+				if err != nil {
+					t.Fatalf("Failed to save URL: %v", err)
+				}
+				if again.ID != first.ID {
+					t.Errorf("Expected %s to reuse ID %d, got %d", longURL, first.ID, again.ID)
+				}
+			}
+			// The link still redirects to the URL as first given
+			if first.LongURL != "https://Example.com/" {
+				t.Errorf("Expected the original URL to be kept, got %s", first.LongURL)
+			}
+
+			other, err := repo.SaveURL(ctx, "https://example.com/?utm_source=x", LinkOptions{})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			if other.ID == first.ID {
+				t.Errorf("Expected tracking parameters to be kept unless stripping is enabled")
+			}
+
+			// Deleted links no longer take part in dedupe
+			if err := repo.DeleteURL(ctx, first.ID); err != nil {
+				t.Fatalf("Failed to delete URL: %v", err)
+			}
+			fresh, err := repo.SaveURL(ctx, "https://example.com/", LinkOptions{})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			if fresh.ID == first.ID {
+				t.Errorf("Expected a new link after deleting the old one")
+			}
+		})
+	}
+}
+
+// TestRepositoryFragmentDedupe checks pages of a single page app told apart by their fragment get separate links
+func TestRepositoryFragmentDedupe(t *testing.T) {
+	for name, repo := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+
+			settings, err := repo.SaveURL(ctx, "https://app.example.com/#/settings", LinkOptions{})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			billing, err := repo.SaveURL(ctx, "https://app.example.com/#/billing", LinkOptions{})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			if billing.ID == settings.ID {
+				t.Errorf("Expected #/billing to get its own link")
+			}
+			again, err := repo.SaveURL(ctx, "https://APP.example.com/#/settings", LinkOptions{})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			if again.ID != settings.ID {
+				t.Errorf("Expected #/settings to reuse ID %d, got %d", settings.ID, again.ID)
+			}
+		})
+	}
+}
+
+// TestRepositoryConcurrentSave checks parallel saves of one URL or alias settle on a single link on every backend
+func TestRepositoryConcurrentSave(t *testing.T) {
+	const workers = 16
+	for name, repo := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+
+			var wg sync.WaitGroup
+			codes := make([]string, workers)
+			errs := make([]error, workers)
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					// Alternate between two spellings of the same URL
+					longURL := "https://example.com/race"
+					if i%2 == 1 {
+						longURL = "https://EXAMPLE.com:443/race"
+					}
+					urlDoc, err := repo.SaveURL(ctx, longURL, LinkOptions{})
+					if err != nil {
+						errs[i] = err
+						return
+					}
+					codes[i] = urlDoc.ShortCode()
+				}(i)
+			}
+			wg.Wait()
+			for i := 0; i < workers; i++ {
+				if errs[i] != nil {
+					t.Fatalf("Failed to save URL: %v", errs[i])
+				}
+				if codes[i] != codes[0] {
+					t.Errorf("Expected every save to return %s, got %s", codes[0], codes[i])
+				}
+			}
+
+			var taken atomic.Int32
+			var saved atomic.Int32
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, err := repo.SaveURL(ctx, fmt.Sprintf("https://example.com/alias/%d", i), LinkOptions{Alias: "race"})
+					switch {
+					case err == nil:
+						saved.Add(1)
+					case errors.Is(err, ErrAliasTaken):
+						taken.Add(1)
+					default:
+						t.Errorf("Failed to save URL: %v", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			if saved.Load() != 1 || taken.Load() != workers-1 {
+				t.Errorf("Expected one save to claim the alias, got %d saved and %d taken", saved.Load(), taken.Load())
+			}
+		})
+	}
+}
+
+// TestRepositorySaveURLs checks bulk saves report each row on its own on every backend
+func TestRepositorySaveURLs(t *testing.T) {
+	for name, repo := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+
+			existing, err := repo.SaveURL(ctx, "https://example.com/existing", LinkOptions{})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			if _, err := repo.SaveURL(ctx, "https://example.com/taken", LinkOptions{Alias: "taken"}); err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+
+			created := testutil.ToFloat64(metrics.LinksCreated.WithLabelValues("bulk"))
+			results, err := repo.SaveURLs(ctx, []BulkLink{
+				{LongURL: "https://example.com/a"},
+				{LongURL: "https://EXAMPLE.com/existing"},
+				{LongURL: "not a url"},
+				{LongURL: "https://example.com:443/a"},
+				{LongURL: "https://example.com/b", Options: LinkOptions{Alias: "spring-sale"}},
+				{LongURL: "https://example.com/c", Options: LinkOptions{Alias: "spring-sale"}},
+				{LongURL: "https://example.com/d", Options: LinkOptions{Alias: "taken"}},
+				{LongURL: "https://example.com/e"},
+			})
+			if err != nil {
+				t.Fatalf("Failed to save URLs: %v", err)
+			}
+			if len(results) != 8 {
+				t.Fatalf("Expected 8 results, got %d", len(results))
+			}
+
+			var urlErr *utils.URLError
+			if !errors.As(results[2].Err, &urlErr) {
+				t.Errorf("Expected an invalid URL error, got %v", results[2].Err)
+			}
+			for _, row := range []int{5, 6} {
+				if !errors.Is(results[row].Err, ErrAliasTaken) {
+					t.Errorf("Expected row %d to fail with ErrAliasTaken, got %v", row, results[row].Err)
+				}
+			}
+			for _, row := range []int{0, 1, 3, 4, 7} {
+				if results[row].Err != nil {
+					t.Fatalf("Expected row %d to be saved, got %v", row, results[row].Err)
+				}
+			}
+			if got := testutil.ToFloat64(metrics.LinksCreated.WithLabelValues("bulk")) - created; got != 3 {
+				t.Errorf("Expected 3 links counted as created, got %v", got)
+			}
+			if results[1].URL.ID != existing.ID {
+				t.Errorf("Expected the existing link %d, got %d", existing.ID, results[1].URL.ID)
+			}
+			if results[3].URL.ID != results[0].URL.ID {
+				t.Errorf("Expected repeated rows to share a link, got %d and %d", results[0].URL.ID, results[3].URL.ID)
+			}
+			// The new links take one consecutive block of IDs
+			if results[4].URL.ID != results[0].URL.ID+1 || results[7].URL.ID != results[0].URL.ID+2 {
+				t.Errorf("Expected consecutive IDs, got %d, %d and %d", results[0].URL.ID, results[4].URL.ID, results[7].URL.ID)
+			}
+			for _, row := range []int{0, 4, 7} {
+				found, err := FindURLByShortCode(ctx, repo, results[row].URL.ShortCode())
+				if err != nil {
+					t.Fatalf("Failed to find row %d: %v", row, err)
+				}
+				if found.LongURL != results[row].URL.LongURL {
+					t.Errorf("Expected %s, got %s", results[row].URL.LongURL, found.LongURL)
+				}
+			}
+
+			next, err := repo.SaveURL(ctx, "https://example.com/f", LinkOptions{})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			if next.ID != results[7].URL.ID+1 {
+				t.Errorf("Expected the counter to continue after the block, got %d", next.ID)
+			}
+		})
+	}
+}
+
+// TestRepositoryDisableAndTop checks operators can disable links and list the most clicked ones on every backend
+func TestRepositoryDisableAndTop(t *testing.T) {
+	for name, repo := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+
+			var ids []int64
+			for i, longURL := range []string{"https://example.com/a", "https://example.com/b", "https://example.com/c"} {
+				urlDoc, err := repo.SaveURL(ctx, longURL, LinkOptions{})
+				if err != nil {
+					t.Fatalf("Failed to save URL: %v", err)
+				}
+				ids = append(ids, urlDoc.ID)
+				if err := repo.IncrementAccessCounts(ctx, map[int64]int{urlDoc.ID: i * 10}); err != nil {
+					t.Fatalf("Failed to count clicks: %v", err)
+				}
+			}
+
+			disabled, err := repo.SetDisabled(ctx, ids[0], true)
+			if err != nil || !disabled.Disabled() {
+				t.Fatalf("Expected the link to be disabled, got %+v, %v", disabled, err)
+			}
+			// A disabled link is still the one returned for its URL
+			again, err := repo.SaveURL(ctx, "https://example.com/a", LinkOptions{})
+			if err != nil || again.ID != ids[0] || !again.Disabled() {
+				t.Errorf("Expected the disabled link, got %+v, %v", again, err)
+			}
+			enabled, err := repo.SetDisabled(ctx, ids[0], false)
+			if err != nil || enabled.Disabled() {
+				t.Errorf("Expected the link to be enabled, got %+v, %v", enabled, err)
+			}
+			if _, err := repo.SetDisabled(ctx, 999, true); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+
+			if err := repo.DeleteURL(ctx, ids[2]); err != nil {
+				t.Fatalf("Failed to delete URL: %v", err)
+			}
+			top, err := repo.TopURLs(ctx, 5)
+			if err != nil {
+				t.Fatalf("Failed to list top links: %v", err)
+			}
+			if len(top) != 2 || top[0].ID != ids[1] || top[1].ID != ids[0] {
+				t.Errorf("Expected the live links by clicks, got %+v", top)
+			}
+		})
+	}
+}
+
+// TestSQLiteBackfillCanonicalKeys checks links saved before canonical keys are given theirs when the index is created
+func TestSQLiteBackfillCanonicalKeys(t *testing.T) {
+	ctx := context.TODO()
+	repo, err := NewSQLiteRepo(ctx, filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite repo: %v", err)
+	}
+	defer repo.Close(ctx)
+
+	// Rows written by an older version, two of them equivalent
+	for id, longURL := range map[int64]string{1: "https://example.com/a", 2: "https://EXAMPLE.com/a", 3: "https://example.com/b"} {
+		_, err := repo.DB.ExecContext(ctx, `INSERT INTO urls (id, created_at, long_url) VALUES (?, ?, ?)`, id, time.Now().UnixMilli(), longURL)
+		if err != nil {
+			t.Fatalf("Failed to insert URL: %v", err)
+		}
+	}
+	if err := repo.EnsureIndexes(ctx); err != nil {
+		t.Fatalf("Failed to create indexes: %v", err)
+	}
+
+	for longURL, wantID := range map[string]int64{"https://example.com/a": 1, "https://example.com/b": 3} {
+		urlDoc, err := repo.SaveURL(ctx, longURL, LinkOptions{})
+		if err != nil {
+			t.Fatalf("Failed to save URL: %v", err)
+		}
+		if urlDoc.ID != wantID {
+			t.Errorf("Expected %s to be deduped onto ID %d, got %d", longURL, wantID, urlDoc.ID)
+		}
+	}
+}
+
+// TestRepositoryImportAliasTaken checks an import can't give a link an alias another link holds on every backend
+func TestRepositoryImportAliasTaken(t *testing.T) {
+	for name, repo := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+			now := time.Now()
+
+			if err := repo.ImportURLs(ctx, []*URL{{ID: 1, CreatedAt: now, LongURL: "https://example.com/a", Alias: "launch2026"}}); err != nil {
+				t.Fatalf("Failed to import: %v", err)
+			}
+			err := repo.ImportURLs(ctx, []*URL{{ID: 2, CreatedAt: now, LongURL: "https://example.com/b", Alias: "launch2026"}})
+			if !errors.Is(err, ErrAliasTaken) {
+				t.Fatalf("Expected ErrAliasTaken, got %v", err)
+			}
+			if _, err := repo.FindURLByID(ctx, 2); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected the conflicting link not to be stored, got %v", err)
+			}
+
+			// Replacing the link holding the alias, or moving the alias in the same batch, is fine
+			err = repo.ImportURLs(ctx, []*URL{
+				{ID: 1, CreatedAt: now, LongURL: "https://example.com/c"},
+				{ID: 2, CreatedAt: now, LongURL: "https://example.com/b", Alias: "launch2026"},
+			})
+			if err != nil {
+				t.Fatalf("Failed to import: %v", err)
+			}
+			urlDoc, err := repo.FindURLByAlias(ctx, "launch2026")
+			if err != nil || urlDoc == nil || urlDoc.ID != 2 {
+				t.Errorf("Expected the alias to move to link 2, got %+v, %v", urlDoc, err)
+			}
+		})
+	}
+}
+
+// TestRepositoryImportCanonicalKeyTaken checks an import can't give an owner two plain links for the same URL on every backend
+func TestRepositoryImportCanonicalKeyTaken(t *testing.T) {
+	for name, repo := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+			now := time.Now()
+			key := "https://example.com/a"
+
+			if err := repo.ImportURLs(ctx, []*URL{{ID: 1, CreatedAt: now, LongURL: key, CanonicalKey: key, OwnerID: "team-a"}}); err != nil {
+				t.Fatalf("Failed to import: %v", err)
+			}
+			err := repo.ImportURLs(ctx, []*URL{{ID: 2, CreatedAt: now, LongURL: key, CanonicalKey: key, OwnerID: "team-a"}})
+			if !errors.Is(err, ErrCanonicalKeyTaken) || !strings.Contains(err.Error(), "link 2") {
+				t.Fatalf("Expected ErrCanonicalKeyTaken for link 2, got %v", err)
+			}
+			if _, err := repo.FindURLByID(ctx, 2); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected the conflicting link not to be stored, got %v", err)
+			}
+
+			// Another owner may have the same URL, and replacing the link holding the key frees it
+			err = repo.ImportURLs(ctx, []*URL{
+				{ID: 3, CreatedAt: now, LongURL: key, CanonicalKey: key, OwnerID: "team-b"},
+				{ID: 1, CreatedAt: now, LongURL: "https://example.com/c", OwnerID: "team-a"},
+				{ID: 2, CreatedAt: now, LongURL: key, CanonicalKey: key, OwnerID: "team-a"},
+			})
+			if err != nil {
+				t.Fatalf("Failed to import: %v", err)
+			}
+			urlDoc, err := repo.FindURLByCanonicalKey(ctx, key, "team-a")
+			if err != nil || urlDoc == nil || urlDoc.ID != 2 {
+				t.Errorf("Expected the canonical key to move to link 2, got %+v, %v", urlDoc, err)
+			}
+		})
+	}
+}
+
+// TestRepositoryUpdateAndDelete checks editing and soft deleting links on every backend
+func TestRepositoryUpdateAndDelete(t *testing.T) {
+	for name, repo := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+			expiresAt := time.Now().Add(time.Hour)
+
+			urlDoc, err := repo.SaveURL(ctx, "https://example.com/a", LinkOptions{OwnerID: "team-a"})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+
+			updated, err := repo.UpdateURL(ctx, urlDoc.ID, LinkUpdate{LongURL: "https://example.com/b", SetExpiry: true, ExpiresAt: &expiresAt})
+			if err != nil {
+				t.Fatalf("Failed to update URL: %v", err)
+			}
+			if updated.LongURL != "https://example.com/b" || updated.ExpiresAt == nil || updated.OwnerID != "team-a" {
+				t.Errorf("Unexpected updated URL %+v", updated)
+			}
+			updated, err = repo.UpdateURL(ctx, urlDoc.ID, LinkUpdate{SetExpiry: true})
+			if err != nil {
+				t.Fatalf("Failed to clear expiry: %v", err)
+			}
+			if updated.ExpiresAt != nil || updated.LongURL != "https://example.com/b" {
+				t.Errorf("Expected only the expiry to be cleared, got %+v", updated)
+			}
+			var urlErr *utils.URLError
+			if _, err := repo.UpdateURL(ctx, urlDoc.ID, LinkUpdate{LongURL: "ftp://example.com"}); !errors.As(err, &urlErr) {
+				t.Errorf("Expected URLError, got %v", err)
+			}
+
+			if err := repo.DeleteURL(ctx, urlDoc.ID); err != nil {
+				t.Fatalf("Failed to delete URL: %v", err)
+			}
+			// Deleted links are still found so redirects can answer 410, but can't be changed again
+			found, err := repo.FindURLByID(ctx, urlDoc.ID)
+			if err != nil {
+				t.Fatalf("Failed to find deleted URL: %v", err)
+			}
+			if !found.Deleted() {
+				t.Errorf("Expected link to be marked deleted")
+			}
+			if err := repo.DeleteURL(ctx, urlDoc.ID); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound deleting twice, got %v", err)
+			}
+			if _, err := repo.UpdateURL(ctx, urlDoc.ID, LinkUpdate{LongURL: "https://example.com/c"}); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound updating a deleted link, got %v", err)
+			}
+
+			// Deleted links are neither reused by dedupe nor listed
+			again, err := repo.SaveURL(ctx, "https://example.com/b", LinkOptions{OwnerID: "team-a"})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			if again.ID == urlDoc.ID {
+				t.Errorf("Expected a new link after deleting the old one")
+			}
+			links, err := repo.ListURLsByOwner(ctx, "team-a", 0, 10)
+			if err != nil {
+				t.Fatalf("Failed to list URLs: %v", err)
+			}
+			if len(links) != 1 || links[0].ID != again.ID {
+				t.Errorf("Expected only the new link to be listed, got %+v", links)
+			}
+		})
+	}
+}
+
+// TestRepositoryClicks checks access counting and click limits on every backend
+func TestRepositoryClicks(t *testing.T) {
+	for name, repo := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+			expiresAt := time.Now().Add(time.Hour)
+
+			urlDoc, err := repo.SaveURL(ctx, "https://example.com", LinkOptions{MaxClicks: 2, ExpiresAt: &expiresAt})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+
+			for i := 0; i < 2; i++ {
+				if err := repo.ConsumeClick(ctx, urlDoc.ID); err != nil {
+					t.Fatalf("Click %d: unexpected error %v", i+1, err)
+				}
+			}
+			if err := repo.ConsumeClick(ctx, urlDoc.ID); !errors.Is(err, ErrLinkExpired) {
+				t.Errorf("Expected ErrLinkExpired, got %v", err)
+			}
+
+			if err := repo.IncrementAccessCount(ctx, urlDoc.ID); err != nil {
+				t.Fatalf("Failed to increment access count: %v", err)
+			}
+			found, err := repo.FindURLByID(ctx, urlDoc.ID)
+			if err != nil {
+				t.Fatalf("Failed to find URL: %v", err)
+			}
+			if found.AccessCount != 3 {
+				t.Errorf("Expected access count 3, got %d", found.AccessCount)
+			}
+			// Used up links keep their expiry, so the TTL index doesn't purge them and they keep answering 410 Gone
+			if found.ExpiresAt == nil || found.ExpiresAt.UnixMilli() != expiresAt.UnixMilli() {
+				t.Errorf("Expected expiry %v, got %v", expiresAt, found.ExpiresAt)
+			}
+		})
+	}
+}
+
+// TestRepositoryClickStats checks click events are bucketed and ranked the same way on every backend
+func TestRepositoryClickStats(t *testing.T) {
+	for name, repo := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.TODO()
+			day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+			events := []ClickEvent{
+				{LinkID: 1, Timestamp: day.Add(10 * time.Minute), Referrer: "a.example.com", UserAgent: "mobile", Country: "AU"},
+				{LinkID: 1, Timestamp: day.Add(20 * time.Minute), Referrer: "b.example.com", UserAgent: "desktop", Country: "AU"},
+				{LinkID: 1, Timestamp: day.Add(90 * time.Minute), Referrer: "b.example.com", UserAgent: "desktop"},
+				{LinkID: 2, Timestamp: day.Add(30 * time.Minute), Referrer: "c.example.com", UserAgent: "bot"},
+				{LinkID: 1, Timestamp: day.Add(-time.Hour), Referrer: "old.example.com", UserAgent: "bot"},
+			}
+			if err := repo.RecordClicks(ctx, events); err != nil {
+				t.Fatalf("Failed to record clicks: %v", err)
+			}
+
+			stats, err := repo.ClickStats(ctx, 1, day, time.Hour)
+			if err != nil {
+				t.Fatalf("Failed to load click stats: %v", err)
+			}
+
+			expectedBuckets := []ClickBucket{{Start: day, Count: 2}, {Start: day.Add(time.Hour), Count: 1}}
+			if len(stats.Buckets) != len(expectedBuckets) {
+				t.Fatalf("Expected %d buckets, got %+v", len(expectedBuckets), stats.Buckets)
+			}
+			for i, b := range expectedBuckets {
+				if !stats.Buckets[i].Start.Equal(b.Start) || stats.Buckets[i].Count != b.Count {
+					t.Errorf("Bucket %d: expected %+v, got %+v", i, b, stats.Buckets[i])
+				}
+			}
+			if len(stats.TopReferrers) != 2 || stats.TopReferrers[0] != (ClickCount{Value: "b.example.com", Count: 2}) {
+				t.Errorf("Unexpected referrers: %+v", stats.TopReferrers)
+			}
+			if len(stats.Countries) != 1 || stats.Countries[0] != (ClickCount{Value: "AU", Count: 2}) {
+				t.Errorf("Unexpected countries: %+v", stats.Countries)
+			}
+		})
+	}
+}
+
+// TestFindURLByShortCodeObfuscated checks links resolve through an obfuscating codec, including legacy codes
+func TestFindURLByShortCodeObfuscated(t *testing.T) {
+	ctx := context.TODO()
+	repo := NewMemoryRepo()
+
+	// Link created before obfuscation was enabled
+	legacy, err := repo.SaveURL(ctx, "https://example.com/old", LinkOptions{})
+	if err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+	legacyCode := legacy.ShortCode()
+
+	codec, err := utils.NewShortCodec("test-secret", 6, legacy.ID)
+	if err != nil {
+		t.Fatalf("Failed to create codec: %v", err)
+	}
+	utils.SetShortCodec(codec)
+	t.Cleanup(func() { utils.SetShortCodec(nil) })
+
+	fresh, err := repo.SaveURL(ctx, "https://example.com/new", LinkOptions{})
+	if err != nil {
+		t.Fatalf("Failed to save URL: %v", err)
+	}
+	if code := fresh.ShortCode(); len(code) < 6 || code == utils.Encode(fresh.ID) {
+		t.Errorf("Expected an obfuscated code, got %s", code)
+	}
+
+	for code, expected := range map[string]int64{legacyCode: legacy.ID, fresh.ShortCode(): fresh.ID} {
+		found, err := FindURLByShortCode(ctx, repo, code)
+		if err != nil {
+			t.Fatalf("Failed to resolve %s: %v", code, err)
+		}
+		if found.ID != expected {
+			t.Errorf("Expected %s to resolve to ID %d, got %d", code, expected, found.ID)
+		}
+	}
+
+	// The plain code for the new link no longer resolves
+	if _, err := FindURLByShortCode(ctx, repo, utils.Encode(fresh.ID)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for the plain code, got %v", err)
+	}
+}
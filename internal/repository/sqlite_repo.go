@@ -0,0 +1,719 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"gochop-it/internal/logging"
+	"gochop-it/internal/metrics"
+	"gochop-it/internal/utils"
+
+	// Pure Go SQLite driver, so the binary stays CGO free
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteRepo stores links in a SQLite database for deployments without MongoDB
+type SQLiteRepo struct {
+	DB *sql.DB
+	// IDs leases blocks of IDs for new links, when nil every ID is taken from the counter
+	IDs *IDAllocator
+}
+
+var _ URLRepository = (*SQLiteRepo)(nil)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS urls (
+	id            INTEGER PRIMARY KEY,
+	created_at    INTEGER NOT NULL,
+	long_url      TEXT    NOT NULL,
+	access_count  INTEGER NOT NULL DEFAULT 0,
+	alias         TEXT,
+	expires_at    INTEGER,
+	max_clicks    INTEGER NOT NULL DEFAULT 0,
+	owner_id      TEXT,
+	deleted_at    INTEGER,
+	canonical_key TEXT,
+	disabled_at   INTEGER
+);
+CREATE TABLE IF NOT EXISTS counters (
+	name TEXT PRIMARY KEY,
+	seq  INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS clicks (
+	link_id    INTEGER NOT NULL,
+	timestamp  INTEGER NOT NULL,
+	referrer   TEXT    NOT NULL,
+	user_agent TEXT    NOT NULL,
+	ip_hash    TEXT    NOT NULL,
+	country    TEXT    NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS api_keys (
+	hash       TEXT    PRIMARY KEY,
+	owner_id   TEXT    NOT NULL,
+	name       TEXT    NOT NULL,
+	tier       TEXT    NOT NULL DEFAULT '',
+	created_at INTEGER NOT NULL
+);`
+
+// urlColumns is the column list matching scanURL
+const urlColumns = `id, created_at, long_url, access_count, alias, expires_at, max_clicks, owner_id, deleted_at, canonical_key, disabled_at`
+
+// NewSQLiteRepo opens the SQLite database at path and creates the schema if needed
+func NewSQLiteRepo(ctx context.Context, path string) (*SQLiteRepo, error) {
+	if path == "" {
+		path = "smallchop.db"
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, serialise access rather than hit SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create SQLite schema: %w", err)
+	}
+	// Databases created by older versions lack the newer columns
+	migrations := []struct{ table, column, definition string }{
+		{"urls", "owner_id", "TEXT"},
+		{"urls", "deleted_at", "INTEGER"},
+		{"urls", "canonical_key", "TEXT"},
+		{"urls", "disabled_at", "INTEGER"},
+		{"api_keys", "tier", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, m := range migrations {
+		if err := addColumnIfMissing(ctx, db, m.table, m.column, m.definition); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("failed to migrate SQLite schema: %w", err)
+		}
+	}
+
+	slog.InfoContext(ctx, "Connected to SQLite database", "path", path)
+	return &SQLiteRepo{DB: db}, nil
+}
+
+// SaveURL stores a new link or returns the existing document for a duplicate plain link
+func (repo *SQLiteRepo) SaveURL(ctx context.Context, longURL string, opts LinkOptions) (*URL, error) {
+	urlDoc, existing, err := prepareURL(ctx, repo, repo.GetNextID, longURL, opts)
+	if err != nil || existing {
+		return urlDoc, err
+	}
+
+	_, err = repo.DB.ExecContext(ctx, insertURL, urlArgs(urlDoc)...)
+	if isUniqueViolation(err) {
+		// A concurrent save of the same link or alias won the race after the lookups in prepareURL
+		return resolveDuplicate(ctx, repo, urlDoc, err)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to save link", "error", err)
+		return nil, err
+	}
+
+	metrics.LinksCreated.WithLabelValues("single").Inc()
+	slog.DebugContext(ctx, "Saved new link", "code", urlDoc.ShortCode(), "url", logging.RedactURL(urlDoc.LongURL))
+	return urlDoc, nil
+}
+
+// SaveURLs saves a batch of links in a single transaction. A row that fails, such as one losing
+// a race on a unique index, only rolls back its own statement, so the other rows are still saved.
+func (repo *SQLiteRepo) SaveURLs(ctx context.Context, links []BulkLink) ([]BulkResult, error) {
+	batch, err := prepareURLs(ctx, repo, repo.ReserveIDs, links)
+	if err != nil {
+		return nil, err
+	}
+	if len(batch.pending) == 0 {
+		return batch.finish(), nil
+	}
+
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, insertURL)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	failed := make(map[int]error)
+	for n, urlDoc := range batch.docs() {
+		if _, err := stmt.ExecContext(ctx, urlArgs(urlDoc)...); err != nil {
+			failed[batch.pending[n]] = err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		slog.ErrorContext(ctx, "Failed to save links in bulk", "error", err)
+		return nil, err
+	}
+	// Duplicates are resolved once the transaction has released the connection
+	for row, err := range failed {
+		batch.fail(ctx, repo, row, err, isUniqueViolation(err))
+	}
+
+	slog.DebugContext(ctx, "Saved new links in bulk", "count", len(batch.pending)-len(failed))
+	return batch.finish(), nil
+}
+
+// FindURLByID searches by id column
+func (repo *SQLiteRepo) FindURLByID(ctx context.Context, id int64) (*URL, error) {
+	urlDoc, err := repo.findOne(ctx, `WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if urlDoc == nil {
+		return nil, ErrNotFound
+	}
+	return urlDoc, nil
+}
+
+// FindURLByCanonicalKey returns the owner's plain link for a canonical URL, or nil if there is none
+func (repo *SQLiteRepo) FindURLByCanonicalKey(ctx context.Context, canonicalKey string, ownerID string) (*URL, error) {
+	return repo.findOne(ctx, `WHERE canonical_key = ? AND IFNULL(owner_id, '') = ?`, canonicalKey, ownerID)
+}
+
+// ListURLsByOwner returns up to limit of the owner's links, newest first, with IDs below beforeID (0 for the first page)
+func (repo *SQLiteRepo) ListURLsByOwner(ctx context.Context, ownerID string, beforeID int64, limit int) ([]*URL, error) {
+	query := `SELECT ` + urlColumns + ` FROM urls WHERE owner_id = ? AND deleted_at IS NULL`
+	args := []any{ownerID}
+	if beforeID > 0 {
+		query += ` AND id < ?`
+		args = append(args, beforeID)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := repo.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	urls := []*URL{}
+	for rows.Next() {
+		urlDoc, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, urlDoc)
+	}
+	return urls, rows.Err()
+}
+
+// CreateAPIKey stores a hashed API key
+func (repo *SQLiteRepo) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	_, err := repo.DB.ExecContext(ctx,
+		`INSERT INTO api_keys (hash, owner_id, name, tier, created_at) VALUES (?, ?, ?, ?, ?)`,
+		key.Hash, key.OwnerID, key.Name, key.Tier, key.CreatedAt.UnixMilli())
+	return err
+}
+
+// FindAPIKey looks up an API key by its hash
+func (repo *SQLiteRepo) FindAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	var (
+		key       APIKey
+		createdAt int64
+	)
+	err := repo.DB.QueryRowContext(ctx,
+		`SELECT hash, owner_id, name, tier, created_at FROM api_keys WHERE hash = ?`, hash,
+	).Scan(&key.Hash, &key.OwnerID, &key.Name, &key.Tier, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	key.CreatedAt = time.UnixMilli(createdAt)
+	return &key, nil
+}
+
+// FindURLByAlias returns the link for a custom alias, or nil if the alias is unused
+func (repo *SQLiteRepo) FindURLByAlias(ctx context.Context, alias string) (*URL, error) {
+	return repo.findOne(ctx, `WHERE alias = ?`, alias)
+}
+
+// findOne returns the first link matching the where clause, or nil if there is none
+func (repo *SQLiteRepo) findOne(ctx context.Context, where string, args ...any) (*URL, error) {
+	row := repo.DB.QueryRowContext(ctx, `SELECT `+urlColumns+` FROM urls `+where+` LIMIT 1`, args...)
+	urlDoc, err := scanURL(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return urlDoc, err
+}
+
+// IncrementAccessCount adds one to the link's access count
+func (repo *SQLiteRepo) IncrementAccessCount(ctx context.Context, id int64) error {
+	_, err := repo.DB.ExecContext(ctx, `UPDATE urls SET access_count = access_count + 1 WHERE id = ?`, id)
+	return err
+}
+
+// IncrementAccessCounts applies a batch of buffered clicks in one transaction
+func (repo *SQLiteRepo) IncrementAccessCounts(ctx context.Context, counts map[int64]int) error {
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, `UPDATE urls SET access_count = access_count + ? WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, n := range counts {
+		if _, err := stmt.ExecContext(ctx, n, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ConsumeClick counts a click on a click limited link, returning ErrLinkExpired once the limit is reached
+func (repo *SQLiteRepo) ConsumeClick(ctx context.Context, id int64) error {
+	res, err := repo.DB.ExecContext(ctx,
+		`UPDATE urls SET access_count = access_count + 1 WHERE id = ? AND access_count < max_clicks`, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLinkExpired
+	}
+	return nil
+}
+
+// UpdateURL changes a link's destination or expiry and returns the updated document
+func (repo *SQLiteRepo) UpdateURL(ctx context.Context, id int64, update LinkUpdate) (*URL, error) {
+	update, err := update.prepare()
+	if err != nil {
+		return nil, err
+	}
+
+	// Edited links drop their canonical key, see LinkUpdate
+	set := []string{`canonical_key = NULL`}
+	var args []any
+	if update.LongURL != "" {
+		set = append(set, `long_url = ?`)
+		args = append(args, update.LongURL)
+	}
+	if update.SetExpiry {
+		set = append(set, `expires_at = ?`)
+		args = append(args, nullTime(update.ExpiresAt))
+	}
+	args = append(args, id)
+
+	res, err := repo.DB.ExecContext(ctx,
+		`UPDATE urls SET `+strings.Join(set, ", ")+` WHERE id = ? AND deleted_at IS NULL`, args...)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+	return repo.FindURLByID(ctx, id)
+}
+
+// DeleteURL soft deletes a link, it keeps its ID and alias but redirects answer 410 Gone
+func (repo *SQLiteRepo) DeleteURL(ctx context.Context, id int64) error {
+	res, err := repo.DB.ExecContext(ctx,
+		`UPDATE urls SET deleted_at = ?, canonical_key = NULL WHERE id = ? AND deleted_at IS NULL`, time.Now().UnixMilli(), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetDisabled disables or re-enables a link and returns the updated row
+func (repo *SQLiteRepo) SetDisabled(ctx context.Context, id int64, disabled bool) (*URL, error) {
+	var disabledAt *time.Time
+	if disabled {
+		now := time.Now()
+		disabledAt = &now
+	}
+	res, err := repo.DB.ExecContext(ctx, `UPDATE urls SET disabled_at = ? WHERE id = ?`, nullTime(disabledAt), id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrNotFound
+	}
+	return repo.FindURLByID(ctx, id)
+}
+
+// TopURLs returns up to limit links with the most clicks, deleted links excluded
+func (repo *SQLiteRepo) TopURLs(ctx context.Context, limit int) ([]*URL, error) {
+	rows, err := repo.DB.QueryContext(ctx,
+		`SELECT `+urlColumns+` FROM urls WHERE deleted_at IS NULL ORDER BY access_count DESC, id LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	urls := []*URL{}
+	for rows.Next() {
+		urlDoc, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, urlDoc)
+	}
+	return urls, rows.Err()
+}
+
+// EachURL calls fn with every link in ID order, stopping at the first error.
+// fn must not use the repository, as the query holds the only connection.
+func (repo *SQLiteRepo) EachURL(ctx context.Context, fn func(urlDoc *URL) error) error {
+	rows, err := repo.DB.QueryContext(ctx, `SELECT `+urlColumns+` FROM urls ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		urlDoc, err := scanURL(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(urlDoc); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ImportURLs stores the links as given in a single transaction, replacing any link with the same ID.
+// An alias or an owner's canonical key held by another link fails the whole batch
+// with ErrAliasTaken or ErrCanonicalKeyTaken.
+func (repo *SQLiteRepo) ImportURLs(ctx context.Context, urls []*URL) error {
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, upsertURL)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, urlDoc := range urls {
+		if _, err := stmt.ExecContext(ctx, urlArgs(urlDoc)...); err != nil {
+			if isUniqueViolation(err) {
+				switch {
+				case strings.Contains(err.Error(), "urls.alias"):
+					err = ErrAliasTaken
+				case strings.Contains(err.Error(), "urls_canonical_key"):
+					err = ErrCanonicalKeyTaken
+				}
+			}
+			return fmt.Errorf("link %d: %w", urlDoc.ID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// EnsureCounter raises the named counter to at least min, so new IDs never reuse an imported one
+func (repo *SQLiteRepo) EnsureCounter(ctx context.Context, counterName string, min int64) error {
+	_, err := repo.DB.ExecContext(ctx,
+		`INSERT INTO counters (name, seq) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET seq = MAX(seq, excluded.seq)`, counterName, min)
+	return err
+}
+
+// GetNextID returns the next ID of the named counter, from the leased block if IDs is set
+func (repo *SQLiteRepo) GetNextID(ctx context.Context, counterName string) (int64, error) {
+	if repo.IDs != nil {
+		return repo.IDs.Next(ctx, counterName)
+	}
+	return repo.ReserveIDs(ctx, counterName, 1)
+}
+
+// ReserveIDs atomically advances the named counter by n and returns the first ID of the reserved block
+func (repo *SQLiteRepo) ReserveIDs(ctx context.Context, counterName string, n int64) (int64, error) {
+	var seq int64
+	err := repo.DB.QueryRowContext(ctx,
+		`INSERT INTO counters (name, seq) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET seq = seq + excluded.seq
+		RETURNING seq`, counterName, n).Scan(&seq)
+	if err != nil {
+		return 0, err
+	}
+	return seq - n + 1, nil
+}
+
+// RecordClicks inserts the click events in a single transaction
+func (repo *SQLiteRepo) RecordClicks(ctx context.Context, events []ClickEvent) error {
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx,
+		`INSERT INTO clicks (link_id, timestamp, referrer, user_agent, ip_hash, country) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, ev := range events {
+		_, err := stmt.ExecContext(ctx, ev.LinkID, ev.Timestamp.UnixMilli(), ev.Referrer, ev.UserAgent, ev.IPHash, ev.Country)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ClickStats aggregates the link's click events since the given time
+func (repo *SQLiteRepo) ClickStats(ctx context.Context, linkID int64, since time.Time, bucket time.Duration) (*ClickStats, error) {
+	stats := &ClickStats{}
+	bucketMillis := bucket.Milliseconds()
+
+	rows, err := repo.DB.QueryContext(ctx,
+		`SELECT (timestamp / ?) * ? AS start, COUNT(*) FROM clicks
+		WHERE link_id = ? AND timestamp >= ?
+		GROUP BY start ORDER BY start`,
+		bucketMillis, bucketMillis, linkID, since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats.Buckets = []ClickBucket{}
+	for rows.Next() {
+		var start int64
+		var b ClickBucket
+		if err := rows.Scan(&start, &b.Count); err != nil {
+			return nil, err
+		}
+		b.Start = time.UnixMilli(start).UTC()
+		stats.Buckets = append(stats.Buckets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if stats.TopReferrers, err = repo.topClicks(ctx, "referrer", linkID, since); err != nil {
+		return nil, err
+	}
+	if stats.Countries, err = repo.topClicks(ctx, "country", linkID, since); err != nil {
+		return nil, err
+	}
+	if stats.UserAgents, err = repo.topClicks(ctx, "user_agent", linkID, since); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// topClicks counts the link's clicks grouped by column, highest count first.
+// column is always one of our own column names, never user input.
+func (repo *SQLiteRepo) topClicks(ctx context.Context, column string, linkID int64, since time.Time) ([]ClickCount, error) {
+	rows, err := repo.DB.QueryContext(ctx,
+		`SELECT `+column+` AS value, COUNT(*) AS n FROM clicks
+		WHERE link_id = ? AND timestamp >= ? AND `+column+` != ''
+		GROUP BY value ORDER BY n DESC, value LIMIT ?`,
+		linkID, since.UnixMilli(), topClickCountLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []ClickCount{}
+	for rows.Next() {
+		var c ClickCount
+		if err := rows.Scan(&c.Value, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// EnsureIndexes creates the lookup indexes used for dedupe, aliases and click stats.
+// The first time the canonical key index is created, links created before canonical keys are given theirs.
+func (repo *SQLiteRepo) EnsureIndexes(ctx context.Context) error {
+	var n int
+	err := repo.DB.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'urls_canonical_key'`).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if err := repo.backfillCanonicalKeys(ctx); err != nil {
+			return fmt.Errorf("failed to backfill canonical keys: %w", err)
+		}
+	}
+
+	_, err = repo.DB.ExecContext(ctx, `
+		DROP INDEX IF EXISTS urls_long_url;
+		CREATE UNIQUE INDEX IF NOT EXISTS urls_canonical_key ON urls (canonical_key, IFNULL(owner_id, ''))
+			WHERE canonical_key IS NOT NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS urls_alias ON urls (alias);
+		CREATE INDEX IF NOT EXISTS urls_owner_id ON urls (owner_id, id);
+		CREATE INDEX IF NOT EXISTS clicks_link_timestamp ON clicks (link_id, timestamp);`)
+	return err
+}
+
+// backfillCanonicalKeys sets the canonical key of plain links that lack one, oldest first.
+// Links equivalent to an older one are left without a key, they still redirect but aren't deduped onto.
+func (repo *SQLiteRepo) backfillCanonicalKeys(ctx context.Context) error {
+	rows, err := repo.DB.QueryContext(ctx, `SELECT id, long_url, IFNULL(owner_id, '') FROM urls
+		WHERE canonical_key IS NULL AND alias IS NULL AND expires_at IS NULL AND max_clicks = 0 AND deleted_at IS NULL
+		ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	keys := make(map[int64]string)
+	seen := make(map[[2]string]bool)
+	for rows.Next() {
+		var (
+			id               int64
+			longURL, ownerID string
+		)
+		if err := rows.Scan(&id, &longURL, &ownerID); err != nil {
+			rows.Close()
+			return err
+		}
+		canonicalKey, err := utils.CanonicalURL(longURL)
+		if err != nil || seen[[2]string{canonicalKey, ownerID}] {
+			continue
+		}
+		seen[[2]string{canonicalKey, ownerID}] = true
+		keys[id] = canonicalKey
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// The single connection is held by rows until they are closed, so the updates run afterwards
+	tx, err := repo.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	for id, canonicalKey := range keys {
+		if _, err := tx.ExecContext(ctx, `UPDATE urls SET canonical_key = ? WHERE id = ?`, canonicalKey, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Ping tests the database connection
+func (repo *SQLiteRepo) Ping(ctx context.Context) error {
+	return repo.DB.PingContext(ctx)
+}
+
+// Close closes the database
+func (repo *SQLiteRepo) Close(ctx context.Context) error {
+	return repo.DB.Close()
+}
+
+// addColumnIfMissing adds a column to an existing table, doing nothing if it is already there
+func addColumnIfMissing(ctx context.Context, db *sql.DB, table, column, definition string) error {
+	var n int
+	err := db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `ALTER TABLE `+table+` ADD COLUMN `+column+` `+definition)
+	return err
+}
+
+// insertURL inserts a link with the arguments from urlArgs
+const insertURL = `INSERT INTO urls (` + urlColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// upsertURL inserts a link with the arguments from urlArgs or replaces the link with the same ID.
+// Unlike INSERT OR REPLACE it never deletes another link that conflicts on the alias or canonical key.
+const upsertURL = insertURL + ` ON CONFLICT (id) DO UPDATE SET
+	created_at = excluded.created_at, long_url = excluded.long_url, access_count = excluded.access_count,
+	alias = excluded.alias, expires_at = excluded.expires_at, max_clicks = excluded.max_clicks,
+	owner_id = excluded.owner_id, deleted_at = excluded.deleted_at, canonical_key = excluded.canonical_key,
+	disabled_at = excluded.disabled_at`
+
+// urlArgs returns the arguments of insertURL for a link
+func urlArgs(urlDoc *URL) []any {
+	return []any{
+		urlDoc.ID, urlDoc.CreatedAt.UnixMilli(), urlDoc.LongURL, urlDoc.AccessCount,
+		nullString(urlDoc.Alias), nullTime(urlDoc.ExpiresAt), urlDoc.MaxClicks, nullString(urlDoc.OwnerID),
+		nullTime(urlDoc.DeletedAt), nullString(urlDoc.CanonicalKey), nullTime(urlDoc.DisabledAt),
+	}
+}
+
+// isUniqueViolation reports whether err is a unique constraint failure
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanURL reads a row selected with urlColumns into a URL document
+func scanURL(row rowScanner) (*URL, error) {
+	var (
+		urlDoc       URL
+		createdAt    int64
+		alias        sql.NullString
+		expiresAt    sql.NullInt64
+		ownerID      sql.NullString
+		deletedAt    sql.NullInt64
+		canonicalKey sql.NullString
+		disabledAt   sql.NullInt64
+	)
+	err := row.Scan(&urlDoc.ID, &createdAt, &urlDoc.LongURL, &urlDoc.AccessCount, &alias, &expiresAt, &urlDoc.MaxClicks, &ownerID, &deletedAt, &canonicalKey, &disabledAt)
+	if err != nil {
+		return nil, err
+	}
+	urlDoc.CreatedAt = time.UnixMilli(createdAt)
+	urlDoc.Alias = alias.String
+	urlDoc.OwnerID = ownerID.String
+	urlDoc.CanonicalKey = canonicalKey.String
+	if deletedAt.Valid {
+		t := time.UnixMilli(deletedAt.Int64)
+		urlDoc.DeletedAt = &t
+	}
+	if expiresAt.Valid {
+		t := time.UnixMilli(expiresAt.Int64)
+		urlDoc.ExpiresAt = &t
+	}
+	if disabledAt.Valid {
+		t := time.UnixMilli(disabledAt.Int64)
+		urlDoc.DisabledAt = &t
+	}
+	return &urlDoc, nil
+}
+
+// nullString stores empty strings as NULL so the unique alias and canonical key indexes ignore them
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullTime stores an optional timestamp as Unix milliseconds
+func nullTime(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixMilli(), Valid: true}
+}
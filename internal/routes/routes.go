@@ -3,12 +3,57 @@ package routes
 import (
 	"net/http"
 
+	"gochop-it/internal/config"
 	"gochop-it/internal/handlers"
+	"gochop-it/internal/health"
+	"gochop-it/internal/metrics"
 	"gochop-it/internal/middleware"
+	"gochop-it/internal/tracing"
 )
 
-func RegisterRoutes(h *handlers.Handlers) {
-	http.HandleFunc("/", h.RootHandler)
-	http.Handle("/shorten", middleware.PerClientRateLimiter(http.HandlerFunc(h.ShortenURLHandler)))
-	http.Handle("/r/", middleware.PerClientRateLimiter(http.HandlerFunc(h.RedirectHandler)))
+func RegisterRoutes(h *handlers.Handlers, cfg *config.Config) {
+	// Share the buckets between instances through Redis unless configured to keep them in memory
+	var limiter *middleware.RateLimiter
+	if cfg.RateLimit.Store == "redis" {
+		limiter = middleware.NewRateLimiter(cfg.RateLimit, h.RedisRepo.Client)
+	} else {
+		limiter = middleware.NewRateLimiter(cfg.RateLimit, nil)
+	}
+	authenticate := middleware.Authenticate(h.Repo)
+	// Trusted proxies are checked by Validate
+	trusted, _ := cfg.Server.TrustedProxyNets()
+	clientIP := middleware.NewClientIPResolver(trusted, cfg.Server.ClientIPHeader).Middleware
+
+	// instrument counts, times and traces the requests of a route before anything else runs,
+	// so requests rejected by the limiter show up in the metrics and traces too
+	instrument := func(handler http.Handler) http.Handler {
+		return metrics.Instrument(tracing.Middleware(handler))
+	}
+	// limited resolves the client address behind trusted proxies and applies the route's rate limit policy
+	limited := func(route string, handler http.HandlerFunc) http.Handler {
+		return instrument(clientIP(limiter.Limit(route)(handler)))
+	}
+	// api also resolves the caller's API key first, so its tier and owner pick the rate limit.
+	// Key lookups are limited per client address before that, so bogus keys can't flood storage.
+	api := func(route string, handler http.HandlerFunc) http.Handler {
+		return instrument(clientIP(limiter.LimitKeyLookups(authenticate(limiter.Limit(route)(handler)))))
+	}
+
+	http.Handle("/", instrument(http.HandlerFunc(h.RootHandler)))
+	http.Handle("GET /metrics", metrics.Handler())
+	// Probes aren't instrumented, they would drown out the traffic in the metrics
+	http.HandleFunc("GET /healthz", health.Live)
+	http.Handle("GET /readyz", health.NewChecker(
+		health.Check{Name: cfg.Storage.Backend, Ping: h.Repo.Ping},
+		health.Check{Name: "redis", Ping: h.RedisRepo.Ping},
+	))
+	http.Handle("/shorten", api("shorten", h.ShortenURLHandler))
+	http.Handle("POST /api/v1/links", api("shorten", h.ShortenURLHandler))
+	http.Handle("POST /api/v1/links/bulk", api("bulk", h.BulkShortenHandler))
+	http.Handle("GET /api/v1/links", api("api", h.ListLinksHandler))
+	http.Handle("PATCH /api/v1/links/{code}", api("api", h.UpdateLinkHandler))
+	http.Handle("DELETE /api/v1/links/{code}", api("api", h.DeleteLinkHandler))
+	http.Handle("/api/v1/links/{code}/stats", api("api", h.LinkStatsHandler))
+	http.Handle("/api/v1/keys", limited("keys", h.CreateAPIKeyHandler))
+	http.Handle("/r/", limited("redirect", h.RedirectHandler))
 }
@@ -0,0 +1,159 @@
+package screening
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blocklist is a set of blocked domains loaded from a file. A domain also blocks all of its
+// subdomains. The file is reloaded by Watch when it changes, so domains can be blocked without
+// a restart. A nil *Blocklist is valid and blocks nothing.
+type Blocklist struct {
+	path string
+
+	mu      sync.RWMutex
+	domains map[string]struct{}
+	modTime time.Time
+	size    int64
+}
+
+// LoadBlocklist reads a blocklist file with one domain per line. Blank lines and
+// lines starting with # are ignored.
+func LoadBlocklist(path string) (*Blocklist, error) {
+	b := &Blocklist{path: path}
+	if err := b.Reload(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewBlocklist creates an in-memory blocklist of the given domains, it is never reloaded
+func NewBlocklist(domains ...string) *Blocklist {
+	b := &Blocklist{domains: make(map[string]struct{}, len(domains))}
+	for _, domain := range domains {
+		if domain = normalizeHost(domain); domain != "" {
+			b.domains[domain] = struct{}{}
+		}
+	}
+	return b
+}
+
+// Reload reads the file again. On error the current domains are kept.
+func (b *Blocklist) Reload() error {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return fmt.Errorf("could not open blocklist: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat blocklist: %w", err)
+	}
+	domains, err := parseBlocklist(f)
+	if err != nil {
+		return fmt.Errorf("could not read blocklist %s: %w", b.path, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.domains = domains
+	b.modTime = info.ModTime()
+	b.size = info.Size()
+	return nil
+}
+
+// parseBlocklist reads one domain per line, skipping blank lines and comments
+func parseBlocklist(r io.Reader) (map[string]struct{}, error) {
+	domains := make(map[string]struct{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if domain := normalizeHost(line); domain != "" {
+			domains[domain] = struct{}{}
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// Watch checks the file every interval and reloads it when its size or modification time
+// changes, until ctx is cancelled. Failed reloads are logged and the old domains stay in use.
+func (b *Blocklist) Watch(ctx context.Context, interval time.Duration) {
+	if b == nil || b.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !b.changed() {
+				continue
+			}
+			if err := b.Reload(); err != nil {
+				slog.ErrorContext(ctx, "Failed to reload blocklist", "path", b.path, "error", err)
+				continue
+			}
+			slog.InfoContext(ctx, "Reloaded blocklist", "path", b.path, "domains", b.Len())
+		}
+	}
+}
+
+// changed reports whether the file differs from the last loaded version
+func (b *Blocklist) changed() bool {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		slog.Error("Failed to check blocklist", "path", b.path, "error", err)
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return !info.ModTime().Equal(b.modTime) || info.Size() != b.size
+}
+
+// Blocks reports whether host or one of its parent domains is on the blocklist
+func (b *Blocklist) Blocks(host string) bool {
+	if b == nil {
+		return false
+	}
+	host = normalizeHost(host)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for host != "" {
+		if _, ok := b.domains[host]; ok {
+			return true
+		}
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			return false
+		}
+		host = parent
+	}
+	return false
+}
+
+// Len returns the number of blocked domains
+func (b *Blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.domains)
+}
+
+// normalizeHost lowercases a host name and drops the trailing dot of fully qualified names
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
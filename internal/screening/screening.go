@@ -0,0 +1,231 @@
+// Package screening checks link destinations before they are shortened, so the
+// shortener can't be used to hide malware, phishing pages or internal addresses.
+package screening
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gochop-it/internal/utils"
+)
+
+// lookupTimeout bounds the DNS resolution of a destination host
+const lookupTimeout = 2 * time.Second
+
+// Screener rejects destinations on the blocklist, flagged by the reputation service,
+// or pointing at private, loopback or link-local addresses.
+// A nil *Screener is valid and accepts every URL.
+type Screener struct {
+	blocklist    *Blocklist
+	reputation   Reputation
+	allowPrivate bool
+	// lookupIP resolves host names, it is replaced in tests
+	lookupIP func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// NewScreener creates a screener. The blocklist and reputation service are optional,
+// allowPrivate accepts destinations on private networks for internal deployments.
+func NewScreener(blocklist *Blocklist, reputation Reputation, allowPrivate bool) *Screener {
+	return &Screener{
+		blocklist:    blocklist,
+		reputation:   reputation,
+		allowPrivate: allowPrivate,
+		lookupIP:     net.DefaultResolver.LookupIPAddr,
+	}
+}
+
+// Check screens a destination before it is shortened, rejected URLs return a *utils.URLError.
+// Reputation and DNS failures are logged and let the URL through, an outage of either
+// must not stop the shortener.
+func (s *Screener) Check(ctx context.Context, rawURL string) error {
+	if s == nil {
+		return nil
+	}
+	sanitizedURL, err := s.checkHost(ctx, rawURL)
+	if err != nil {
+		return err
+	}
+	if s.reputation != nil {
+		threat, err := s.reputation.Lookup(ctx, sanitizedURL)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to check URL reputation", "error", err)
+		} else if threat != "" {
+			return threatError(threat)
+		}
+	}
+	return nil
+}
+
+// Limits of CheckAll, so a large batch can't hold a request for long or flood the resolver
+const (
+	bulkTimeout = 10 * time.Second
+	bulkWorkers = 16
+)
+
+// CheckAll screens a batch of destinations like Check, returning the error of each URL by index.
+// Hosts are resolved a few at a time and the reputation service is asked once for the whole
+// batch, all under an overall deadline. URLs that couldn't be screened before it are rejected.
+func (s *Screener) CheckAll(ctx context.Context, rawURLs []string) []error {
+	errs := make([]error, len(rawURLs))
+	if s == nil {
+		return errs
+	}
+	ctx, cancel := context.WithTimeout(ctx, bulkTimeout)
+	defer cancel()
+
+	sanitized := make([]string, len(rawURLs))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(bulkWorkers, len(rawURLs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if ctx.Err() != nil {
+					errs[i] = &utils.URLError{Reason: "URL could not be screened in time, try again"}
+					continue
+				}
+				sanitized[i], errs[i] = s.checkHost(ctx, rawURLs[i])
+			}
+		}()
+	}
+	for i := range rawURLs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	if s.reputation == nil {
+		return errs
+	}
+	var pending []string
+	for i, err := range errs {
+		if err == nil {
+			pending = append(pending, sanitized[i])
+		}
+	}
+	if len(pending) == 0 {
+		return errs
+	}
+	threats, err := s.reputation.LookupAll(ctx, pending)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to check URL reputation", "urls", len(pending), "error", err)
+		return errs
+	}
+	for i, err := range errs {
+		if threat := threats[sanitized[i]]; err == nil && threat != "" {
+			errs[i] = threatError(threat)
+		}
+	}
+	return errs
+}
+
+// threatError rejects a URL listed by the reputation service
+func threatError(threat string) error {
+	return &utils.URLError{Reason: "URL is flagged as unsafe (" + strings.ToLower(threat) + ")"}
+}
+
+// checkHost runs the checks of Check before the reputation lookup and returns the URL as it will be stored
+func (s *Screener) checkHost(ctx context.Context, rawURL string) (string, error) {
+	// Screen the URL as it will be stored, this also reports malformed URLs the same way as saving
+	sanitizedURL, err := utils.SanitizeURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(sanitizedURL)
+	if err != nil {
+		return "", &utils.URLError{Reason: "invalid URL format"}
+	}
+	host := normalizeHost(u.Hostname())
+	if host == "" {
+		return "", &utils.URLError{Reason: "URL must have a host"}
+	}
+	if s.blocklist.Blocks(host) {
+		return "", &utils.URLError{Reason: "URL points to a blocked domain"}
+	}
+	if !s.allowPrivate {
+		if err := s.checkPublic(ctx, host); err != nil {
+			return "", err
+		}
+	}
+	return sanitizedURL, nil
+}
+
+// Blocked reports whether a stored destination's domain is on the blocklist.
+// It is checked on every redirect, so links are disabled as soon as their domain is blocked.
+func (s *Screener) Blocked(rawURL string) bool {
+	if s == nil {
+		return false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return s.blocklist.Blocks(u.Hostname())
+}
+
+// localSuffixes are names that only resolve inside a private network
+var localSuffixes = []string{".localhost", ".local", ".internal", ".home.arpa"}
+
+// checkPublic rejects hosts that are, or resolve to, non public addresses
+func (s *Screener) checkPublic(ctx context.Context, host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !isPublic(addr) {
+			return &utils.URLError{Reason: "URL points to a private or local address"}
+		}
+		return nil
+	}
+
+	// Single label names like "intranet" only resolve through local search domains
+	if host == "localhost" || !strings.Contains(host, ".") {
+		return &utils.URLError{Reason: "URL points to a private or local address"}
+	}
+	for _, suffix := range localSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return &utils.URLError{Reason: "URL points to a private or local address"}
+		}
+	}
+	// Browsers read a numeric last label as an IPv4 address in decimal, octal or hex
+	// form, e.g. 0x7f.1, which netip doesn't parse
+	if isNumericLabel(host[strings.LastIndex(host, ".")+1:]) {
+		return &utils.URLError{Reason: "URL host is not a valid address"}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	addrs, err := s.lookupIP(ctx, host)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to resolve host", "host", host, "error", err)
+		return nil
+	}
+	for _, ipAddr := range addrs {
+		addr, ok := netip.AddrFromSlice(ipAddr.IP)
+		if ok && !isPublic(addr) {
+			return &utils.URLError{Reason: "URL points to a private or local address"}
+		}
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier grade NAT range, which is not covered by netip.Addr.IsPrivate
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPublic reports whether addr is a globally routable unicast address
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// isNumericLabel reports whether a host label is a number, such as 1, 0177 or 0x7f
+func isNumericLabel(label string) bool {
+	if hex, ok := strings.CutPrefix(strings.ToLower(label), "0x"); ok {
+		return strings.Trim(hex, "0123456789abcdef") == ""
+	}
+	return label != "" && strings.Trim(label, "0123456789") == ""
+}
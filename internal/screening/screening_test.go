@@ -0,0 +1,298 @@
+package screening
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gochop-it/internal/utils"
+)
+
+// Test blocked domains also block their subdomains
+func TestBlocklistBlocks(t *testing.T) {
+	b, err := parseBlocklist(strings.NewReader("# phishing\nevil.example\n\n  Bad.Example.  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := &Blocklist{domains: b}
+
+	tests := map[string]bool{
+		"evil.example":       true,
+		"login.evil.example": true,
+		"bad.example":        true,
+		"BAD.EXAMPLE.":       true,
+		"notevil.example":    false,
+		"example":            false,
+	}
+	for host, want := range tests {
+		if got := list.Blocks(host); got != want {
+			t.Errorf("Blocks(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	var nilList *Blocklist
+	if nilList.Blocks("evil.example") {
+		t.Error("Expected a nil blocklist to block nothing")
+	}
+}
+
+// Test the blocklist file is reloaded by Watch when it changes
+func TestBlocklistWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("evil.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	list, err := LoadBlocklist(path)
+	if err != nil {
+		t.Fatalf("Failed to load blocklist: %v", err)
+	}
+	if !list.Blocks("evil.example") || list.Blocks("phish.example") {
+		t.Fatal("Unexpected initial blocklist")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go list.Watch(ctx, 10*time.Millisecond)
+
+	if err := os.WriteFile(path, []byte("evil.example\nphish.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !list.Blocks("phish.example") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the blocklist to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test private, loopback and link-local destinations are rejected
+func TestScreenerPrivateHosts(t *testing.T) {
+	s := NewScreener(nil, nil, false)
+	s.lookupIP = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "internal.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("10.1.2.3")}}, nil
+		case "public.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://public.example.com/page", true},
+		{"https://93.184.216.34/", true},
+		{"https://unresolvable.example.com/", true},
+		{"http://127.0.0.1:8080/admin", false},
+		{"http://[::1]/", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://192.168.1.1/", false},
+		{"http://[fd00::1]/", false},
+		{"http://[::ffff:10.0.0.1]/", false},
+		{"http://100.64.0.1/", false},
+		{"http://localhost:6379/", false},
+		{"http://redis/", false},
+		{"http://printer.local/", false},
+		{"http://0x7f.1/", false},
+		{"https://internal.example.com/", false},
+		{"https:///no-host", false},
+	}
+	for _, tt := range tests {
+		err := s.Check(context.TODO(), tt.url)
+		if tt.allowed && err != nil {
+			t.Errorf("Expected %s to be allowed, got %v", tt.url, err)
+		}
+		if !tt.allowed {
+			var urlErr *utils.URLError
+			if !errors.As(err, &urlErr) {
+				t.Errorf("Expected %s to be rejected with a URLError, got %v", tt.url, err)
+			}
+		}
+	}
+
+	s.allowPrivate = true
+	if err := s.Check(context.TODO(), "http://192.168.1.1/"); err != nil {
+		t.Errorf("Expected private hosts to be allowed, got %v", err)
+	}
+}
+
+// Test the blocklist and reputation checks
+func TestScreenerBlocklistAndReputation(t *testing.T) {
+	s := NewScreener(NewBlocklist("evil.example"), StubReputation{"phish.example": "SOCIAL_ENGINEERING"}, true)
+
+	if err := s.Check(context.TODO(), "https://login.evil.example/"); err == nil {
+		t.Error("Expected blocked domain to be rejected")
+	}
+	if err := s.Check(context.TODO(), "https://phish.example/login"); err == nil {
+		t.Error("Expected flagged URL to be rejected")
+	}
+	if err := s.Check(context.TODO(), "https://example.com/"); err != nil {
+		t.Errorf("Expected clean URL to be allowed, got %v", err)
+	}
+	if !s.Blocked("https://www.evil.example/old-link") || s.Blocked("https://example.com/") {
+		t.Error("Unexpected Blocked result for stored destinations")
+	}
+
+	var nilScreener *Screener
+	if err := nilScreener.Check(context.TODO(), "http://127.0.0.1/"); err != nil || nilScreener.Blocked("https://evil.example/") {
+		t.Error("Expected a nil screener to accept everything")
+	}
+}
+
+// Test the Safe Browsing client against a fake lookup API
+func TestSafeBrowsing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") != "test-key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var body safeBrowsingRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if body.ThreatInfo.ThreatEntries[0]["url"] == "https://malware.example/" {
+			_, _ = w.Write([]byte(`{"matches":[{"threatType":"MALWARE"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	sb := NewSafeBrowsing("test-key")
+	sb.Endpoint = server.URL
+
+	threat, err := sb.Lookup(context.TODO(), "https://malware.example/")
+	if err != nil || threat != "MALWARE" {
+		t.Errorf("Expected MALWARE, got %q, %v", threat, err)
+	}
+	threat, err = sb.Lookup(context.TODO(), "https://example.com/")
+	if err != nil || threat != "" {
+		t.Errorf("Expected no threat, got %q, %v", threat, err)
+	}
+
+	sb.APIKey = "wrong"
+	if _, err := sb.Lookup(context.TODO(), "https://example.com/"); err == nil {
+		t.Error("Expected an error for a rejected API key")
+	}
+}
+
+// Test a batch is screened like single URLs, with hosts resolved a few at a time
+func TestScreenerCheckAll(t *testing.T) {
+	s := NewScreener(NewBlocklist("evil.example"), StubReputation{"phish.example": "SOCIAL_ENGINEERING"}, false)
+	var running, peak atomic.Int32
+	s.lookupIP = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(time.Millisecond)
+		if host == "internal.example.com" {
+			return []net.IPAddr{{IP: net.ParseIP("10.1.2.3")}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+	}
+
+	urls := []string{"https://example.com/", "https://login.evil.example/", "https://phish.example/login", "https://internal.example.com/", "not a url"}
+	for i := 0; i < 40; i++ {
+		urls = append(urls, fmt.Sprintf("https://host%d.example.com/", i))
+	}
+	errs := s.CheckAll(context.TODO(), urls)
+	if len(errs) != len(urls) {
+		t.Fatalf("Expected an error slot per URL, got %d", len(errs))
+	}
+	for i, err := range errs {
+		if rejected := i >= 1 && i <= 4; rejected != (err != nil) {
+			t.Errorf("Unexpected result for %s: %v", urls[i], err)
+		}
+	}
+	if err := errs[2]; err == nil || !strings.Contains(err.Error(), "social_engineering") {
+		t.Errorf("Expected the flagged URL to name its threat, got %v", err)
+	}
+	if got := peak.Load(); got > bulkWorkers {
+		t.Errorf("Expected at most %d lookups at once, got %d", bulkWorkers, got)
+	}
+
+	var nilScreener *Screener
+	if errs := nilScreener.CheckAll(context.TODO(), urls); len(errs) != len(urls) || errs[1] != nil {
+		t.Errorf("Expected a nil screener to accept every URL")
+	}
+}
+
+// Test URLs that couldn't be screened before the deadline are rejected
+func TestScreenerCheckAllDeadline(t *testing.T) {
+	s := NewScreener(nil, nil, false)
+	s.lookupIP = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	urls := make([]string, bulkWorkers+10)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("https://host%d.example.com/", i)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var timedOut int
+	for _, err := range s.CheckAll(ctx, urls) {
+		if err != nil && strings.Contains(err.Error(), "in time") {
+			timedOut++
+		}
+	}
+	// The lookups in flight at the deadline fail open like single checks, the rest never started
+	if timedOut != 10 {
+		t.Errorf("Expected 10 URLs to time out, got %d", timedOut)
+	}
+}
+
+// Test the Safe Browsing client checks a batch of URLs in as few requests as the API allows
+func TestSafeBrowsingLookupAll(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		var body safeBrowsingRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.ThreatInfo.ThreatEntries) > maxSafeBrowsingEntries {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, entry := range body.ThreatInfo.ThreatEntries {
+			if entry["url"] == "https://malware.example/" {
+				_, _ = w.Write([]byte(`{"matches":[{"threatType":"MALWARE","threat":{"url":"https://malware.example/"}}]}`))
+				return
+			}
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	sb := NewSafeBrowsing("test-key")
+	sb.Endpoint = server.URL
+	urls := []string{"https://malware.example/"}
+	for i := 0; i < maxSafeBrowsingEntries; i++ {
+		urls = append(urls, fmt.Sprintf("https://host%d.example.com/", i))
+	}
+
+	threats, err := sb.LookupAll(context.TODO(), urls)
+	if err != nil {
+		t.Fatalf("Failed to look up URLs: %v", err)
+	}
+	if len(threats) != 1 || threats["https://malware.example/"] != "MALWARE" {
+		t.Errorf("Unexpected threats %v", threats)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("Expected 2 requests for %d URLs, got %d", len(urls), got)
+	}
+}
@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+
+	"gochop-it/internal/config"
+	"gochop-it/internal/tracing/tracingtest"
+)
+
+// Test each request gets a server span named after its route, with handler spans below it
+func TestMiddleware(t *testing.T) {
+	recorder := tracingtest.Record(t)
+	mux := http.NewServeMux()
+	mux.Handle("/r/", Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "redis get")
+		span.End()
+		http.Redirect(w, r, "https://example.com", http.StatusPermanentRedirect)
+	})))
+	mux.Handle("POST /api/v1/links", Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})))
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/r/bc", nil))
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/links", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %v", tracingtest.Names(recorder))
+	}
+	child, redirect, create := spans[0], spans[1], spans[2]
+	if redirect.Name() != "GET /r/" || create.Name() != "POST /api/v1/links" {
+		t.Errorf("Unexpected span names %q and %q", redirect.Name(), create.Name())
+	}
+	if child.Parent().SpanID() != redirect.SpanContext().SpanID() {
+		t.Errorf("Expected the handler's span to be a child of the request span")
+	}
+	attrs := map[string]any{}
+	for _, attr := range redirect.Attributes() {
+		attrs[string(attr.Key)] = attr.Value.AsInterface()
+	}
+	if attrs[string(semconv.HTTPRouteKey)] != "/r/" || attrs[string(semconv.HTTPResponseStatusCodeKey)] != int64(http.StatusPermanentRedirect) {
+		t.Errorf("Unexpected attributes %v", attrs)
+	}
+	if redirect.Status().Code != codes.Unset || create.Status().Code != codes.Error {
+		t.Errorf("Expected only the 500 to be marked as an error, got %v and %v", redirect.Status(), create.Status())
+	}
+}
+
+// Test a request carrying a traceparent header continues the caller's trace
+func TestMiddlewareContinuesTrace(t *testing.T) {
+	recorder := tracingtest.Record(t)
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(previous) })
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/r/bc", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the span to join the incoming trace, got %v", spans)
+	}
+}
+
+// Test tracing stays off without an endpoint
+func TestSetupWithoutEndpoint(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	shutdown, err := Setup(context.Background(), config.TracingConfig{ServiceName: "smallchop", SampleRatio: 1})
+	if err != nil {
+		t.Fatalf("Failed to set up tracing: %v", err)
+	}
+	if otel.GetTracerProvider() != previous {
+		t.Errorf("Expected the tracer provider to be left alone")
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("Expected the no-op shutdown to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,431 @@
+// Package transfer exports the link database to NDJSON or CSV and imports it back,
+// for backups and for migrating between storage backends.
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"gochop-it/internal/repository"
+)
+
+// Export formats
+const (
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+)
+
+// importBatchSize is how many links are written per ImportURLs call
+const importBatchSize = 500
+
+// Record is the exported form of a link, with every field of repository.URL
+type Record struct {
+	ID           int64      `json:"id"`
+	LongURL      string     `json:"longURL"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	AccessCount  int        `json:"accessCount"`
+	Alias        string     `json:"alias,omitempty"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	MaxClicks    int        `json:"maxClicks,omitempty"`
+	OwnerID      string     `json:"ownerID,omitempty"`
+	DeletedAt    *time.Time `json:"deletedAt,omitempty"`
+	CanonicalKey string     `json:"canonicalKey,omitempty"`
+	DisabledAt   *time.Time `json:"disabledAt,omitempty"`
+}
+
+// csvHeader names the CSV columns, in the order written by recordFields
+var csvHeader = []string{"id", "longURL", "createdAt", "accessCount", "alias", "expiresAt", "maxClicks", "ownerID", "deletedAt", "canonicalKey", "disabledAt"}
+
+// NewRecord converts a stored link to its exported form. Times are kept to the
+// millisecond in UTC, the precision every backend stores them with.
+func NewRecord(urlDoc *repository.URL) Record {
+	return Record{
+		ID:           urlDoc.ID,
+		LongURL:      urlDoc.LongURL,
+		CreatedAt:    normalizeTime(urlDoc.CreatedAt),
+		AccessCount:  urlDoc.AccessCount,
+		Alias:        urlDoc.Alias,
+		ExpiresAt:    normalizeTimePtr(urlDoc.ExpiresAt),
+		MaxClicks:    urlDoc.MaxClicks,
+		OwnerID:      urlDoc.OwnerID,
+		DeletedAt:    normalizeTimePtr(urlDoc.DeletedAt),
+		CanonicalKey: urlDoc.CanonicalKey,
+		DisabledAt:   normalizeTimePtr(urlDoc.DisabledAt),
+	}
+}
+
+// URL converts the record back to a link
+func (rec Record) URL() *repository.URL {
+	return &repository.URL{
+		ID:           rec.ID,
+		LongURL:      rec.LongURL,
+		CreatedAt:    rec.CreatedAt,
+		AccessCount:  rec.AccessCount,
+		Alias:        rec.Alias,
+		ExpiresAt:    rec.ExpiresAt,
+		MaxClicks:    rec.MaxClicks,
+		OwnerID:      rec.OwnerID,
+		DeletedAt:    rec.DeletedAt,
+		CanonicalKey: rec.CanonicalKey,
+		DisabledAt:   rec.DisabledAt,
+	}
+}
+
+// digest fingerprints the record for the round trip check
+func (rec Record) digest() [sha256.Size]byte {
+	rec = NewRecord(rec.URL())
+	data, _ := json.Marshal(rec)
+	return sha256.Sum256(data)
+}
+
+// validate rejects records that can't be stored as a link
+func (rec Record) validate() error {
+	if rec.ID < 1 {
+		return fmt.Errorf("invalid id %d", rec.ID)
+	}
+	if rec.LongURL == "" {
+		return errors.New("missing longURL")
+	}
+	return nil
+}
+
+func normalizeTime(t time.Time) time.Time {
+	return t.Truncate(time.Millisecond).UTC()
+}
+
+func normalizeTimePtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	normalized := normalizeTime(*t)
+	return &normalized
+}
+
+// ParseFormat checks a format name, an empty name defaults to NDJSON
+func ParseFormat(format string) (string, error) {
+	switch format {
+	case "", FormatNDJSON:
+		return FormatNDJSON, nil
+	case FormatCSV:
+		return FormatCSV, nil
+	default:
+		return "", fmt.Errorf("unknown format %q, must be %s or %s", format, FormatNDJSON, FormatCSV)
+	}
+}
+
+// Export streams every link, deleted ones included, to w in ID order and returns how many were written
+func Export(ctx context.Context, repo repository.URLRepository, w io.Writer, format string) (int, error) {
+	format, err := ParseFormat(format)
+	if err != nil {
+		return 0, err
+	}
+	buf := bufio.NewWriter(w)
+	var write func(Record) error
+	var csvWriter *csv.Writer
+	if format == FormatCSV {
+		csvWriter = csv.NewWriter(buf)
+		if err := csvWriter.Write(csvHeader); err != nil {
+			return 0, err
+		}
+		write = func(rec Record) error { return csvWriter.Write(recordFields(rec)) }
+	} else {
+		encoder := json.NewEncoder(buf)
+		encoder.SetEscapeHTML(false)
+		write = func(rec Record) error { return encoder.Encode(rec) }
+	}
+
+	count := 0
+	err = repo.EachURL(ctx, func(urlDoc *repository.URL) error {
+		count++
+		return write(NewRecord(urlDoc))
+	})
+	if err != nil {
+		return count, err
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return count, err
+		}
+	}
+	return count, buf.Flush()
+}
+
+// ImportResult summarises an import
+type ImportResult struct {
+	Imported int
+	// MaxID is the highest imported ID, the url_counter is raised to at least this value
+	MaxID int64
+	// digests fingerprints every imported record by ID for Verify
+	digests map[int64][sha256.Size]byte
+}
+
+// Cache drops cached copies of links, *repository.RedisRepo is one
+type Cache interface {
+	InvalidateKeys(ctx context.Context, codes ...string) error
+}
+
+// Import reads links from r and stores them with their original IDs, replacing links with
+// the same ID, then raises the url_counter above the highest imported ID so new links never
+// reuse one. The cached copies of replaced links are dropped from cache, if it isn't nil.
+// A malformed record stops the import with its line number, the result always counts the
+// links imported before it.
+func Import(ctx context.Context, repo repository.URLRepository, cache Cache, r io.Reader, format string) (*ImportResult, error) {
+	result := &ImportResult{digests: make(map[int64][sha256.Size]byte)}
+	format, err := ParseFormat(format)
+	if err != nil {
+		return result, err
+	}
+	var next func() (Record, error)
+	if format == FormatCSV {
+		next, err = csvRecords(r)
+		if err != nil {
+			return result, err
+		}
+	} else {
+		next = ndjsonRecords(r)
+	}
+
+	batch := make([]*repository.URL, 0, importBatchSize)
+	flush := func() error {
+		codes, err := replacedCodes(ctx, repo, cache, batch)
+		if err != nil {
+			return err
+		}
+		if err := repo.ImportURLs(ctx, batch); err != nil {
+			return err
+		}
+		if len(codes) > 0 {
+			if err := cache.InvalidateKeys(ctx, codes...); err != nil {
+				return fmt.Errorf("links were replaced but their cached copies were not dropped, run the import again: %w", err)
+			}
+		}
+		result.Imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		rec, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		batch = append(batch, rec.URL())
+		result.digests[rec.ID] = rec.digest()
+		result.MaxID = max(result.MaxID, rec.ID)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+
+	if err := repo.EnsureCounter(ctx, "url_counter", result.MaxID); err != nil {
+		return result, fmt.Errorf("could not reset url_counter: %w", err)
+	}
+	return result, nil
+}
+
+// replacedCodes returns the short codes and aliases of the links batch replaces, which may be cached
+func replacedCodes(ctx context.Context, repo repository.URLRepository, cache Cache, batch []*repository.URL) ([]string, error) {
+	if cache == nil {
+		return nil, nil
+	}
+	var codes []string
+	for _, urlDoc := range batch {
+		old, err := repo.FindURLByID(ctx, urlDoc.ID)
+		if errors.Is(err, repository.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, old.ShortCodes()...)
+	}
+	return codes, nil
+}
+
+// Verify reads the imported links back from the repository and checks each one
+// matches the record it was imported from
+func Verify(ctx context.Context, repo repository.URLRepository, result *ImportResult) error {
+	remaining := make(map[int64][sha256.Size]byte, len(result.digests))
+	for id, digest := range result.digests {
+		remaining[id] = digest
+	}
+	mismatched := 0
+	err := repo.EachURL(ctx, func(urlDoc *repository.URL) error {
+		digest, ok := remaining[urlDoc.ID]
+		if !ok {
+			return nil
+		}
+		delete(remaining, urlDoc.ID)
+		if NewRecord(urlDoc).digest() != digest {
+			mismatched++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if mismatched > 0 || len(remaining) > 0 {
+		return fmt.Errorf("round trip check failed: %d links differ from the import and %d are missing", mismatched, len(remaining))
+	}
+	return nil
+}
+
+// ndjsonRecords returns a function reading one JSON record per line
+func ndjsonRecords(r io.Reader) func() (Record, error) {
+	scanner := bufio.NewScanner(r)
+	// Each record is one line, allow for very long URLs
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	return func() (Record, error) {
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var rec Record
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				return rec, fmt.Errorf("line %d: %w", line, err)
+			}
+			if err := rec.validate(); err != nil {
+				return rec, fmt.Errorf("line %d: %w", line, err)
+			}
+			return rec, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return Record{}, err
+		}
+		return Record{}, io.EOF
+	}
+}
+
+// csvRecords reads the header and returns a function reading one record per row.
+// Columns are matched by name, so they may come in any order.
+func csvRecords(r io.Reader) (func() (Record, error), error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return func() (Record, error) { return Record{}, io.EOF }, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("line 1: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"id", "longURL", "createdAt"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("line 1: missing %s column", name)
+		}
+	}
+
+	return func() (Record, error) {
+		fields, err := reader.Read()
+		if err != nil {
+			return Record{}, err
+		}
+		line, _ := reader.FieldPos(0)
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(fields) {
+				return fields[i]
+			}
+			return ""
+		}
+		rec, err := parseRecord(field)
+		if err == nil {
+			err = rec.validate()
+		}
+		if err != nil {
+			return rec, fmt.Errorf("line %d: %w", line, err)
+		}
+		return rec, nil
+	}, nil
+}
+
+// recordFields formats a record as a CSV row matching csvHeader
+func recordFields(rec Record) []string {
+	return []string{
+		strconv.FormatInt(rec.ID, 10),
+		rec.LongURL,
+		rec.CreatedAt.Format(time.RFC3339Nano),
+		strconv.Itoa(rec.AccessCount),
+		rec.Alias,
+		formatTimePtr(rec.ExpiresAt),
+		strconv.Itoa(rec.MaxClicks),
+		rec.OwnerID,
+		formatTimePtr(rec.DeletedAt),
+		rec.CanonicalKey,
+		formatTimePtr(rec.DisabledAt),
+	}
+}
+
+// parseRecord reads a record from the named CSV fields, empty optional fields are left unset
+func parseRecord(field func(name string) string) (Record, error) {
+	rec := Record{
+		LongURL:      field("longURL"),
+		Alias:        field("alias"),
+		OwnerID:      field("ownerID"),
+		CanonicalKey: field("canonicalKey"),
+	}
+	var err error
+	if rec.ID, err = strconv.ParseInt(field("id"), 10, 64); err != nil {
+		return rec, fmt.Errorf("invalid id: %w", err)
+	}
+	if rec.CreatedAt, err = time.Parse(time.RFC3339Nano, field("createdAt")); err != nil {
+		return rec, fmt.Errorf("invalid createdAt: %w", err)
+	}
+	if v := field("accessCount"); v != "" {
+		if rec.AccessCount, err = strconv.Atoi(v); err != nil {
+			return rec, fmt.Errorf("invalid accessCount: %w", err)
+		}
+	}
+	if v := field("maxClicks"); v != "" {
+		if rec.MaxClicks, err = strconv.Atoi(v); err != nil {
+			return rec, fmt.Errorf("invalid maxClicks: %w", err)
+		}
+	}
+	if rec.ExpiresAt, err = parseTimePtr(field("expiresAt")); err != nil {
+		return rec, fmt.Errorf("invalid expiresAt: %w", err)
+	}
+	if rec.DeletedAt, err = parseTimePtr(field("deletedAt")); err != nil {
+		return rec, fmt.Errorf("invalid deletedAt: %w", err)
+	}
+	if rec.DisabledAt, err = parseTimePtr(field("disabledAt")); err != nil {
+		return rec, fmt.Errorf("invalid disabledAt: %w", err)
+	}
+	return rec, nil
+}
+
+func formatTimePtr(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseTimePtr(v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
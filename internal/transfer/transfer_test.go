@@ -0,0 +1,199 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gochop-it/internal/repository"
+	"gochop-it/internal/utils"
+)
+
+// seed fills a memory repository with links using every field
+func seed(t *testing.T) *repository.MemoryRepo {
+	t.Helper()
+	ctx := context.TODO()
+	repo := repository.NewMemoryRepo()
+	expiresAt := time.Now().Add(time.Hour)
+	links := []struct {
+		longURL string
+		opts    repository.LinkOptions
+	}{
+		{"https://example.com/a", repository.LinkOptions{}},
+		{"https://example.com/b?q=1,2", repository.LinkOptions{Alias: "spring-sale", OwnerID: "marketing"}},
+		{"https://example.com/c", repository.LinkOptions{ExpiresAt: &expiresAt, MaxClicks: 10}},
+		{"https://example.com/d", repository.LinkOptions{}},
+	}
+	for _, link := range links {
+		if _, err := repo.SaveURL(ctx, link.longURL, link.opts); err != nil {
+			t.Fatalf("Failed to save URL: %v", err)
+		}
+	}
+	if err := repo.IncrementAccessCounts(ctx, map[int64]int{1: 5, 2: 1}); err != nil {
+		t.Fatalf("Failed to count clicks: %v", err)
+	}
+	if err := repo.DeleteURL(ctx, 4); err != nil {
+		t.Fatalf("Failed to delete URL: %v", err)
+	}
+	if _, err := repo.SetDisabled(ctx, 3, true); err != nil {
+		t.Fatalf("Failed to disable URL: %v", err)
+	}
+	return repo
+}
+
+// Test links survive an export and import into another backend in both formats
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatNDJSON, FormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			ctx := context.TODO()
+			source := seed(t)
+
+			var buf bytes.Buffer
+			count, err := Export(ctx, source, &buf, format)
+			if err != nil {
+				t.Fatalf("Failed to export: %v", err)
+			}
+			if count != 4 {
+				t.Errorf("Expected 4 exported links, got %d", count)
+			}
+			exported := buf.String()
+
+			target, err := repository.NewSQLiteRepo(ctx, filepath.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatalf("Failed to open SQLite repo: %v", err)
+			}
+			defer target.Close(ctx)
+			if err := target.EnsureIndexes(ctx); err != nil {
+				t.Fatalf("Failed to create indexes: %v", err)
+			}
+
+			result, err := Import(ctx, target, nil, strings.NewReader(exported), format)
+			if err != nil {
+				t.Fatalf("Failed to import: %v", err)
+			}
+			if result.Imported != 4 || result.MaxID != 4 {
+				t.Errorf("Unexpected import result %+v", result)
+			}
+			if err := Verify(ctx, target, result); err != nil {
+				t.Errorf("Round trip check failed: %v", err)
+			}
+
+			// Exporting the imported links gives the same file
+			buf.Reset()
+			if _, err := Export(ctx, target, &buf, format); err != nil {
+				t.Fatalf("Failed to export: %v", err)
+			}
+			if buf.String() != exported {
+				t.Errorf("Expected the same export after the round trip, got\n%s\nwant\n%s", buf.String(), exported)
+			}
+
+			deleted, err := target.FindURLByID(ctx, 4)
+			if err != nil || !deleted.Deleted() {
+				t.Errorf("Expected the deleted link to stay deleted, got %+v, %v", deleted, err)
+			}
+			aliased, err := repository.FindURLByShortCode(ctx, target, "spring-sale")
+			if err != nil || aliased.OwnerID != "marketing" || aliased.AccessCount != 1 {
+				t.Errorf("Unexpected aliased link %+v, %v", aliased, err)
+			}
+
+			// New links continue after the highest imported ID
+			next, err := target.SaveURL(ctx, "https://example.com/e", repository.LinkOptions{})
+			if err != nil {
+				t.Fatalf("Failed to save URL: %v", err)
+			}
+			if next.ID != 5 {
+				t.Errorf("Expected the counter to be reset to 4, got ID %d", next.ID)
+			}
+		})
+	}
+}
+
+// Test importing never moves the counter backwards
+func TestImportKeepsHigherCounter(t *testing.T) {
+	ctx := context.TODO()
+	repo := repository.NewMemoryRepo()
+	if _, err := repo.ReserveIDs(context.TODO(), "url_counter", 100); err != nil {
+		t.Fatal(err)
+	}
+	input := `{"id": 7, "longURL": "https://example.com/", "createdAt": "2024-11-01T10:00:00Z"}`
+	if _, err := Import(ctx, repo, nil, strings.NewReader(input), FormatNDJSON); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	id, err := repo.GetNextID(context.TODO(), "url_counter")
+	if err != nil || id != 101 {
+		t.Errorf("Expected ID 101, got %d, %v", id, err)
+	}
+}
+
+// recordingCache records the codes dropped from the cache
+type recordingCache struct {
+	codes []string
+}
+
+func (c *recordingCache) InvalidateKeys(ctx context.Context, codes ...string) error {
+	c.codes = append(c.codes, codes...)
+	return nil
+}
+
+// Test the cached copies of replaced links are dropped, and new links don't touch the cache
+func TestImportInvalidatesReplaced(t *testing.T) {
+	ctx := context.TODO()
+	repo := repository.NewMemoryRepo()
+	input := `{"id": 1, "longURL": "https://example.com/a", "alias": "launch2026", "createdAt": "2024-11-01T10:00:00Z"}`
+	if _, err := Import(ctx, repo, nil, strings.NewReader(input), FormatNDJSON); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+
+	cache := &recordingCache{}
+	input = `{"id": 1, "longURL": "https://example.com/b", "createdAt": "2024-11-01T10:00:00Z"}
+{"id": 2, "longURL": "https://example.com/c", "createdAt": "2024-11-01T10:00:00Z"}`
+	if _, err := Import(ctx, repo, cache, strings.NewReader(input), FormatNDJSON); err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if want := []string{utils.EncodeID(1), "launch2026"}; !slices.Equal(cache.codes, want) {
+		t.Errorf("Expected %v to be dropped from the cache, got %v", want, cache.codes)
+	}
+}
+
+// Test malformed records stop the import with their line number
+func TestImportInvalid(t *testing.T) {
+	ctx := context.TODO()
+	tests := []struct {
+		format, input, want string
+	}{
+		{FormatNDJSON, "{\"id\": 1, \"longURL\": \"https://example.com/\"}\n\n{\"id\": 2", "line 3"},
+		{FormatNDJSON, `{"id": 0, "longURL": "https://example.com/"}`, "line 1: invalid id 0"},
+		{FormatCSV, "id,longURL\n1,https://example.com/\n", "missing createdAt column"},
+		{FormatCSV, "id,longURL,createdAt\n1,https://example.com/,2024-11-01T10:00:00Z\n2,https://example.com/b,yesterday\n", "line 3: invalid createdAt"},
+		{"xml", "", "unknown format"},
+	}
+	for _, tt := range tests {
+		_, err := Import(ctx, repository.NewMemoryRepo(), nil, strings.NewReader(tt.input), tt.format)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Import(%s, %q) = %v, want an error containing %q", tt.format, tt.input, err, tt.want)
+		}
+	}
+}
+
+// Test Verify reports links changed or missing after the import
+func TestVerifyMismatch(t *testing.T) {
+	ctx := context.TODO()
+	repo := repository.NewMemoryRepo()
+	input := `{"id": 1, "longURL": "https://example.com/a", "createdAt": "2024-11-01T10:00:00Z"}
+{"id": 2, "longURL": "https://example.com/b", "createdAt": "2024-11-01T10:00:00Z"}`
+	result, err := Import(ctx, repo, nil, strings.NewReader(input), FormatNDJSON)
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if err := repo.IncrementAccessCount(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	err = Verify(ctx, repo, result)
+	if err == nil || !strings.Contains(err.Error(), "1 links differ") {
+		t.Errorf("Expected a mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Canonicalizer reduces a URL to a canonical form, so spellings of the same address such as
+// https://Example.com:443/a/../b and https://example.com/b are recognised as duplicates.
+// The canonical form is only used as a dedupe key, links still redirect to the URL as given.
+type Canonicalizer struct {
+	// StripTracking drops analytics parameters such as utm_source and fbclid from the query
+	StripTracking bool
+}
+
+// defaultCanonicalizer keeps every query parameter
+var defaultCanonicalizer = &Canonicalizer{}
+
+// canonicalizer is the canonicalizer used by CanonicalURL
+var canonicalizer = defaultCanonicalizer
+
+// SetCanonicalizer sets the canonicalizer used by CanonicalURL. Call it once at startup.
+func SetCanonicalizer(c *Canonicalizer) {
+	if c == nil {
+		c = defaultCanonicalizer
+	}
+	canonicalizer = c
+}
+
+// CanonicalURL returns the canonical form of a URL using the configured canonicalizer
+func CanonicalURL(rawURL string) (string, error) {
+	return canonicalizer.Canonicalize(rawURL)
+}
+
+// trackingParams are query parameters that identify a campaign or click rather than the page.
+// Parameters starting with utm_ are also stripped.
+var trackingParams = map[string]bool{
+	"fbclid":    true,
+	"gclid":     true,
+	"dclid":     true,
+	"gbraid":    true,
+	"wbraid":    true,
+	"msclkid":   true,
+	"yclid":     true,
+	"twclid":    true,
+	"igshid":    true,
+	"mc_cid":    true,
+	"mc_eid":    true,
+	"_ga":       true,
+	"_gl":       true,
+	"li_fat_id": true,
+}
+
+// Canonicalize returns the canonical form of rawURL: the scheme and host are lowercased,
+// internationalised hosts are converted to punycode, default ports are removed, percent-encoding
+// is normalised, dot segments are resolved and query parameters are sorted by name. The fragment
+// is kept, as single page apps route on it and #/settings and #/billing are different pages.
+func (c *Canonicalizer) Canonicalize(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", &URLError{Reason: "invalid URL format"}
+	}
+
+	var b strings.Builder
+	scheme := strings.ToLower(u.Scheme)
+	b.WriteString(scheme)
+	b.WriteString("://")
+	if u.User != nil {
+		b.WriteString(u.User.String())
+		b.WriteByte('@')
+	}
+	b.WriteString(canonicalHost(u.Hostname()))
+	if port := u.Port(); port != "" && !(scheme == "http" && port == "80") && !(scheme == "https" && port == "443") {
+		b.WriteByte(':')
+		b.WriteString(port)
+	}
+
+	path := removeDotSegments(normalizeEscapes(u.EscapedPath()))
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString(path)
+
+	if query := c.canonicalQuery(u.RawQuery); query != "" {
+		b.WriteByte('?')
+		b.WriteString(query)
+	}
+	if fragment := normalizeEscapes(u.EscapedFragment()); fragment != "" {
+		b.WriteByte('#')
+		b.WriteString(fragment)
+	}
+	return b.String(), nil
+}
+
+// canonicalHost lowercases the host and converts internationalised names to punycode.
+// Hosts the IDNA lookup profile rejects, such as names with underscores, are kept lowercased.
+func canonicalHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if strings.Contains(host, ":") {
+		// IPv6 literal
+		return "[" + host + "]"
+	}
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		return ascii
+	}
+	return host
+}
+
+// canonicalQuery normalises the escapes of each parameter, drops empty and tracking parameters
+// and sorts the rest by name. Repeated names keep their relative order, as it can be significant.
+func (c *Canonicalizer) canonicalQuery(rawQuery string) string {
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		param = normalizeEscapes(param)
+		if c.StripTracking && isTrackingParam(queryParamName(param)) {
+			continue
+		}
+		params = append(params, param)
+	}
+	sort.SliceStable(params, func(i, j int) bool {
+		return queryParamName(params[i]) < queryParamName(params[j])
+	})
+	return strings.Join(params, "&")
+}
+
+// queryParamName returns the name part of a name=value query parameter
+func queryParamName(param string) string {
+	name, _, _ := strings.Cut(param, "=")
+	return name
+}
+
+// isTrackingParam reports whether a query parameter name is a known tracking parameter
+func isTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "utm_") || trackingParams[name]
+}
+
+// normalizeEscapes decodes percent-encoded unreserved characters, which mean the same
+// either way, and uppercases the hex digits of every other escape (RFC 3986 section 6.2.2)
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+		decoded := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(decoded) {
+			b.WriteByte(decoded)
+		} else {
+			b.WriteByte('%')
+			b.WriteString(strings.ToUpper(s[i+1 : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+// removeDotSegments resolves "." and ".." path segments (RFC 3986 section 5.2.4).
+// Empty segments are kept, a/b and a//b can be different resources.
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			// Never pop the empty segment before the leading slash
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, segment)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+// isUnreserved reports whether c may appear in a URL without escaping in any component
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// maxCodeLength is the longest code whose domain, 52^n, still fits in an int64
+const maxCodeLength = 11
+
+// feistelRounds is the number of rounds in the ID permutation
+const feistelRounds = 4
+
+// ShortCodec maps IDs to short codes. With a secret, IDs are run through a keyed
+// Feistel permutation before encoding, so sequential IDs produce unrelated codes that
+// can't be enumerated. Each code length is its own format preserving domain:
+// an n character code permutes values below 52^n, with cycle walking to stay in range.
+//
+// Links created before obfuscation was enabled keep their plain codes: IDs up to
+// legacyMaxID still encode and decode as plain base 52, and are always shorter
+// than minLength so the two kinds of code can't be confused.
+type ShortCodec struct {
+	key         []byte
+	minLength   int
+	legacyMaxID int64
+}
+
+// plainCodec is the codec used when no secret is configured, codes are plain base 52
+var plainCodec = &ShortCodec{}
+
+// shortCodec is the codec used by EncodeID and DecodeID
+var shortCodec = plainCodec
+
+// NewShortCodec creates a codec. An empty secret disables obfuscation.
+func NewShortCodec(secret string, minLength int, legacyMaxID int64) (*ShortCodec, error) {
+	if secret == "" {
+		return plainCodec, nil
+	}
+	if minLength < 1 || minLength > maxCodeLength {
+		return nil, fmt.Errorf("short code min length must be between 1 and %d", maxCodeLength)
+	}
+	if legacyMaxID < 0 {
+		return nil, errors.New("legacy max ID must not be negative")
+	}
+	if legacyMaxID > 0 && len(Encode(legacyMaxID)) >= minLength {
+		return nil, fmt.Errorf("short code min length must be longer than legacy code %s", Encode(legacyMaxID))
+	}
+	return &ShortCodec{key: []byte(secret), minLength: minLength, legacyMaxID: legacyMaxID}, nil
+}
+
+// SetShortCodec sets the codec used by EncodeID and DecodeID. Call it once at startup.
+func SetShortCodec(c *ShortCodec) {
+	if c == nil {
+		c = plainCodec
+	}
+	shortCodec = c
+}
+
+// EncodeID returns the public short code for an ID using the configured codec
+func EncodeID(id int64) string {
+	return shortCodec.Encode(id)
+}
+
+// DecodeID returns the ID for a short code using the configured codec, or -1 if the code is not valid
+func DecodeID(code string) int64 {
+	return shortCodec.Decode(code)
+}
+
+// Encode returns the short code for id
+func (c *ShortCodec) Encode(id int64) string {
+	if c.key == nil || id <= c.legacyMaxID {
+		return Encode(id)
+	}
+	n := c.lengthFor(id)
+	code := Encode(c.permute(id, n))
+	// Pad with the zero digit so the length identifies the domain
+	return strings.Repeat(string(alphabet[0]), n-len(code)) + code
+}
+
+// Decode returns the ID for code, or -1 if it is not a code this codec could have produced
+func (c *ShortCodec) Decode(code string) int64 {
+	if code == "" || len(code) > maxCodeLength {
+		return -1
+	}
+	value := Decode(code)
+	if value == -1 {
+		return -1
+	}
+	if c.key == nil {
+		return value
+	}
+	if len(code) < c.minLength {
+		// Only legacy links were ever given codes this short
+		if value > c.legacyMaxID {
+			return -1
+		}
+		return value
+	}
+	id := c.unpermute(value, len(code))
+	// Reject codes from the wrong domain, such as IDs that would encode shorter
+	if id <= c.legacyMaxID || c.lengthFor(id) != len(code) {
+		return -1
+	}
+	return id
+}
+
+// lengthFor returns the code length used for id, the smallest n >= minLength with id < 52^n
+func (c *ShortCodec) lengthFor(id int64) int {
+	n := c.minLength
+	for n < maxCodeLength && id >= pow52(n) {
+		n++
+	}
+	return n
+}
+
+// permute applies the keyed permutation of [0, 52^n), cycle walking until the value is in range
+func (c *ShortCodec) permute(v int64, n int) int64 {
+	limit := uint64(pow52(n))
+	halfBits := feistelHalfBits(limit)
+	x := uint64(v)
+	for {
+		x = c.feistel(x, halfBits, n, false)
+		if x < limit {
+			return int64(x)
+		}
+	}
+}
+
+// unpermute is the inverse of permute
+func (c *ShortCodec) unpermute(v int64, n int) int64 {
+	limit := uint64(pow52(n))
+	halfBits := feistelHalfBits(limit)
+	x := uint64(v)
+	for {
+		x = c.feistel(x, halfBits, n, true)
+		if x < limit {
+			return int64(x)
+		}
+	}
+}
+
+// feistel runs a balanced Feistel network over 2*halfBits bit values
+func (c *ShortCodec) feistel(x uint64, halfBits uint, n int, inverse bool) uint64 {
+	mask := uint64(1)<<halfBits - 1
+	left, right := x>>halfBits, x&mask
+	for i := 0; i < feistelRounds; i++ {
+		round := i
+		if inverse {
+			round = feistelRounds - 1 - i
+			left, right = right^(c.round(left, round, n)&mask), left
+		} else {
+			left, right = right, left^(c.round(right, round, n)&mask)
+		}
+	}
+	return left<<halfBits | right
+}
+
+// round is the Feistel round function, an HMAC of the half block keyed by the secret
+func (c *ShortCodec) round(half uint64, round int, n int) uint64 {
+	mac := hmac.New(sha256.New, c.key)
+	var buf [10]byte
+	buf[0] = byte(round)
+	buf[1] = byte(n)
+	binary.BigEndian.PutUint64(buf[2:], half)
+	mac.Write(buf[:])
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// feistelHalfBits returns half the bit width of the smallest even width power of two >= limit
+func feistelHalfBits(limit uint64) uint {
+	width := uint(bits.Len64(limit - 1))
+	if width%2 == 1 {
+		width++
+	}
+	return width / 2
+}
+
+// pow52 returns 52^n
+func pow52(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= base
+	}
+	return p
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"testing"
+)
+
+// Test that obfuscated codes round trip and are unique
+func TestShortCodecRoundTrip(t *testing.T) {
+	codec, err := NewShortCodec("test-secret", 6, 0)
+	if err != nil {
+		t.Fatalf("Failed to create codec: %v", err)
+	}
+
+	seen := make(map[string]int64)
+	ids := []int64{1, 2, 3, 52, 1000, 123456, pow52(6) - 1, pow52(6), pow52(7) + 5, 1 << 62}
+	for id := int64(1); id < 2000; id++ {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		code := codec.Encode(id)
+		if len(code) < 6 {
+			t.Errorf("Code %s for ID %d is shorter than the minimum length", code, id)
+		}
+		if other, ok := seen[code]; ok && other != id {
+			t.Fatalf("IDs %d and %d share code %s", other, id, code)
+		}
+		seen[code] = id
+		if got := codec.Decode(code); got != id {
+			t.Errorf("Decode(Encode(%d)) = %d, code %s", id, got, code)
+		}
+	}
+}
+
+// Test that consecutive IDs don't produce consecutive codes
+func TestShortCodecNotSequential(t *testing.T) {
+	codec, err := NewShortCodec("test-secret", 6, 0)
+	if err != nil {
+		t.Fatalf("Failed to create codec: %v", err)
+	}
+	sequential := 0
+	for id := int64(1); id < 100; id++ {
+		if Decode(codec.Encode(id+1))-Decode(codec.Encode(id)) == 1 {
+			sequential++
+		}
+	}
+	if sequential > 2 {
+		t.Errorf("Expected codes to look random, %d of 99 were sequential", sequential)
+	}
+
+	// A different secret produces different codes
+	other, _ := NewShortCodec("other-secret", 6, 0)
+	if codec.Encode(42) == other.Encode(42) {
+		t.Errorf("Expected the secret to change the code")
+	}
+}
+
+// Test that links created before obfuscation keep resolving
+func TestShortCodecLegacyCodes(t *testing.T) {
+	codec, err := NewShortCodec("test-secret", 6, 5000)
+	if err != nil {
+		t.Fatalf("Failed to create codec: %v", err)
+	}
+
+	// Legacy IDs keep their plain code in both directions
+	if got := codec.Encode(4321); got != Encode(4321) {
+		t.Errorf("Expected legacy ID to keep code %s, got %s", Encode(4321), got)
+	}
+	if got := codec.Decode(Encode(4321)); got != 4321 {
+		t.Errorf("Expected legacy code to decode to 4321, got %d", got)
+	}
+
+	// New IDs can't be reached by walking plain codes
+	if got := codec.Decode(Encode(5001)); got != -1 {
+		t.Errorf("Expected plain code for a new ID to be rejected, got %d", got)
+	}
+	if got := codec.Decode(codec.Encode(5001)); got != 5001 {
+		t.Errorf("Expected obfuscated code to decode to 5001, got %d", got)
+	}
+
+	// The minimum length must leave room for every legacy code
+	if _, err := NewShortCodec("test-secret", 2, 5000); err == nil {
+		t.Errorf("Expected a min length clashing with legacy codes to be rejected")
+	}
+}
+
+// Test that without a secret codes are plain base 52
+func TestShortCodecPlain(t *testing.T) {
+	codec, err := NewShortCodec("", 6, 0)
+	if err != nil {
+		t.Fatalf("Failed to create codec: %v", err)
+	}
+	if got := codec.Encode(12345); got != Encode(12345) {
+		t.Errorf("Expected plain code %s, got %s", Encode(12345), got)
+	}
+	if got := codec.Decode(Encode(12345)); got != 12345 {
+		t.Errorf("Expected 12345, got %d", got)
+	}
+}
@@ -2,9 +2,9 @@ package utils
 
 import (
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -12,15 +12,11 @@ import (
 // Creates a short URL based on creation timestamp
 // this has since been replaced with the encode/ decode functions
 func GetShortCode() string {
-	fmt.Println("Shortening URL")
-
 	ts := time.Now().UnixNano()
-	fmt.Println("Timestamp: ", ts)
 
 	// We convert the timestamp to byte slice and then encode it to base64 string
 	ts_bytes := []byte(fmt.Sprintf("%d", ts))
 	key := base64.StdEncoding.EncodeToString(ts_bytes)
-	fmt.Println("Key: ", key)
 
 	// We remove the last two chars since they are always equal signs (==)
 	key = key[:len(key)-2]
@@ -64,31 +60,69 @@ func Decode(encoded string) int64 {
 	return num
 }
 
+// URLError is returned by SanitizeURL when the input is rejected,
+// so callers can tell bad user input apart from storage failures
+type URLError struct {
+	Reason string
+}
+
+func (e *URLError) Error() string {
+	return e.Reason
+}
+
+// aliasPattern is the extended charset allowed for custom aliases
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,32}$`)
+
+// ValidateAlias checks a custom alias against the alias charset.
+// Aliases made only of alphabet characters are rejected, as they would decode
+// to a numeric ID and collide with a generated short code now or in the future.
+func ValidateAlias(alias string) error {
+	if !aliasPattern.MatchString(alias) {
+		return &URLError{Reason: "alias must be 3-32 letters, digits, '-' or '_'"}
+	}
+	if Decode(alias) != -1 {
+		return &URLError{Reason: "alias is reserved for generated short codes, include a vowel, '-' or '_'"}
+	}
+	return nil
+}
+
+// IsValidShortCode reports whether code is either a generated short code or a well formed alias
+func IsValidShortCode(code string) bool {
+	if code == "" {
+		return false
+	}
+	return Decode(code) != -1 || ValidateAlias(code) == nil
+}
+
 // basic URL sanitisation
 func SanitizeURL(rawURL string) (string, error) {
 	if len(rawURL) > 2048 {
-		return "", errors.New("URL is too long")
+		return "", &URLError{Reason: "URL is too long"}
 	}
 	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
-		return "", errors.New("invalid URL format")
+		return "", &URLError{Reason: "invalid URL format"}
 	}
 	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
-		return "", errors.New("URL must start with http or https")
+		return "", &URLError{Reason: "URL must start with http or https"}
 	}
 	decodedPath, err := url.PathUnescape(parsedURL.Path)
 	if err != nil {
-		return "", errors.New("error decoding URL path")
+		return "", &URLError{Reason: "error decoding URL path"}
 	}
 	decodedQuery, err := url.QueryUnescape(parsedURL.RawQuery)
 	if err != nil {
-		return "", errors.New("error decoding URL query")
+		return "", &URLError{Reason: "error decoding URL query"}
 	}
 	combined := decodedPath + decodedQuery
 	lowerCombined := strings.ToLower(combined)
 	if strings.Contains(lowerCombined, "javascript:") || strings.Contains(lowerCombined, "<script>") {
-		return "", errors.New("URL contains potentially malicious content")
+		return "", &URLError{Reason: "URL contains potentially malicious content"}
 	}
 	sanitizedURL := parsedURL.Scheme + "://" + parsedURL.Host + parsedURL.RequestURI()
+	// Single page apps route on the fragment, so it is part of the destination
+	if fragment := parsedURL.EscapedFragment(); fragment != "" {
+		sanitizedURL += "#" + fragment
+	}
 	return sanitizedURL, nil
 }
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"encoding/base64"
+	"errors"
 	"testing"
 )
 
@@ -41,3 +42,51 @@ func TestGetShortCodeBase64(t *testing.T) {
 		t.Errorf("Generated short code is not valid base64: %v", err)
 	}
 }
+
+// Test that SanitizeURL rejects bad input with a URLError
+func TestSanitizeURLError(t *testing.T) {
+	_, err := SanitizeURL("ftp://example.com")
+	var urlErr *URLError
+	if !errors.As(err, &urlErr) {
+		t.Fatalf("Expected URLError, got %v", err)
+	}
+
+	sanitized, err := SanitizeURL("https://example.com/path?q=1")
+	if err != nil {
+		t.Fatalf("Expected valid URL, got %v", err)
+	}
+	if sanitized != "https://example.com/path?q=1" {
+		t.Errorf("Unexpected sanitized URL: %s", sanitized)
+	}
+
+	sanitized, err = SanitizeURL("https://app.example.com/?q=1#/billing")
+	if err != nil {
+		t.Fatalf("Expected valid URL, got %v", err)
+	}
+	if sanitized != "https://app.example.com/?q=1#/billing" {
+		t.Errorf("Expected the fragment to be kept, got %s", sanitized)
+	}
+}
+
+// Test alias validation against the charset and the generated code space
+func TestValidateAlias(t *testing.T) {
+	valid := []string{"launch2026", "summer-sale", "my_link"}
+	for _, alias := range valid {
+		if err := ValidateAlias(alias); err != nil {
+			t.Errorf("Expected alias %q to be valid, got %v", alias, err)
+		}
+	}
+
+	invalid := []string{
+		"ab",              // too short
+		"has space",       // invalid character
+		"bcd",             // decodes to a numeric ID
+		Encode(123456789), // generated short code
+		"a-very-long-alias-that-goes-past-the-limit",
+	}
+	for _, alias := range invalid {
+		if err := ValidateAlias(alias); err == nil {
+			t.Errorf("Expected alias %q to be rejected", alias)
+		}
+	}
+}